@@ -0,0 +1,105 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package bcrypt_pbkdf implements bcrypt_pbkdf, the key derivation
+// function OpenSSH uses to encrypt private keys. It is a variant of
+// PBKDF2 that uses a bcrypt-like hash as its pseudorandom function. See
+// http://www.tedunangst.com/flak/post/bcrypt-pbkdf.
+package bcrypt_pbkdf
+
+import (
+	"crypto/sha512"
+	"errors"
+
+	"github.com/massiveart/go.crypto/blowfish"
+)
+
+const blockSize = 32
+
+// magic is encrypted by the bcrypt hash, like "OrpheanBeholderScryDoubt"
+// in bcrypt.
+var magic = []byte("OxychromaticBlowfishSwatDynamite")
+
+// Key derives a key of length keyLen from password and salt, iterating
+// the hash rounds times. Unlike PBKDF2, the output blocks are
+// interleaved, so every byte of the key depends on all rounds of every
+// block.
+func Key(password, salt []byte, rounds, keyLen int) ([]byte, error) {
+	if rounds < 1 {
+		return nil, errors.New("bcrypt_pbkdf: number of rounds is too small")
+	}
+	if len(password) == 0 {
+		return nil, errors.New("bcrypt_pbkdf: empty password")
+	}
+	if len(salt) == 0 || len(salt) > 1<<20 {
+		return nil, errors.New("bcrypt_pbkdf: bad salt length")
+	}
+	if keyLen < 1 || keyLen > 1024 {
+		return nil, errors.New("bcrypt_pbkdf: bad key length")
+	}
+
+	numBlocks := (keyLen + blockSize - 1) / blockSize
+	key := make([]byte, numBlocks*blockSize)
+
+	h := sha512.New()
+	h.Write(password)
+	shapass := h.Sum(nil)
+
+	var cnt [4]byte
+	var shasalt []byte
+	out := make([]byte, blockSize)
+	tmp := make([]byte, blockSize)
+	for block := 1; block <= numBlocks; block++ {
+		h.Reset()
+		h.Write(salt)
+		cnt[0] = byte(block >> 24)
+		cnt[1] = byte(block >> 16)
+		cnt[2] = byte(block >> 8)
+		cnt[3] = byte(block)
+		h.Write(cnt[:])
+		shasalt = h.Sum(shasalt[:0])
+		bcryptHash(tmp, shapass, shasalt)
+		copy(out, tmp)
+
+		for i := 1; i < rounds; i++ {
+			h.Reset()
+			h.Write(tmp)
+			shasalt = h.Sum(shasalt[:0])
+			bcryptHash(tmp, shapass, shasalt)
+			for j := range out {
+				out[j] ^= tmp[j]
+			}
+		}
+
+		for i, v := range out {
+			key[i*numBlocks+block-1] = v
+		}
+	}
+	return key[:keyLen], nil
+}
+
+// bcryptHash computes the bcrypt-like hash of the SHA-512 digests of a
+// password and a salt.
+func bcryptHash(out, shapass, shasalt []byte) {
+	c, err := blowfish.NewSaltedCipher(shapass, shasalt)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < 64; i++ {
+		blowfish.ExpandKey(shasalt, c)
+		blowfish.ExpandKey(shapass, c)
+	}
+
+	copy(out, magic)
+	for i := 0; i < blockSize; i += blowfish.BlockSize {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(out[i:i+blowfish.BlockSize], out[i:i+blowfish.BlockSize])
+		}
+	}
+	// The reference implementation outputs the words in little-endian
+	// order.
+	for i := 0; i < blockSize; i += 4 {
+		out[i], out[i+1], out[i+2], out[i+3] = out[i+3], out[i+2], out[i+1], out[i]
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bcrypt_pbkdf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+var golden = []struct {
+	password, salt string
+	rounds         int
+	key            string
+}{
+	{
+		"password", "salt", 4,
+		"5bbf0cc293587f1c3635555c27796598d47e579071bf427e9d8fbe842aba34d9",
+	},
+	{
+		"password", "salt", 12,
+		"1aa6a5e4c6222c0511053952d4e05887f7dbbc8b020259e2f6f1c849347b21ac" +
+			"8ca4abdeeb8e7ce4ff1aeadaa6931927bc2279acb93efe436913c53c5f2e82da" +
+			"58bb99582397034f4cbe9106",
+	},
+	// The key and IV of a private key encrypted by ssh-keygen.
+	{
+		"hunter2", "\x2b\x16\x6b\xf6\xb5\xac\x81\x31\x72\x12\x6e\x65\x5f\x13\x6b\x5e", 4,
+		"f1e0d712259bd0cc44ab4d3debfc9d9d7160140c1033247f684658e3c36e52c4" +
+			"bbdd08292f7855f22cec34eb0c5e4db7",
+	},
+}
+
+func TestKey(t *testing.T) {
+	for i, test := range golden {
+		want, _ := hex.DecodeString(test.key)
+		got, err := Key([]byte(test.password), []byte(test.salt), test.rounds, len(want))
+		if err != nil {
+			t.Errorf("#%d: Key: %v", i, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("#%d: got %x, want %x", i, got, want)
+		}
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	// Blocks are interleaved, so a shorter key is not a prefix of a
+	// longer one.
+	short, _ := Key([]byte("password"), []byte("salt"), 2, 32)
+	long, _ := Key([]byte("password"), []byte("salt"), 2, 64)
+	if bytes.Equal(short, long[:32]) {
+		t.Errorf("short key is a prefix of the long key")
+	}
+}
+
+func TestKeyErrors(t *testing.T) {
+	for i, test := range []struct {
+		password, salt string
+		rounds, keyLen int
+	}{
+		{"password", "salt", 0, 32},
+		{"", "salt", 1, 32},
+		{"password", "", 1, 32},
+		{"password", "salt", 1, 0},
+		{"password", "salt", 1, 1025},
+	} {
+		if _, err := Key([]byte(test.password), []byte(test.salt), test.rounds, test.keyLen); err == nil {
+			t.Errorf("#%d: Key succeeded with bad parameters", i)
+		}
+	}
+}
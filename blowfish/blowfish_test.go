@@ -208,3 +208,22 @@ func TestSaltedCipherKeyLength(t *testing.T) {
 		t.Errorf("NewSaltedCipher with long key, gave error %#v", err)
 	}
 }
+
+func TestSaltedCipherLongSalt(t *testing.T) {
+	key := []byte("secret")
+	salt := []byte("0123456789abcdef")
+	c1, err := NewSaltedCipher(key, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Salts are used cyclically, so repeating the salt is a no-op.
+	c2, _ := NewSaltedCipher(key, append(salt, salt...))
+	if *c1 != *c2 {
+		t.Errorf("repeated salt gave a different cipher")
+	}
+	// But bytes beyond the 16th must be taken into account.
+	c3, _ := NewSaltedCipher(key, append(salt, 'x'))
+	if *c1 == *c3 {
+		t.Errorf("salt bytes after the 16th were ignored")
+	}
+}
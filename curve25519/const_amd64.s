@@ -7,14 +7,16 @@
 
 // +build amd64,!gccgo
 
+// The constants are read-only data (flag 8, RODATA) and hold no pointers.
+
 DATA ·REDMASK51(SB)/8, $0x0007FFFFFFFFFFFF
-GLOBL ·REDMASK51(SB), $8
+GLOBL ·REDMASK51(SB), 8, $8
 
 DATA ·_121666_213(SB)/8, $996687872
-GLOBL ·_121666_213(SB), $8
+GLOBL ·_121666_213(SB), 8, $8
 
 DATA ·_2P0(SB)/8, $0xFFFFFFFFFFFDA
-GLOBL ·_2P0(SB), $8
+GLOBL ·_2P0(SB), 8, $8
 
 DATA ·_2P1234(SB)/8, $0xFFFFFFFFFFFFE
-GLOBL ·_2P1234(SB), $8
+GLOBL ·_2P1234(SB), 8, $8
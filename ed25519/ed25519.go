@@ -0,0 +1,149 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ed25519 implements the Ed25519 signature algorithm. See
+// http://ed25519.cr.yp.to/.
+//
+// Private keys are stored as the 32-byte seed followed by the public
+// key, as in NaCl and OpenSSH.
+package ed25519
+
+import (
+	"crypto/sha512"
+	"crypto/subtle"
+	"io"
+)
+
+const (
+	PublicKeySize  = 32
+	PrivateKeySize = 64
+	SignatureSize  = 64
+	SeedSize       = 32
+)
+
+// GenerateKey generates a public/private key pair using randomness from
+// rand.
+func GenerateKey(rand io.Reader) (publicKey *[PublicKeySize]byte, privateKey *[PrivateKeySize]byte, err error) {
+	var seed [SeedSize]byte
+	if _, err = io.ReadFull(rand, seed[:]); err != nil {
+		return nil, nil, err
+	}
+	publicKey, privateKey = NewKeyFromSeed(&seed)
+	return publicKey, privateKey, nil
+}
+
+// NewKeyFromSeed derives the key pair for seed.
+func NewKeyFromSeed(seed *[SeedSize]byte) (publicKey *[PublicKeySize]byte, privateKey *[PrivateKeySize]byte) {
+	var a [32]byte
+	digest := sha512.Sum512(seed[:])
+	copy(a[:], digest[:32])
+	clamp(&a)
+
+	var A extendedPoint
+	A.scalarMult(&a, &basePoint)
+
+	publicKey = new([PublicKeySize]byte)
+	A.toBytes(publicKey)
+	privateKey = new([PrivateKeySize]byte)
+	copy(privateKey[:], seed[:])
+	copy(privateKey[32:], publicKey[:])
+	return publicKey, privateKey
+}
+
+// clamp turns the first half of the hashed seed into the secret scalar.
+func clamp(a *[32]byte) {
+	a[0] &= 248
+	a[31] &= 127
+	a[31] |= 64
+}
+
+// Sign signs message with privateKey and returns the signature.
+func Sign(privateKey *[PrivateKeySize]byte, message []byte) *[SignatureSize]byte {
+	digest := sha512.Sum512(privateKey[:32])
+	var a [32]byte
+	copy(a[:], digest[:32])
+	clamp(&a)
+
+	h := sha512.New()
+	h.Write(digest[32:])
+	h.Write(message)
+	var rDigest [64]byte
+	h.Sum(rDigest[:0])
+	var r [32]byte
+	scReduce(&r, &rDigest)
+
+	var R extendedPoint
+	R.scalarMult(&r, &basePoint)
+	var encodedR [32]byte
+	R.toBytes(&encodedR)
+
+	h.Reset()
+	h.Write(encodedR[:])
+	h.Write(privateKey[32:])
+	h.Write(message)
+	var kDigest [64]byte
+	h.Sum(kDigest[:0])
+	var k [32]byte
+	scReduce(&k, &kDigest)
+
+	var s [32]byte
+	scMulAdd(&s, &k, &a, &r)
+
+	sig := new([SignatureSize]byte)
+	copy(sig[:], encodedR[:])
+	copy(sig[32:], s[:])
+	return sig
+}
+
+// order is the group order l in little-endian form.
+var order = [32]byte{
+	0xed, 0xd3, 0xf5, 0x5c, 0x1a, 0x63, 0x12, 0x58,
+	0xd6, 0x9c, 0xf7, 0xa2, 0xde, 0xf9, 0xde, 0x14,
+	0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0x10,
+}
+
+// scIsCanonical reports whether s < l.
+func scIsCanonical(s []byte) bool {
+	for i := 31; i >= 0; i-- {
+		if s[i] != order[i] {
+			return s[i] < order[i]
+		}
+	}
+	return false
+}
+
+// Verify reports whether sig is a valid signature of message by
+// publicKey.
+func Verify(publicKey *[PublicKeySize]byte, message []byte, sig *[SignatureSize]byte) bool {
+	if !scIsCanonical(sig[32:]) {
+		return false
+	}
+	var A extendedPoint
+	if !A.fromBytes(publicKey) {
+		return false
+	}
+
+	h := sha512.New()
+	h.Write(sig[:32])
+	h.Write(publicKey[:])
+	h.Write(message)
+	var kDigest [64]byte
+	h.Sum(kDigest[:0])
+	var k [32]byte
+	scReduce(&k, &kDigest)
+
+	// Check that R = s*B - k*A.
+	var s [32]byte
+	copy(s[:], sig[32:])
+	var sB, kA, R extendedPoint
+	sB.scalarMult(&s, &basePoint)
+	kA.scalarMult(&k, &A)
+	kA.neg(&kA)
+	R.add(&sB, &kA)
+
+	var encodedR [32]byte
+	R.toBytes(&encodedR)
+	return subtle.ConstantTimeCompare(encodedR[:], sig[:32]) == 1
+}
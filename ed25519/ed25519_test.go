@@ -0,0 +1,168 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ed25519
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+// Test vectors from RFC 8032, section 7.1.
+var rfcTests = []struct {
+	seed, pub, msg, sig string
+}{
+	{
+		"9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60",
+		"d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+		"",
+		"e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b",
+	},
+	{
+		"4ccd089b28ff96da9db6c346ec114e0f5b8a319f35aba624da8cf6ed4fb8a6fb",
+		"3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c",
+		"72",
+		"92a009a9f0d4cab8720e820b5f642540a2b27b5416503f8fb3762223ebdb69da085ac1e43e15996e458f3613d0f11d8c387b2eaeb4302aeeb00d291612bb0c00",
+	},
+	{
+		"c5aa8df43f9f837bedb7442f31dcb7b166d38535076f094b85ce3a2e0b4458f7",
+		"fc51cd8e6218a1a38da47ed00230f0580816ed13ba3303ac5deb911548908025",
+		"af82",
+		"6291d657deec24024827e69c3abe01a30ce548a284743a445e3680d7db5ac3ac18ff9b538d16f290ae67f760984dc6594a7c15e9716ed28dc027beceea1ec40a",
+	},
+}
+
+func fromHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRFCVectors(t *testing.T) {
+	for i, test := range rfcTests {
+		var seed [SeedSize]byte
+		copy(seed[:], fromHex(t, test.seed))
+		pub, priv := NewKeyFromSeed(&seed)
+		if want := fromHex(t, test.pub); !bytes.Equal(pub[:], want) {
+			t.Errorf("#%d: got public key %x, want %x", i, pub[:], want)
+		}
+		msg := fromHex(t, test.msg)
+		sig := Sign(priv, msg)
+		if want := fromHex(t, test.sig); !bytes.Equal(sig[:], want) {
+			t.Errorf("#%d: got signature %x, want %x", i, sig[:], want)
+		}
+		if !Verify(pub, msg, sig) {
+			t.Errorf("#%d: signature does not verify", i)
+		}
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	pub, priv, err := GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := []byte("test message")
+	sig := Sign(priv, msg)
+	if !Verify(pub, msg, sig) {
+		t.Errorf("valid signature rejected")
+	}
+	if Verify(pub, []byte("wrong message"), sig) {
+		t.Errorf("signature of a different message accepted")
+	}
+
+	for _, i := range []int{0, 31, 32, 63} {
+		bad := *sig
+		bad[i] ^= 1
+		if Verify(pub, msg, &bad) {
+			t.Errorf("signature with flipped bit in byte %d accepted", i)
+		}
+	}
+
+	// Adding l to s gives an equivalent, but non-canonical, signature.
+	l := new(big.Int).SetBytes(reverse(order[:]))
+	s := new(big.Int).SetBytes(reverse(sig[32:]))
+	s.Add(s, l)
+	malleable := *sig
+	copy(malleable[32:], reverse(s.Bytes()))
+	if Verify(pub, msg, &malleable) {
+		t.Errorf("non-canonical signature accepted")
+	}
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, v := range b {
+		r[len(b)-1-i] = v
+	}
+	return r
+}
+
+func TestScalarArithmetic(t *testing.T) {
+	l := new(big.Int).SetBytes(reverse(order[:]))
+	toBig := func(b []byte) *big.Int { return new(big.Int).SetBytes(reverse(b)) }
+
+	var inputs [][64]byte
+	var allOnes [64]byte
+	for i := range allOnes {
+		allOnes[i] = 0xff
+	}
+	inputs = append(inputs, [64]byte{}, allOnes)
+	for i := 0; i < 100; i++ {
+		var in [64]byte
+		rand.Read(in[:])
+		inputs = append(inputs, in)
+	}
+
+	for _, in := range inputs {
+		var out [32]byte
+		scReduce(&out, &in)
+		want := new(big.Int).Mod(toBig(in[:]), l)
+		if toBig(out[:]).Cmp(want) != 0 {
+			t.Errorf("scReduce(%x) = %x, want %x", in, out, want)
+		}
+
+		var a, b, c, s [32]byte
+		scReduce(&a, &in)
+		copy(b[:], in[32:])
+		b[31] &= 0x7f // as large as a clamped secret scalar
+		copy(c[:], in[:32])
+		c[31] &= 0x0f
+		scMulAdd(&s, &a, &b, &c)
+		want.Mul(toBig(a[:]), toBig(b[:]))
+		want.Add(want, toBig(c[:]))
+		want.Mod(want, l)
+		if toBig(s[:]).Cmp(want) != 0 {
+			t.Errorf("scMulAdd(%x, %x, %x) = %x, want %x", a, b, c, s, want)
+		}
+	}
+}
+
+func BenchmarkSign(b *testing.B) {
+	_, priv, err := GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	msg := []byte("benchmark message")
+	for i := 0; i < b.N; i++ {
+		Sign(priv, msg)
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	pub, priv, err := GenerateKey(rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	msg := []byte("benchmark message")
+	sig := Sign(priv, msg)
+	for i := 0; i < b.N; i++ {
+		Verify(pub, msg, sig)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ed25519
+
+import (
+	"math/big"
+)
+
+// Group arithmetic on the twisted Edwards curve -x^2 + y^2 = 1 + d x^2 y^2
+// over GF(2^255 - 19), which is birationally equivalent to curve25519.
+
+var (
+	// d is the curve constant -121665/121666, d2 is 2*d.
+	d, d2 fieldElement
+	// sqrtM1 is a square root of -1.
+	sqrtM1 fieldElement
+	// basePoint is the generator B, whose y coordinate is 4/5.
+	basePoint extendedPoint
+)
+
+func init() {
+	p := new(big.Int).Lsh(big.NewInt(1), 255)
+	p.Sub(p, big.NewInt(19))
+
+	n := new(big.Int).ModInverse(big.NewInt(121666), p)
+	n.Mul(n, big.NewInt(-121665))
+	n.Mod(n, p)
+	feFromBig(&d, n)
+	feAdd(&d2, &d, &d)
+
+	e := new(big.Int).Sub(p, big.NewInt(1))
+	e.Rsh(e, 2)
+	n.Exp(big.NewInt(2), e, p)
+	feFromBig(&sqrtM1, n)
+
+	n.ModInverse(big.NewInt(5), p)
+	n.Mul(n, big.NewInt(4))
+	n.Mod(n, p)
+	var s [32]byte
+	bigToBytes(&s, n)
+	if !basePoint.fromBytes(&s) {
+		panic("ed25519: invalid base point")
+	}
+}
+
+// bigToBytes writes n, which must be less than 2^256, to s in
+// little-endian form.
+func bigToBytes(s *[32]byte, n *big.Int) {
+	b := n.Bytes()
+	for i := range s {
+		s[i] = 0
+	}
+	for i, v := range b {
+		s[len(b)-1-i] = v
+	}
+}
+
+func feFromBig(fe *fieldElement, n *big.Int) {
+	var s [32]byte
+	bigToBytes(&s, n)
+	feFromBytes(fe, &s)
+}
+
+// extendedPoint is a point in extended coordinates (X:Y:Z:T), which
+// represent x = X/Z, y = Y/Z and x*y = T/Z. See "Twisted Edwards Curves
+// Revisited" by Hisil, Wong, Carter and Dawson.
+type extendedPoint struct {
+	X, Y, Z, T fieldElement
+}
+
+// zero sets p to the neutral element (0, 1).
+func (p *extendedPoint) zero() {
+	feZero(&p.X)
+	feOne(&p.Y)
+	feOne(&p.Z)
+	feZero(&p.T)
+}
+
+// add sets r = p + q. The formula is complete on this curve, so it
+// may also be used for doubling.
+func (r *extendedPoint) add(p, q *extendedPoint) {
+	var a, b, c, dd, e, f, g, h, t0, t1 fieldElement
+
+	feSub(&t0, &p.Y, &p.X)
+	feSub(&t1, &q.Y, &q.X)
+	feMul(&a, &t0, &t1)
+	feAdd(&t0, &p.Y, &p.X)
+	feAdd(&t1, &q.Y, &q.X)
+	feMul(&b, &t0, &t1)
+	feMul(&t0, &p.T, &q.T)
+	feMul(&c, &t0, &d2)
+	feMul(&t0, &p.Z, &q.Z)
+	feAdd(&dd, &t0, &t0)
+
+	feSub(&e, &b, &a)
+	feSub(&f, &dd, &c)
+	feAdd(&g, &dd, &c)
+	feAdd(&h, &b, &a)
+
+	feMul(&r.X, &e, &f)
+	feMul(&r.Y, &g, &h)
+	feMul(&r.T, &e, &h)
+	feMul(&r.Z, &f, &g)
+}
+
+// neg sets r = -p.
+func (r *extendedPoint) neg(p *extendedPoint) {
+	feNeg(&r.X, &p.X)
+	feCopy(&r.Y, &p.Y)
+	feCopy(&r.Z, &p.Z)
+	feNeg(&r.T, &p.T)
+}
+
+// cmove replaces p with q if b == 1 and leaves it unchanged if b == 0.
+func (p *extendedPoint) cmove(q *extendedPoint, b int32) {
+	feCMove(&p.X, &q.X, b)
+	feCMove(&p.Y, &q.Y, b)
+	feCMove(&p.Z, &q.Z, b)
+	feCMove(&p.T, &q.T, b)
+}
+
+// scalarMult sets r = a*p, where a is a 256-bit little-endian scalar.
+// It runs in time independent of a, using a fixed window of four bits
+// and a table lookup that touches every entry.
+func (r *extendedPoint) scalarMult(a *[32]byte, p *extendedPoint) {
+	var table [16]extendedPoint
+	table[0].zero()
+	table[1] = *p
+	for i := 2; i < len(table); i++ {
+		table[i].add(&table[i-1], p)
+	}
+
+	var q, t extendedPoint
+	q.zero()
+	for i := 63; i >= 0; i-- {
+		for j := 0; j < 4; j++ {
+			q.add(&q, &q)
+		}
+		w := int32(a[i/2]>>(uint(i&1)*4)) & 15
+		t.zero()
+		for j := range table {
+			t.cmove(&table[j], equal(int32(j), w))
+		}
+		q.add(&q, &t)
+	}
+	*r = q
+}
+
+// equal returns 1 if a == b and 0 otherwise, for a, b in [0, 2^31).
+func equal(a, b int32) int32 {
+	x := uint32(a ^ b)
+	x--
+	return int32(x >> 31)
+}
+
+// toBytes encodes p as the little-endian y coordinate with the sign of
+// x in the top bit.
+func (p *extendedPoint) toBytes(s *[32]byte) {
+	var recip, x, y fieldElement
+
+	feInvert(&recip, &p.Z)
+	feMul(&x, &p.X, &recip)
+	feMul(&y, &p.Y, &recip)
+	feToBytes(s, &y)
+	s[31] ^= byte(feIsNegative(&x) << 7)
+}
+
+// fromBytes sets p to the point encoded in s. It returns false if s is
+// not a valid encoding. It does not run in constant time.
+func (p *extendedPoint) fromBytes(s *[32]byte) bool {
+	var u, v, v3, vxx, check fieldElement
+
+	feFromBytes(&p.Y, s)
+	feOne(&p.Z)
+	feSquare(&u, &p.Y)
+	feMul(&v, &u, &d)
+	feSub(&u, &u, &p.Z) // u = y^2 - 1
+	feAdd(&v, &v, &p.Z) // v = d*y^2 + 1
+
+	// x = u*v^3 * (u*v^7)^((p-5)/8)
+	feSquare(&v3, &v)
+	feMul(&v3, &v3, &v)
+	feSquare(&p.X, &v3)
+	feMul(&p.X, &p.X, &v)
+	feMul(&p.X, &p.X, &u)
+	fePow22523(&p.X, &p.X)
+	feMul(&p.X, &p.X, &v3)
+	feMul(&p.X, &p.X, &u)
+
+	feSquare(&vxx, &p.X)
+	feMul(&vxx, &vxx, &v)
+	feSub(&check, &vxx, &u)
+	if feIsNonZero(&check) == 1 {
+		feAdd(&check, &vxx, &u)
+		if feIsNonZero(&check) == 1 {
+			return false
+		}
+		feMul(&p.X, &p.X, &sqrtM1)
+	}
+
+	sign := int32(s[31] >> 7)
+	if feIsNonZero(&p.X) == 0 && sign == 1 {
+		return false
+	}
+	if feIsNegative(&p.X) != sign {
+		feNeg(&p.X, &p.X)
+	}
+	feMul(&p.T, &p.X, &p.Y)
+	return true
+}
+
+// Arithmetic on scalars modulo the group order
+// l = 2^252 + 27742317777372353535851937790883648493. Scalars are
+// processed as signed 21-bit limbs, following ref10's sc_reduce and
+// sc_muladd.
+
+// scLoad splits the little-endian value s into 21-bit limbs. The last
+// limb receives the remaining top bits.
+func scLoad(limbs []int64, s []byte) {
+	for i := range limbs {
+		bit := 21 * i
+		v := load4(s[bit/8:]) >> uint(bit%8)
+		if i < len(limbs)-1 {
+			v &= 1<<21 - 1
+		}
+		limbs[i] = v
+	}
+}
+
+// scFold eliminates limb i > 11 by using 2^252 = -27742317777372353535851937790883648493
+// mod l, whose 21-bit limbs are the constants below.
+func scFold(s *[24]int64, i int) {
+	s[i-12] += s[i] * 666643
+	s[i-11] += s[i] * 470296
+	s[i-10] += s[i] * 654183
+	s[i-9] -= s[i] * 997805
+	s[i-8] += s[i] * 136657
+	s[i-7] -= s[i] * 683901
+	s[i] = 0
+}
+
+// scCarry propagates carries from limbs from to to-1 into the next
+// limb. If round is set, limbs are left in [-2^20, 2^20), otherwise in
+// [0, 2^21).
+func scCarry(s *[24]int64, from, to int, round bool) {
+	for i := from; i < to; i++ {
+		c := s[i]
+		if round {
+			c += 1 << 20
+		}
+		c >>= 21
+		s[i+1] += c
+		s[i] -= c << 21
+	}
+}
+
+// scReduceLimbs reduces the 504-bit value in s modulo l and writes the
+// result to out.
+func scReduceLimbs(out *[32]byte, s *[24]int64) {
+	for i := 23; i >= 18; i-- {
+		scFold(s, i)
+	}
+	scCarry(s, 6, 17, true)
+	for i := 17; i >= 12; i-- {
+		scFold(s, i)
+	}
+	scCarry(s, 0, 12, true)
+	scFold(s, 12)
+	scCarry(s, 0, 12, false)
+	scFold(s, 12)
+	scCarry(s, 0, 11, false)
+
+	var acc uint64
+	var n uint
+	j := 0
+	for i := 0; i < 12; i++ {
+		acc |= uint64(s[i]) << n
+		for n += 21; n >= 8 && j < len(out); n -= 8 {
+			out[j] = byte(acc)
+			acc >>= 8
+			j++
+		}
+	}
+	for ; j < len(out); j++ {
+		out[j] = byte(acc)
+		acc >>= 8
+	}
+}
+
+// scReduce sets out = s mod l, where s is a 512-bit little-endian value.
+func scReduce(out *[32]byte, s *[64]byte) {
+	var limbs [24]int64
+	scLoad(limbs[:], s[:])
+	scReduceLimbs(out, &limbs)
+}
+
+// scMulAdd sets s = (a*b + c) mod l, where a, b and c are 256-bit
+// little-endian values.
+func scMulAdd(s, a, b, c *[32]byte) {
+	var al, bl, cl [12]int64
+	scLoad(al[:], a[:])
+	scLoad(bl[:], b[:])
+	scLoad(cl[:], c[:])
+
+	var limbs [24]int64
+	copy(limbs[:], cl[:])
+	for i := range al {
+		for j := range bl {
+			limbs[i+j] += al[i] * bl[j]
+		}
+	}
+	scCarry(&limbs, 0, 23, true)
+	scReduceLimbs(s, &limbs)
+}
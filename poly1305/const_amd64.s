@@ -7,39 +7,41 @@
 
 // +build amd64,!gccgo
 
+// The constants are read-only data (flag 8, RODATA) and hold no pointers.
+
 DATA ·SCALE(SB)/8, $0x37F4000000000000
-GLOBL ·SCALE(SB), $8
+GLOBL ·SCALE(SB), 8, $8
 DATA ·TWO32(SB)/8, $0x41F0000000000000
-GLOBL ·TWO32(SB), $8
+GLOBL ·TWO32(SB), 8, $8
 DATA ·TWO64(SB)/8, $0x43F0000000000000
-GLOBL ·TWO64(SB), $8
+GLOBL ·TWO64(SB), 8, $8
 DATA ·TWO96(SB)/8, $0x45F0000000000000
-GLOBL ·TWO96(SB), $8
+GLOBL ·TWO96(SB), 8, $8
 DATA ·ALPHA32(SB)/8, $0x45E8000000000000
-GLOBL ·ALPHA32(SB), $8
+GLOBL ·ALPHA32(SB), 8, $8
 DATA ·ALPHA64(SB)/8, $0x47E8000000000000
-GLOBL ·ALPHA64(SB), $8
+GLOBL ·ALPHA64(SB), 8, $8
 DATA ·ALPHA96(SB)/8, $0x49E8000000000000
-GLOBL ·ALPHA96(SB), $8
+GLOBL ·ALPHA96(SB), 8, $8
 DATA ·ALPHA130(SB)/8, $0x4C08000000000000
-GLOBL ·ALPHA130(SB), $8
+GLOBL ·ALPHA130(SB), 8, $8
 DATA ·DOFFSET0(SB)/8, $0x4330000000000000
-GLOBL ·DOFFSET0(SB), $8
+GLOBL ·DOFFSET0(SB), 8, $8
 DATA ·DOFFSET1(SB)/8, $0x4530000000000000
-GLOBL ·DOFFSET1(SB), $8
+GLOBL ·DOFFSET1(SB), 8, $8
 DATA ·DOFFSET2(SB)/8, $0x4730000000000000
-GLOBL ·DOFFSET2(SB), $8
+GLOBL ·DOFFSET2(SB), 8, $8
 DATA ·DOFFSET3(SB)/8, $0x4930000000000000
-GLOBL ·DOFFSET3(SB), $8
+GLOBL ·DOFFSET3(SB), 8, $8
 DATA ·DOFFSET3MINUSTWO128(SB)/8, $0x492FFFFE00000000
-GLOBL ·DOFFSET3MINUSTWO128(SB), $8
+GLOBL ·DOFFSET3MINUSTWO128(SB), 8, $8
 DATA ·HOFFSET0(SB)/8, $0x43300001FFFFFFFB
-GLOBL ·HOFFSET0(SB), $8
+GLOBL ·HOFFSET0(SB), 8, $8
 DATA ·HOFFSET1(SB)/8, $0x45300001FFFFFFFE
-GLOBL ·HOFFSET1(SB), $8
+GLOBL ·HOFFSET1(SB), 8, $8
 DATA ·HOFFSET2(SB)/8, $0x47300001FFFFFFFE
-GLOBL ·HOFFSET2(SB), $8
+GLOBL ·HOFFSET2(SB), 8, $8
 DATA ·HOFFSET3(SB)/8, $0x49300003FFFFFFFE
-GLOBL ·HOFFSET3(SB), $8
+GLOBL ·HOFFSET3(SB), 8, $8
 DATA ·ROUNDING(SB)/2, $0x137f
-GLOBL ·ROUNDING(SB), $2
+GLOBL ·ROUNDING(SB), 8, $2
@@ -5,10 +5,18 @@
 package ssh
 
 import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"math/big"
 	"sync"
+	"time"
+
+	"github.com/massiveart/go.crypto/ed25519"
 )
 
 // See [PROTOCOL.agent], section 3.
@@ -39,6 +47,11 @@ const (
 	// 3.7 Key constraint identifiers
 	agentConstrainLifetime = 1
 	agentConstrainConfirm  = 2
+
+	// Signature flags of SSH_AGENTC_SIGN_REQUEST, which select
+	// the hash for RSA keys. See RFC 8332, section 4.
+	agentRSASHA2256 = 2
+	agentRSASHA2512 = 4
 )
 
 // maxAgentResponseBytes is the maximum agent reply size that is accepted. This
@@ -74,6 +87,19 @@ type signResponseAgentMsg struct {
 	SigBlob []byte
 }
 
+// See [PROTOCOL.agent], section 2.4.2.
+type removeIdentityAgentMsg struct {
+	KeyBlob []byte
+}
+
+// See [PROTOCOL.agent], section 2.4.3.
+type removeAllIdentitiesAgentMsg struct{}
+
+// See [PROTOCOL.agent], section 2.7.
+type lockAgentMsg struct {
+	Passphrase []byte
+}
+
 // AgentKey represents a protocol 2 key as defined in [PROTOCOL.agent],
 // section 2.5.2.
 type AgentKey struct {
@@ -141,6 +167,15 @@ func NewAgentClient(rw io.ReadWriter) *AgentClient {
 // the reply is unmarshaled into reply and replyType is set to the first byte of
 // the reply, which contains the type of the message.
 func (ac *AgentClient) sendAndReceive(req []byte) (reply interface{}, replyType uint8, err error) {
+	buf, err := ac.call(req)
+	if err != nil {
+		return
+	}
+	return unmarshalAgentMsg(buf)
+}
+
+// call sends req to the agent and returns the raw reply.
+func (ac *AgentClient) call(req []byte) ([]byte, error) {
 	// ac.mu prevents multiple, concurrent requests. Since the agent is typically
 	// on the same machine, we don't attempt to pipeline the requests.
 	ac.mu.Lock()
@@ -148,26 +183,25 @@ func (ac *AgentClient) sendAndReceive(req []byte) (reply interface{}, replyType
 
 	msg := make([]byte, stringLength(len(req)))
 	marshalString(msg, req)
-	if _, err = ac.conn.Write(msg); err != nil {
-		return
+	if _, err := ac.conn.Write(msg); err != nil {
+		return nil, err
 	}
 
 	var respSizeBuf [4]byte
-	if _, err = io.ReadFull(ac.conn, respSizeBuf[:]); err != nil {
-		return
+	if _, err := io.ReadFull(ac.conn, respSizeBuf[:]); err != nil {
+		return nil, err
 	}
 	respSize, _, _ := parseUint32(respSizeBuf[:])
 
 	if respSize > maxAgentResponseBytes {
-		err = errors.New("ssh: agent reply too large")
-		return
+		return nil, errors.New("ssh: agent reply too large")
 	}
 
 	buf := make([]byte, respSize)
-	if _, err = io.ReadFull(ac.conn, buf); err != nil {
-		return
+	if _, err := io.ReadFull(ac.conn, buf); err != nil {
+		return nil, err
 	}
-	return unmarshalAgentMsg(buf)
+	return buf, nil
 }
 
 // RequestIdentities queries the agent for protocol 2 keys as defined in
@@ -205,9 +239,27 @@ func (ac *AgentClient) RequestIdentities() ([]*AgentKey, error) {
 // SignRequest requests the signing of data by the agent using a protocol 2 key
 // as defined in [PROTOCOL.agent] section 2.6.2.
 func (ac *AgentClient) SignRequest(key PublicKey, data []byte) ([]byte, error) {
+	return ac.SignRequestWithAlgorithm(key, data, key.PrivateKeyAlgo())
+}
+
+// SignRequestWithAlgorithm is like SignRequest, but asks the agent to
+// use the given signature algorithm. Besides the default algorithm of
+// the key, only rsa-sha2-256 and rsa-sha2-512 are supported.
+func (ac *AgentClient) SignRequestWithAlgorithm(key PublicKey, data []byte, algorithm string) ([]byte, error) {
+	var flags uint32
+	switch algorithm {
+	case key.PrivateKeyAlgo():
+	case SigAlgoRSASHA2256:
+		flags = agentRSASHA2256
+	case SigAlgoRSASHA2512:
+		flags = agentRSASHA2512
+	default:
+		return nil, fmt.Errorf("ssh: agent cannot sign with algorithm %s", algorithm)
+	}
 	req := marshal(agentSignRequest, signRequestAgentMsg{
 		KeyBlob: MarshalPublicKey(key),
 		Data:    data,
+		Flags:   flags,
 	})
 
 	msg, msgType, err := ac.sendAndReceive(req)
@@ -224,6 +276,131 @@ func (ac *AgentClient) SignRequest(key PublicKey, data []byte) ([]byte, error) {
 	return nil, UnexpectedMessageError{agentSignResponse, msgType}
 }
 
+// simpleCall sends req to the agent and checks that it succeeded.
+func (ac *AgentClient) simpleCall(req []byte, errMsg string) error {
+	msg, msgType, err := ac.sendAndReceive(req)
+	if err != nil {
+		return err
+	}
+
+	switch msg.(type) {
+	case *successAgentMsg:
+		return nil
+	case *failureAgentMsg:
+		return errors.New("ssh: " + errMsg)
+	}
+	return UnexpectedMessageError{agentSuccess, msgType}
+}
+
+// AddIdentity adds a private key to the agent, as defined in
+// [PROTOCOL.agent] section 2.2. The key must be an *rsa.PrivateKey,
+// *dsa.PrivateKey, *ecdsa.PrivateKey or *[ed25519.PrivateKeySize]byte.
+func (ac *AgentClient) AddIdentity(key interface{}, comment string) error {
+	return ac.AddConstrainedIdentity(key, comment, 0, false)
+}
+
+// AddConstrainedIdentity adds a private key to the agent with the
+// constraints defined in [PROTOCOL.agent] section 2.2.6. A non-zero
+// lifetime makes the agent forget the key after that duration, which
+// is rounded up to whole seconds. If confirm is set, the agent asks
+// for confirmation before every use of the key.
+func (ac *AgentClient) AddConstrainedIdentity(key interface{}, comment string, lifetime time.Duration, confirm bool) error {
+	keyBytes, err := marshalAgentPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	var constraints []byte
+	if lifetime > 0 {
+		secs := (lifetime + time.Second - 1) / time.Second
+		constraints = append(constraints, agentConstrainLifetime)
+		constraints = appendU32(constraints, uint32(secs))
+	}
+	if confirm {
+		constraints = append(constraints, agentConstrainConfirm)
+	}
+
+	req := []byte{agentAddIdentity}
+	if len(constraints) > 0 {
+		req[0] = agentAddIdConstrained
+	}
+	req = append(req, keyBytes...)
+	req = appendString(req, comment)
+	req = append(req, constraints...)
+	return ac.simpleCall(req, "failed to add key to agent")
+}
+
+// marshalAgentPrivateKey serializes a private key in the format used by
+// add identity requests, see [PROTOCOL.agent], section 2.2.
+func marshalAgentPrivateKey(key interface{}) ([]byte, error) {
+	var out []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return nil, errors.New("ssh: agent requires RSA keys with exactly two primes")
+		}
+		// Qinv is computed here rather than with k.Precompute, which
+		// would modify the caller's key.
+		qinv := new(big.Int).ModInverse(k.Primes[1], k.Primes[0])
+		out = appendString(out, KeyAlgoRSA)
+		for _, n := range []*big.Int{k.N, big.NewInt(int64(k.E)), k.D, qinv, k.Primes[0], k.Primes[1]} {
+			out = appendMPInt(out, n)
+		}
+	case *dsa.PrivateKey:
+		out = appendString(out, KeyAlgoDSA)
+		for _, n := range []*big.Int{k.P, k.Q, k.G, k.Y, k.X} {
+			out = appendMPInt(out, n)
+		}
+	case *ecdsa.PrivateKey:
+		if !supportedEllipticCurve(k.Curve) {
+			return nil, errors.New("ssh: only P256, P384 and P521 EC keys are supported.")
+		}
+		pub := (*ecdsaPublicKey)(&k.PublicKey)
+		out = appendString(out, pub.PrivateKeyAlgo())
+		out = append(out, pub.Marshal()...)
+		out = appendMPInt(out, k.D)
+	case *[ed25519.PrivateKeySize]byte:
+		// The public key, then the seed followed by the public
+		// key, as in OpenSSH.
+		out = appendString(out, KeyAlgoED25519)
+		out = appendString(out, string(k[32:]))
+		out = appendString(out, string(k[:]))
+	default:
+		return nil, fmt.Errorf("ssh: unsupported key type %T", key)
+	}
+	return out, nil
+}
+
+// RemoveIdentity removes the given key from the agent, as defined in
+// [PROTOCOL.agent] section 2.4.2.
+func (ac *AgentClient) RemoveIdentity(key PublicKey) error {
+	req := marshal(agentRemoveIdentity, removeIdentityAgentMsg{
+		KeyBlob: MarshalPublicKey(key),
+	})
+	return ac.simpleCall(req, "failed to remove key from agent")
+}
+
+// RemoveAllIdentities removes all protocol 2 keys from the agent, as
+// defined in [PROTOCOL.agent] section 2.4.3.
+func (ac *AgentClient) RemoveAllIdentities() error {
+	req := marshal(agentRemoveAllIdentities, removeAllIdentitiesAgentMsg{})
+	return ac.simpleCall(req, "failed to remove keys from agent")
+}
+
+// Lock locks the agent with passphrase, as defined in [PROTOCOL.agent]
+// section 2.7. A locked agent does not list or use its keys until it
+// is unlocked with the same passphrase.
+func (ac *AgentClient) Lock(passphrase []byte) error {
+	req := marshal(agentLock, lockAgentMsg{Passphrase: passphrase})
+	return ac.simpleCall(req, "failed to lock agent")
+}
+
+// Unlock unlocks an agent locked with passphrase.
+func (ac *AgentClient) Unlock(passphrase []byte) error {
+	req := marshal(agentUnlock, lockAgentMsg{Passphrase: passphrase})
+	return ac.simpleCall(req, "failed to unlock agent")
+}
+
 // unmarshalAgentMsg parses an agent message in packet, returning the parsed
 // form and the message type of packet.
 func unmarshalAgentMsg(packet []byte) (interface{}, uint8, error) {
@@ -0,0 +1,73 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"io"
+)
+
+// These are the names OpenSSH uses for agent forwarding.
+const (
+	agentRequestType = "auth-agent-req@openssh.com"
+	agentChannelType = "auth-agent@openssh.com"
+)
+
+// ForwardAgent arranges for agent channels opened by the server, after
+// a call to Session.RequestAgentForwarding, to be relayed to agent.
+func (c *ClientConn) ForwardAgent(agent *AgentClient) {
+	c.setAgentServe(func(rw io.ReadWriter) error {
+		return serveAgentRequests(rw, agent.call)
+	})
+}
+
+// ForwardAgentKeyring arranges for agent channels opened by the server,
+// after a call to Session.RequestAgentForwarding, to be served from
+// keyring.
+func (c *ClientConn) ForwardAgentKeyring(keyring *AgentKeyring) {
+	c.setAgentServe(func(rw io.ReadWriter) error {
+		return ServeAgent(keyring, rw)
+	})
+}
+
+func (c *ClientConn) setAgentServe(serve func(io.ReadWriter) error) {
+	c.agentMu.Lock()
+	defer c.agentMu.Unlock()
+	c.agentServe = serve
+}
+
+// handleAgentChanOpen accepts an agent channel from the server if
+// agent forwarding has been set up.
+func (c *ClientConn) handleAgentChanOpen(msg *channelOpenMsg) {
+	c.agentMu.Lock()
+	serve := c.agentServe
+	c.agentMu.Unlock()
+
+	if serve == nil {
+		c.writePacket(marshal(msgChannelOpenFailure, channelOpenFailureMsg{
+			PeersId:  msg.PeersId,
+			Reason:   Prohibited,
+			Message:  "agent forwarding is not enabled",
+			Language: "en_US.UTF-8",
+		}))
+		return
+	}
+
+	ch := c.acceptChan(msg)
+	go func() {
+		serve(struct {
+			io.Reader
+			io.Writer
+		}{ch.stdout, ch.stdin})
+		ch.Close()
+	}()
+}
+
+// OpenAgentChannel opens an agent channel to the client, which must
+// have requested agent forwarding on one of its sessions. Use
+// NewAgentClient on the returned Channel to talk to the agent. As with
+// OpenChannel, Accept must be running in another goroutine.
+func (s *ServerConn) OpenAgentChannel() (Channel, error) {
+	return s.OpenChannel(agentChannelType, nil)
+}
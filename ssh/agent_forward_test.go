@@ -0,0 +1,98 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"fmt"
+	"testing"
+)
+
+// agentListHandler waits for an exec request and then writes the
+// comments of the keys in the forwarded agent, or the error from
+// opening the agent channel, to stdout.
+func agentListHandler(ch *serverChan, t *testing.T) {
+	defer ch.Close()
+	for {
+		_, err := ch.Read(make([]byte, 0))
+		req, ok := err.(ChannelRequest)
+		if !ok {
+			t.Errorf("expected channel request, got: %v", err)
+			return
+		}
+		ch.AckRequest(true)
+		if req.Request == "exec" {
+			break
+		}
+	}
+
+	agentChan, err := ch.serverConn.OpenAgentChannel()
+	if err != nil {
+		fmt.Fprintf(ch, "error")
+		sendStatus(0, ch, t)
+		return
+	}
+	defer agentChan.Close()
+
+	keys, err := NewAgentClient(agentChan).RequestIdentities()
+	if err != nil {
+		t.Errorf("RequestIdentities: %v", err)
+	}
+	for _, k := range keys {
+		fmt.Fprintf(ch, "%s;", k.Comment)
+	}
+	sendStatus(0, ch, t)
+}
+
+func TestAgentForwarding(t *testing.T) {
+	keyring := NewAgentKeyring()
+	keyring.Add(rsaKey, "rsa")
+	keyring.Add(ecdsaKey, "ecdsa")
+	agent, cleanup := startAgent(t, keyring)
+	defer cleanup()
+
+	for _, c := range []struct {
+		name  string
+		setup func(*ClientConn)
+	}{
+		{"keyring", func(c *ClientConn) { c.ForwardAgentKeyring(keyring) }},
+		{"agent", func(c *ClientConn) { c.ForwardAgent(agent) }},
+	} {
+		conn := dial(agentListHandler, t)
+		c.setup(conn)
+		session, err := conn.NewSession()
+		if err != nil {
+			t.Fatalf("%s: unable to request new session: %v", c.name, err)
+		}
+		if err := session.RequestAgentForwarding(); err != nil {
+			t.Fatalf("%s: RequestAgentForwarding: %v", c.name, err)
+		}
+		out, err := session.Output("ssh-add -l")
+		if err != nil {
+			t.Fatalf("%s: Output: %v", c.name, err)
+		}
+		if got, want := string(out), "rsa;ecdsa;"; got != want {
+			t.Errorf("%s: got %q, want %q", c.name, got, want)
+		}
+		session.Close()
+		conn.Close()
+	}
+}
+
+func TestAgentForwardingNotEnabled(t *testing.T) {
+	conn := dial(agentListHandler, t)
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("unable to request new session: %v", err)
+	}
+	defer session.Close()
+	out, err := session.Output("ssh-add -l")
+	if err != nil {
+		t.Fatalf("Output: %v", err)
+	}
+	if string(out) != "error" {
+		t.Errorf("got %q, want the agent channel to be rejected", out)
+	}
+}
@@ -0,0 +1,495 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/massiveart/go.crypto/ed25519"
+)
+
+// agentKeyringEntry is a key held by an AgentKeyring together with
+// its constraints.
+type agentKeyringEntry struct {
+	signer  Signer
+	comment string
+	blob    []byte
+
+	// expire is the time the key is removed from the keyring. It
+	// is zero for keys without a lifetime constraint.
+	expire time.Time
+
+	// confirm is set if every use of the key must be confirmed.
+	confirm bool
+}
+
+// AgentKeyring is an in-memory collection of keys that can be served
+// to ssh clients over the agent protocol with ServeAgent. It is safe
+// for concurrent use.
+type AgentKeyring struct {
+	// Confirm is called before signing with a key that was added
+	// with the confirm constraint. If it is nil, or returns false,
+	// the request is refused.
+	Confirm func(key PublicKey, comment string) bool
+
+	// Rand provides the source of entropy for signatures. If Rand
+	// is nil, the cryptographic random reader in package
+	// crypto/rand will be used.
+	Rand io.Reader
+
+	mu         sync.Mutex
+	keys       []*agentKeyringEntry
+	locked     bool
+	passphrase []byte
+}
+
+// NewAgentKeyring returns an empty, unlocked AgentKeyring.
+func NewAgentKeyring() *AgentKeyring {
+	return new(AgentKeyring)
+}
+
+var errAgentLocked = errors.New("ssh: agent is locked")
+
+func (r *AgentKeyring) rand() io.Reader {
+	if r.Rand == nil {
+		return rand.Reader
+	}
+	return r.Rand
+}
+
+// expireKeys removes keys whose lifetime has passed. It must be called
+// with r.mu held.
+func (r *AgentKeyring) expireKeys() {
+	now := time.Now()
+	keys := r.keys[:0]
+	for _, k := range r.keys {
+		if k.expire.IsZero() || now.Before(k.expire) {
+			keys = append(keys, k)
+		}
+	}
+	r.keys = keys
+}
+
+// Add adds key to the keyring. If the key is already present, its
+// comment and constraints are replaced.
+func (r *AgentKeyring) Add(key Signer, comment string) error {
+	return r.AddConstrained(key, comment, 0, false)
+}
+
+// AddConstrained adds key to the keyring with the given constraints. A
+// non-zero lifetime causes the key to be removed after that duration.
+// If confirm is set, the Confirm callback is consulted before every
+// use of the key.
+func (r *AgentKeyring) AddConstrained(key Signer, comment string, lifetime time.Duration, confirm bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.locked {
+		return errAgentLocked
+	}
+
+	e := &agentKeyringEntry{
+		signer:  key,
+		comment: comment,
+		blob:    MarshalPublicKey(key.PublicKey()),
+		confirm: confirm,
+	}
+	if lifetime > 0 {
+		e.expire = time.Now().Add(lifetime)
+	}
+
+	for i, k := range r.keys {
+		if bytes.Equal(k.blob, e.blob) {
+			r.keys[i] = e
+			return nil
+		}
+	}
+	r.keys = append(r.keys, e)
+	return nil
+}
+
+// Remove removes the key from the keyring.
+func (r *AgentKeyring) Remove(key PublicKey) error {
+	return r.remove(MarshalPublicKey(key))
+}
+
+func (r *AgentKeyring) remove(blob []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.locked {
+		return errAgentLocked
+	}
+
+	for i, k := range r.keys {
+		if bytes.Equal(k.blob, blob) {
+			r.keys = append(r.keys[:i], r.keys[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("ssh: key not found in agent")
+}
+
+// RemoveAll removes all keys from the keyring.
+func (r *AgentKeyring) RemoveAll() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.locked {
+		return errAgentLocked
+	}
+	r.keys = nil
+	return nil
+}
+
+// Lock locks the keyring with passphrase. While locked, the keyring
+// lists no keys and refuses all operations except Unlock.
+func (r *AgentKeyring) Lock(passphrase []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.locked {
+		return errAgentLocked
+	}
+	r.locked = true
+	r.passphrase = append([]byte(nil), passphrase...)
+	return nil
+}
+
+// Unlock undoes the effect of Lock if passphrase matches.
+func (r *AgentKeyring) Unlock(passphrase []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.locked {
+		return errors.New("ssh: agent is not locked")
+	}
+	if len(passphrase) != len(r.passphrase) || subtle.ConstantTimeCompare(passphrase, r.passphrase) != 1 {
+		return errors.New("ssh: incorrect passphrase")
+	}
+	r.locked = false
+	r.passphrase = nil
+	return nil
+}
+
+// List returns the keys held by the keyring.
+func (r *AgentKeyring) List() ([]*AgentKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.locked {
+		// Like ssh-agent, pretend to be empty.
+		return nil, nil
+	}
+
+	r.expireKeys()
+	var keys []*AgentKey
+	for _, k := range r.keys {
+		keys = append(keys, &AgentKey{blob: k.blob, Comment: k.comment})
+	}
+	return keys, nil
+}
+
+// Sign signs data with the given key, which must be held by the
+// keyring. It returns the signature serialized in the same form as
+// AgentClient.SignRequest.
+func (r *AgentKeyring) Sign(key PublicKey, data []byte) ([]byte, error) {
+	return r.sign(MarshalPublicKey(key), data, 0)
+}
+
+// sign signs data with the key whose public key is blob. flags are
+// the signature flags of the request.
+func (r *AgentKeyring) sign(blob, data []byte, flags uint32) ([]byte, error) {
+	r.mu.Lock()
+	if r.locked {
+		r.mu.Unlock()
+		return nil, errAgentLocked
+	}
+	r.expireKeys()
+	var entry *agentKeyringEntry
+	for _, k := range r.keys {
+		if bytes.Equal(k.blob, blob) {
+			entry = k
+			break
+		}
+	}
+	r.mu.Unlock()
+
+	if entry == nil {
+		return nil, errors.New("ssh: key not found in agent")
+	}
+	// The callback may block on user interaction, so it is called
+	// without holding the lock.
+	if entry.confirm && (r.Confirm == nil || !r.Confirm(entry.signer.PublicKey(), entry.comment)) {
+		return nil, errors.New("ssh: use of key not confirmed")
+	}
+
+	// The flags only apply to RSA keys and are ignored otherwise.
+	algo := entry.signer.PublicKey().PrivateKeyAlgo()
+	if algo == KeyAlgoRSA {
+		switch {
+		case flags&agentRSASHA2512 != 0:
+			algo = SigAlgoRSASHA2512
+		case flags&agentRSASHA2256 != 0:
+			algo = SigAlgoRSASHA2256
+		}
+	}
+	sig, err := signWithAlgorithm(entry.signer, r.rand(), data, algo)
+	if err != nil {
+		return nil, err
+	}
+	return serializeSignature(algo, sig), nil
+}
+
+// ServeAgent serves the agent protocol described in [PROTOCOL.agent]
+// on c, using keyring to store keys and answer requests. It returns
+// when c is closed by the client, or on the first error.
+func ServeAgent(keyring *AgentKeyring, c io.ReadWriter) error {
+	return serveAgentRequests(c, func(req []byte) ([]byte, error) {
+		reply, err := keyring.handleRequest(req)
+		if err != nil {
+			reply = []byte{agentFailure}
+		}
+		return reply, nil
+	})
+}
+
+// serveAgentRequests reads agent requests from c, and writes the
+// replies returned by handle.
+func serveAgentRequests(c io.ReadWriter, handle func(req []byte) ([]byte, error)) error {
+	var lenBuf [4]byte
+	for {
+		if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		length, _, _ := parseUint32(lenBuf[:])
+		if length == 0 || length > maxAgentResponseBytes {
+			return errors.New("ssh: agent request of invalid size")
+		}
+
+		req := make([]byte, length)
+		if _, err := io.ReadFull(c, req); err != nil {
+			return err
+		}
+
+		reply, err := handle(req)
+		if err != nil {
+			return err
+		}
+		msg := make([]byte, stringLength(len(reply)))
+		marshalString(msg, reply)
+		if _, err := c.Write(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// handleRequest returns the reply to a single agent request. Errors
+// are reported to the client as a failure message.
+func (r *AgentKeyring) handleRequest(req []byte) ([]byte, error) {
+	switch req[0] {
+	case agentRequestIdentities:
+		keys, err := r.List()
+		if err != nil {
+			return nil, err
+		}
+		var blobs []byte
+		for _, k := range keys {
+			blobs = appendString(blobs, string(k.blob))
+			blobs = appendString(blobs, k.Comment)
+		}
+		return marshal(agentIdentitiesAnswer, identitiesAnswerAgentMsg{
+			NumKeys: uint32(len(keys)),
+			Keys:    blobs,
+		}), nil
+
+	case agentSignRequest:
+		var msg signRequestAgentMsg
+		if err := unmarshal(&msg, req, agentSignRequest); err != nil {
+			return nil, err
+		}
+		sig, err := r.sign(msg.KeyBlob, msg.Data, msg.Flags)
+		if err != nil {
+			return nil, err
+		}
+		return marshal(agentSignResponse, signResponseAgentMsg{SigBlob: sig}), nil
+
+	case agentAddIdentity, agentAddIdConstrained:
+		if err := r.addFromRequest(req[1:], req[0] == agentAddIdConstrained); err != nil {
+			return nil, err
+		}
+
+	case agentRemoveIdentity:
+		var msg removeIdentityAgentMsg
+		if err := unmarshal(&msg, req, agentRemoveIdentity); err != nil {
+			return nil, err
+		}
+		if err := r.remove(msg.KeyBlob); err != nil {
+			return nil, err
+		}
+
+	case agentRemoveAllIdentities:
+		if err := r.RemoveAll(); err != nil {
+			return nil, err
+		}
+
+	case agentLock, agentUnlock:
+		var msg lockAgentMsg
+		if err := unmarshal(&msg, req, req[0]); err != nil {
+			return nil, err
+		}
+		var err error
+		if req[0] == agentLock {
+			err = r.Lock(msg.Passphrase)
+		} else {
+			err = r.Unlock(msg.Passphrase)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("ssh: unsupported agent request %d", req[0])
+	}
+	return []byte{agentSuccess}, nil
+}
+
+// addFromRequest parses the body of an add identity request and adds
+// the key to the keyring.
+func (r *AgentKeyring) addFromRequest(in []byte, constrained bool) error {
+	signer, in, ok := parseAgentPrivateKey(in)
+	if !ok {
+		return errors.New("ssh: malformed private key in agent request")
+	}
+	comment, in, ok := parseString(in)
+	if !ok {
+		return ParseError{agentAddIdentity}
+	}
+
+	var lifetime time.Duration
+	confirm := false
+	if constrained {
+		for len(in) > 0 {
+			switch in[0] {
+			case agentConstrainLifetime:
+				var secs uint32
+				if secs, in, ok = parseUint32(in[1:]); !ok {
+					return ParseError{agentAddIdConstrained}
+				}
+				lifetime = time.Duration(secs) * time.Second
+			case agentConstrainConfirm:
+				confirm = true
+				in = in[1:]
+			default:
+				return fmt.Errorf("ssh: unknown agent constraint %d", in[0])
+			}
+		}
+	} else if len(in) > 0 {
+		return ParseError{agentAddIdentity}
+	}
+
+	return r.AddConstrained(signer, string(comment), lifetime, confirm)
+}
+
+// parseAgentPrivateKey parses a private key in the format used by
+// add identity requests, see [PROTOCOL.agent], section 2.2.
+func parseAgentPrivateKey(in []byte) (signer Signer, rest []byte, ok bool) {
+	algo, in, ok := parseString(in)
+	if !ok {
+		return
+	}
+
+	var ints []*big.Int
+	readInts := func(n int) bool {
+		for i := 0; i < n; i++ {
+			var v *big.Int
+			if v, in, ok = parseInt(in); !ok {
+				return false
+			}
+			ints = append(ints, v)
+		}
+		return true
+	}
+
+	var key interface{}
+	switch string(algo) {
+	case KeyAlgoRSA:
+		// n, e, d, iqmp, p, q
+		if !readInts(6) || ints[1].BitLen() > 31 {
+			return nil, nil, false
+		}
+		k := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: ints[0], E: int(ints[1].Int64())},
+			D:         ints[2],
+			Primes:    []*big.Int{ints[4], ints[5]},
+		}
+		if k.Validate() != nil {
+			return nil, nil, false
+		}
+		k.Precompute()
+		key = k
+	case KeyAlgoDSA:
+		// p, q, g, y, x
+		if !readInts(5) {
+			return nil, nil, false
+		}
+		key = &dsa.PrivateKey{
+			PublicKey: dsa.PublicKey{
+				Parameters: dsa.Parameters{P: ints[0], Q: ints[1], G: ints[2]},
+				Y:          ints[3],
+			},
+			X: ints[4],
+		}
+	case KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521:
+		// curve name, Q, d
+		var pub PublicKey
+		if pub, in, ok = parseECDSA(in); !ok || pub.PrivateKeyAlgo() != string(algo) {
+			return nil, nil, false
+		}
+		if !readInts(1) {
+			return nil, nil, false
+		}
+		k := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey(*pub.(*ecdsaPublicKey)),
+			D:         ints[0],
+		}
+		if x, y := k.Curve.ScalarBaseMult(k.D.Bytes()); x.Cmp(k.X) != 0 || y.Cmp(k.Y) != 0 {
+			return nil, nil, false
+		}
+		key = k
+	case KeyAlgoED25519:
+		// public key, seed followed by public key
+		var pub, priv []byte
+		if pub, in, ok = parseString(in); !ok || len(pub) != ed25519.PublicKeySize {
+			return nil, nil, false
+		}
+		if priv, in, ok = parseString(in); !ok || len(priv) != ed25519.PrivateKeySize {
+			return nil, nil, false
+		}
+		var seed [ed25519.SeedSize]byte
+		copy(seed[:], priv)
+		pubKey, k := ed25519.NewKeyFromSeed(&seed)
+		if !bytes.Equal(pubKey[:], pub) || !bytes.Equal(priv[32:], pub) {
+			return nil, nil, false
+		}
+		key = k
+	default:
+		return nil, nil, false
+	}
+
+	s, err := NewSignerFromKey(key)
+	if err != nil {
+		return nil, nil, false
+	}
+	return s, in, true
+}
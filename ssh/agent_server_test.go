@@ -0,0 +1,187 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// startAgent serves keyring on one end of a connection and returns an
+// AgentClient for the other end.
+func startAgent(t *testing.T, keyring *AgentKeyring) (*AgentClient, func()) {
+	c1, c2, err := pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	go ServeAgent(keyring, c2)
+	return NewAgentClient(c1), func() {
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestAgentKeyringSign(t *testing.T) {
+	keyring := NewAgentKeyring()
+	for _, k := range []Signer{rsaKey, dsaKey, ecdsaKey, ed25519Key} {
+		if err := keyring.Add(k, "key "+k.PublicKey().PrivateKeyAlgo()); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	client, cleanup := startAgent(t, keyring)
+	defer cleanup()
+
+	keys, err := client.RequestIdentities()
+	if err != nil {
+		t.Fatalf("RequestIdentities: %v", err)
+	}
+	if len(keys) != 4 {
+		t.Fatalf("got %d keys, want 4", len(keys))
+	}
+
+	data := []byte("hello")
+	for _, ak := range keys {
+		pub, err := ak.Key()
+		if err != nil {
+			t.Fatalf("Key: %v", err)
+		}
+		if ak.Comment != "key "+pub.PrivateKeyAlgo() {
+			t.Errorf("got comment %q for %s", ak.Comment, pub.PrivateKeyAlgo())
+		}
+		sig, err := client.SignRequest(pub, data)
+		if err != nil {
+			t.Fatalf("SignRequest(%s): %v", pub.PrivateKeyAlgo(), err)
+		}
+		parsed, rest, ok := parseSignatureBody(sig)
+		if !ok || len(rest) > 0 || parsed.Format != pub.PrivateKeyAlgo() {
+			t.Fatalf("malformed signature for %s", pub.PrivateKeyAlgo())
+		}
+		if !pub.Verify(data, parsed.Blob) {
+			t.Errorf("signature for %s does not verify", pub.PrivateKeyAlgo())
+		}
+	}
+
+	for _, algo := range []string{SigAlgoRSASHA2256, SigAlgoRSASHA2512} {
+		sig, err := client.SignRequestWithAlgorithm(rsaKey.PublicKey(), data, algo)
+		if err != nil {
+			t.Fatalf("SignRequestWithAlgorithm(%s): %v", algo, err)
+		}
+		parsed, rest, ok := parseSignatureBody(sig)
+		if !ok || len(rest) > 0 || parsed.Format != algo {
+			t.Fatalf("malformed %s signature", algo)
+		}
+		if !verifySignature(rsaKey.PublicKey(), data, parsed) {
+			t.Errorf("%s signature does not verify", algo)
+		}
+	}
+
+	if err := keyring.Remove(dsaKey.PublicKey()); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := client.SignRequest(dsaKey.PublicKey(), data); err == nil {
+		t.Errorf("SignRequest succeeded with removed key")
+	}
+	if err := keyring.Remove(dsaKey.PublicKey()); err == nil {
+		t.Errorf("Remove of absent key succeeded")
+	}
+}
+
+func TestAgentKeyringLock(t *testing.T) {
+	keyring := NewAgentKeyring()
+	keyring.Add(rsaKey, "rsa")
+
+	if err := keyring.Lock([]byte("secret")); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if keys, _ := keyring.List(); len(keys) != 0 {
+		t.Errorf("locked keyring lists %d keys", len(keys))
+	}
+	if _, err := keyring.Sign(rsaKey.PublicKey(), []byte("data")); err == nil {
+		t.Errorf("locked keyring signed data")
+	}
+	if err := keyring.Add(dsaKey, "dsa"); err == nil {
+		t.Errorf("locked keyring accepted a key")
+	}
+	if err := keyring.Unlock([]byte("wrong")); err == nil {
+		t.Errorf("Unlock succeeded with wrong passphrase")
+	}
+	if err := keyring.Unlock([]byte("secret")); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if keys, _ := keyring.List(); len(keys) != 1 {
+		t.Errorf("got %d keys after unlock, want 1", len(keys))
+	}
+}
+
+func TestAgentKeyringConstraints(t *testing.T) {
+	keyring := NewAgentKeyring()
+	if err := keyring.AddConstrained(rsaKey, "rsa", time.Hour, true); err != nil {
+		t.Fatalf("AddConstrained: %v", err)
+	}
+
+	if _, err := keyring.Sign(rsaKey.PublicKey(), []byte("data")); err == nil {
+		t.Errorf("signed without confirmation")
+	}
+	confirmed := 0
+	keyring.Confirm = func(key PublicKey, comment string) bool {
+		confirmed++
+		return comment == "rsa"
+	}
+	if _, err := keyring.Sign(rsaKey.PublicKey(), []byte("data")); err != nil || confirmed != 1 {
+		t.Errorf("Sign: %v, confirmed %d times", err, confirmed)
+	}
+
+	// Expire the key.
+	keyring.keys[0].expire = time.Now().Add(-time.Second)
+	if keys, _ := keyring.List(); len(keys) != 0 {
+		t.Errorf("expired key still listed")
+	}
+}
+
+func TestAgentServeAddIdentity(t *testing.T) {
+	keyring := NewAgentKeyring()
+	client, cleanup := startAgent(t, keyring)
+	defer cleanup()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	req := []byte{agentAddIdConstrained}
+	req = appendString(req, KeyAlgoRSA)
+	for _, n := range []*big.Int{priv.N, big.NewInt(int64(priv.E)), priv.D, priv.Precomputed.Qinv, priv.Primes[0], priv.Primes[1]} {
+		req = appendMPInt(req, n)
+	}
+	req = appendString(req, "added")
+	req = append(req, agentConstrainLifetime, 0, 0, 0, 60)
+
+	msg, _, err := client.sendAndReceive(req)
+	if err != nil {
+		t.Fatalf("sendAndReceive: %v", err)
+	}
+	if _, ok := msg.(*successAgentMsg); !ok {
+		t.Fatalf("got %T, want success", msg)
+	}
+
+	keys, err := client.RequestIdentities()
+	if err != nil || len(keys) != 1 || keys[0].Comment != "added" {
+		t.Fatalf("RequestIdentities: %v %v", keys, err)
+	}
+	if keyring.keys[0].expire.IsZero() {
+		t.Errorf("lifetime constraint was not applied")
+	}
+
+	msg, _, err = client.sendAndReceive(marshal(agentRemoveAllIdentities, removeAllIdentitiesAgentMsg{}))
+	if _, ok := msg.(*successAgentMsg); err != nil || !ok {
+		t.Fatalf("remove all: %v %T", err, msg)
+	}
+	if keys, _ := client.RequestIdentities(); len(keys) != 0 {
+		t.Errorf("got %d keys after remove all", len(keys))
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/massiveart/go.crypto/ed25519"
+)
+
+func TestAgentClientAddRemove(t *testing.T) {
+	keyring := NewAgentKeyring()
+	client, cleanup := startAgent(t, keyring)
+	defer cleanup()
+
+	rawKeys := []interface{}{
+		rsaKey.(*rsaPrivateKey).PrivateKey,
+		dsaKey.(*dsaPrivateKey).PrivateKey,
+		ecdsaKey.(*ecdsaPrivateKey).PrivateKey,
+	}
+	for i, k := range rawKeys {
+		var err error
+		if i == 0 {
+			err = client.AddIdentity(k, "plain")
+		} else {
+			err = client.AddConstrainedIdentity(k, "constrained", 1500*time.Millisecond, i == 2)
+		}
+		if err != nil {
+			t.Fatalf("adding %T: %v", k, err)
+		}
+	}
+
+	if keyring.keys[0].confirm || !keyring.keys[0].expire.IsZero() {
+		t.Errorf("unconstrained key has constraints")
+	}
+	// The lifetime is rounded up to whole seconds.
+	if d := keyring.keys[1].expire.Sub(time.Now()); d <= time.Second || d > 2*time.Second {
+		t.Errorf("got lifetime %v, want 2s", d)
+	}
+	if !keyring.keys[2].confirm {
+		t.Errorf("confirm constraint not applied")
+	}
+
+	data := []byte("data")
+	for _, s := range []Signer{rsaKey, dsaKey} {
+		sig, err := client.SignRequest(s.PublicKey(), data)
+		if err != nil {
+			t.Fatalf("SignRequest: %v", err)
+		}
+		parsed, _, ok := parseSignatureBody(sig)
+		if !ok || !s.PublicKey().Verify(data, parsed.Blob) {
+			t.Errorf("invalid signature from added %s key", s.PublicKey().PrivateKeyAlgo())
+		}
+	}
+
+	if err := client.RemoveIdentity(rsaKey.PublicKey()); err != nil {
+		t.Fatalf("RemoveIdentity: %v", err)
+	}
+	if err := client.RemoveIdentity(rsaKey.PublicKey()); err == nil {
+		t.Errorf("RemoveIdentity of absent key succeeded")
+	}
+	if keys, _ := client.RequestIdentities(); len(keys) != 2 {
+		t.Errorf("got %d keys, want 2", len(keys))
+	}
+	if err := client.RemoveAllIdentities(); err != nil {
+		t.Fatalf("RemoveAllIdentities: %v", err)
+	}
+	if keys, _ := client.RequestIdentities(); len(keys) != 0 {
+		t.Errorf("got %d keys, want 0", len(keys))
+	}
+
+	if err := client.AddIdentity(rsaKey.PublicKey(), "public"); err == nil {
+		t.Errorf("AddIdentity accepted a public key")
+	}
+}
+
+func TestMarshalAgentRSAKeyUnmodified(t *testing.T) {
+	key := *rsaKey.(*rsaPrivateKey).PrivateKey
+	key.Precomputed = rsa.PrecomputedValues{}
+	out, err := marshalAgentPrivateKey(&key)
+	if err != nil {
+		t.Fatalf("marshalAgentPrivateKey: %v", err)
+	}
+	if key.Precomputed.Qinv != nil {
+		t.Errorf("marshalAgentPrivateKey modified the key")
+	}
+
+	precomputed := key
+	precomputed.Precompute()
+	want, _ := marshalAgentPrivateKey(&precomputed)
+	if !bytes.Equal(out, want) {
+		t.Errorf("got a different encoding for a key without precomputed values")
+	}
+}
+
+func TestAgentClientAddEd25519(t *testing.T) {
+	keyring := NewAgentKeyring()
+	client, cleanup := startAgent(t, keyring)
+	defer cleanup()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	if err := client.AddIdentity(priv, "ed25519"); err != nil {
+		t.Fatalf("AddIdentity: %v", err)
+	}
+	key, err := NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v", err)
+	}
+	data := []byte("data")
+	sig, err := client.SignRequest(key, data)
+	if err != nil {
+		t.Fatalf("SignRequest: %v", err)
+	}
+	parsed, _, ok := parseSignatureBody(sig)
+	if !ok || parsed.Format != KeyAlgoED25519 || !key.Verify(data, parsed.Blob) {
+		t.Errorf("invalid signature from added ed25519 key")
+	}
+}
+
+func TestAgentClientLock(t *testing.T) {
+	keyring := NewAgentKeyring()
+	keyring.Add(rsaKey, "rsa")
+	client, cleanup := startAgent(t, keyring)
+	defer cleanup()
+
+	if err := client.Lock([]byte("pw")); err != nil {
+		t.Fatalf("Lock: %v", err)
+	}
+	if keys, _ := client.RequestIdentities(); len(keys) != 0 {
+		t.Errorf("locked agent lists %d keys", len(keys))
+	}
+	if err := client.Unlock([]byte("wrong")); err == nil {
+		t.Errorf("Unlock succeeded with wrong passphrase")
+	}
+	if err := client.Unlock([]byte("pw")); err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if keys, _ := client.RequestIdentities(); len(keys) != 1 {
+		t.Errorf("got %d keys after unlock, want 1", len(keys))
+	}
+}
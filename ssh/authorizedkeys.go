@@ -0,0 +1,298 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+// AuthorizedKeyOptions holds the options of an authorized_keys entry,
+// see the AUTHORIZED_KEYS FILE FORMAT section of sshd(8).
+type AuthorizedKeyOptions struct {
+	// From lists the patterns of the from option. The client's
+	// address must match one of them, and none of the negated ones
+	// starting with '!'. Patterns may contain the wildcards '*' and
+	// '?', or be CIDR networks. Host name patterns are not resolved
+	// and never match.
+	From []string
+
+	// Command is the forced command of the command option.
+	Command string
+
+	// Environment holds the "NAME=value" pairs of the environment
+	// options.
+	Environment []string
+
+	// PermitOpen lists the "host:port" destinations of the
+	// permitopen options. If non-empty, port forwarding is limited
+	// to them. Either part may be "*".
+	PermitOpen []string
+
+	NoPortForwarding  bool
+	NoPTY             bool
+	NoAgentForwarding bool
+	NoX11Forwarding   bool
+	NoUserRC          bool
+
+	// CertAuthority is set if the key is trusted to sign user
+	// certificates rather than to authenticate directly.
+	CertAuthority bool
+
+	// Principals lists the principals that certificates signed by
+	// a cert-authority key may carry instead of the user name.
+	Principals []string
+}
+
+// ParseAuthorizedKeyOptions parses the options returned by
+// ParseAuthorizedKey. Unknown options are an error, as in sshd.
+func ParseAuthorizedKeyOptions(options []string) (*AuthorizedKeyOptions, error) {
+	opts := new(AuthorizedKeyOptions)
+	for _, option := range options {
+		name, value, hasValue := option, "", false
+		if i := strings.Index(option, "="); i != -1 {
+			name, hasValue = option[:i], true
+			v := option[i+1:]
+			if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+				return nil, fmt.Errorf("ssh: value of option %q must be quoted", name)
+			}
+			value = strings.Replace(v[1:len(v)-1], `\"`, `"`, -1)
+		}
+		name = strings.ToLower(name)
+
+		flags := map[string]*bool{
+			"no-port-forwarding":  &opts.NoPortForwarding,
+			"no-pty":              &opts.NoPTY,
+			"no-agent-forwarding": &opts.NoAgentForwarding,
+			"no-x11-forwarding":   &opts.NoX11Forwarding,
+			"no-user-rc":          &opts.NoUserRC,
+			"cert-authority":      &opts.CertAuthority,
+		}
+		if flag, ok := flags[name]; ok {
+			if hasValue {
+				return nil, fmt.Errorf("ssh: option %q takes no value", name)
+			}
+			*flag = true
+			continue
+		}
+		if !hasValue {
+			return nil, fmt.Errorf("ssh: unknown option %q", name)
+		}
+
+		switch name {
+		case "from":
+			opts.From = append(opts.From, strings.Split(value, ",")...)
+		case "command":
+			opts.Command = value
+		case "environment":
+			if i := strings.Index(value, "="); i <= 0 {
+				return nil, fmt.Errorf("ssh: invalid environment option %q", value)
+			}
+			opts.Environment = append(opts.Environment, value)
+		case "permitopen":
+			if _, _, err := net.SplitHostPort(value); err != nil {
+				return nil, fmt.Errorf("ssh: invalid permitopen option %q", value)
+			}
+			opts.PermitOpen = append(opts.PermitOpen, value)
+		case "principals":
+			opts.Principals = append(opts.Principals, strings.Split(value, ",")...)
+		default:
+			return nil, fmt.Errorf("ssh: unknown option %q", name)
+		}
+	}
+	return opts, nil
+}
+
+// matchFrom reports whether addr is allowed by the from patterns.
+func (o *AuthorizedKeyOptions) matchFrom(addr net.Addr) bool {
+	if len(o.From) == 0 {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	ip := tcpAddr.IP.String()
+
+	matched := false
+	for _, p := range o.From {
+		negate := strings.HasPrefix(p, "!")
+		if negate {
+			p = p[1:]
+		}
+		var m bool
+		if _, ipNet, err := net.ParseCIDR(p); err == nil {
+			m = ipNet.Contains(tcpAddr.IP)
+		} else {
+			m = wildcardMatch(strings.ToLower(p), ip)
+		}
+		if m && negate {
+			return false
+		}
+		matched = matched || m
+	}
+	return matched
+}
+
+// permissions applies the restrictions of the options to perms, which
+// holds the permissions granted by a certificate, if any.
+func (o *AuthorizedKeyOptions) permissions(perms Permissions) (Permissions, error) {
+	if o.Command != "" {
+		if cmd, ok := perms.CriticalOptions[CertOptionForceCommand]; ok && cmd != o.Command {
+			return perms, fmt.Errorf("ssh: forced commands of key and certificate differ")
+		}
+		if perms.CriticalOptions == nil {
+			perms.CriticalOptions = make(map[string]string)
+		}
+		perms.CriticalOptions[CertOptionForceCommand] = o.Command
+	}
+
+	denied := map[string]bool{
+		CertExtPermitPortForwarding:  o.NoPortForwarding,
+		CertExtPermitPTY:             o.NoPTY,
+		CertExtPermitAgentForwarding: o.NoAgentForwarding,
+		CertExtPermitX11Forwarding:   o.NoX11Forwarding,
+		CertExtPermitUserRC:          o.NoUserRC,
+	}
+	for ext, deny := range denied {
+		if !deny {
+			continue
+		}
+		if perms.Extensions == nil {
+			perms.Extensions = make(map[string]string)
+			for _, e := range defaultExtensions {
+				perms.Extensions[e] = ""
+			}
+		}
+		delete(perms.Extensions, ext)
+	}
+
+	perms.PermitOpen = o.PermitOpen
+	perms.Environment = o.Environment
+	return perms, nil
+}
+
+type authorizedKey struct {
+	key     PublicKey
+	options *AuthorizedKeyOptions
+}
+
+// AuthorizedKeys holds the entries of an OpenSSH authorized_keys file.
+// Its Authenticate method can be used as ServerConfig.PublicKeyCallback.
+type AuthorizedKeys struct {
+	// Clock is used to check the validity period of certificates. If
+	// nil, time.Now is used.
+	Clock func() time.Time
+
+	keys []authorizedKey
+}
+
+// ParseAuthorizedKeys parses the contents of an authorized_keys file.
+// As in sshd, entries with unsupported key types or with options that
+// cannot be parsed, such as options added by newer versions of
+// OpenSSH, are ignored, so those keys are not accepted.
+func ParseAuthorizedKeys(in []byte) (*AuthorizedKeys, error) {
+	a := new(AuthorizedKeys)
+	for len(in) > 0 {
+		out, _, options, rest, ok := ParseAuthorizedKey(in)
+		if !ok {
+			break
+		}
+		in = rest
+		opts, err := ParseAuthorizedKeyOptions(options)
+		if err != nil {
+			continue
+		}
+		a.keys = append(a.keys, authorizedKey{out.(PublicKey), opts})
+	}
+	return a, nil
+}
+
+// LoadAuthorizedKeys reads the authorized_keys file at path.
+func LoadAuthorizedKeys(path string) (*AuthorizedKeys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAuthorizedKeys(data)
+}
+
+// Authenticate accepts the keys listed in the file, and certificates
+// signed by keys marked cert-authority that name user, or one of the
+// principals option, as a principal. The first entry whose from option
+// matches the client is used, and its restrictions are stored in
+// conn.Permissions, where the server enforces them.
+func (a *AuthorizedKeys) Authenticate(conn *ServerConn, user, algo string, pubkey []byte) bool {
+	key, _, ok := ParsePublicKey(pubkey)
+	if !ok || conn == nil {
+		return false
+	}
+	cert, isCert := key.(*OpenSSHCertV01)
+
+	for _, k := range a.keys {
+		if k.options.CertAuthority != isCert || !k.options.matchFrom(conn.RemoteAddr()) {
+			continue
+		}
+
+		var perms Permissions
+		if isCert {
+			if !sameKey(k.key, cert.SignatureKey) {
+				continue
+			}
+			var ok bool
+			if perms, ok = a.checkCert(conn, user, k, cert); !ok {
+				continue
+			}
+		} else if !sameKey(k.key, key) {
+			continue
+		}
+
+		perms, err := k.options.permissions(perms)
+		if err != nil {
+			continue
+		}
+		conn.Permissions = perms
+		return true
+	}
+	return false
+}
+
+// checkCert validates a certificate signed by the authority k and
+// returns the permissions that it grants.
+func (a *AuthorizedKeys) checkCert(conn *ServerConn, user string, k authorizedKey, cert *OpenSSHCertV01) (Permissions, bool) {
+	names := k.options.Principals
+	if len(names) == 0 {
+		names = []string{user}
+	}
+	principal := ""
+	for _, p := range cert.ValidPrincipals {
+		for _, n := range names {
+			if p == n {
+				principal = p
+			}
+		}
+	}
+	if principal == "" {
+		return Permissions{}, false
+	}
+
+	checker := CertChecker{
+		IsAuthority: func(auth PublicKey) bool { return sameKey(auth, k.key) },
+		Clock:       a.Clock,
+	}
+	if checker.CheckCert(principal, cert) != nil {
+		return Permissions{}, false
+	}
+	perms := certPermissions(cert)
+	if src, ok := perms.CriticalOptions[CertOptionSourceAddress]; ok {
+		if checkSourceAddress(conn.RemoteAddr(), src) != nil {
+			return Permissions{}, false
+		}
+	}
+	return perms, true
+}
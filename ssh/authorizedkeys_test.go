@@ -0,0 +1,323 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseAuthorizedKeyOptions(t *testing.T) {
+	line := `from="10.0.0.0/8,!10.1.2.3",command="echo \"hi\"",environment="LANG=C",` +
+		`permitopen="localhost:80",permitopen="[::1]:*",No-Pty,no-port-forwarding,` +
+		`no-agent-forwarding,principals="alice,bob",cert-authority ` +
+		string(MarshalAuthorizedKey(rsaKey.PublicKey()))
+	_, _, options, _, ok := ParseAuthorizedKey([]byte(line))
+	if !ok {
+		t.Fatalf("ParseAuthorizedKey(%q) failed", line)
+	}
+	got, err := ParseAuthorizedKeyOptions(options)
+	if err != nil {
+		t.Fatalf("ParseAuthorizedKeyOptions: %v", err)
+	}
+	want := &AuthorizedKeyOptions{
+		From:              []string{"10.0.0.0/8", "!10.1.2.3"},
+		Command:           `echo "hi"`,
+		Environment:       []string{"LANG=C"},
+		PermitOpen:        []string{"localhost:80", "[::1]:*"},
+		NoPortForwarding:  true,
+		NoPTY:             true,
+		NoAgentForwarding: true,
+		CertAuthority:     true,
+		Principals:        []string{"alice", "bob"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	for _, bad := range [][]string{
+		{"no-such-option"},
+		{"no-pty=\"yes\""},
+		{"command=ls"},
+		{"environment=\"=x\""},
+		{"permitopen=\"localhost\""},
+	} {
+		if _, err := ParseAuthorizedKeyOptions(bad); err == nil {
+			t.Errorf("ParseAuthorizedKeyOptions(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestAuthorizedKeyOptionsFrom(t *testing.T) {
+	opts := &AuthorizedKeyOptions{From: []string{"10.0.0.0/8", "!10.1.2.3", "192.168.1.?", "*.example.com"}}
+	for addr, want := range map[string]bool{
+		"10.0.0.1":     true,
+		"10.1.2.3":     false,
+		"192.168.1.7":  true,
+		"192.168.1.70": false,
+		"172.16.0.1":   false,
+	} {
+		if got := opts.matchFrom(&net.TCPAddr{IP: net.ParseIP(addr)}); got != want {
+			t.Errorf("%s: got %v, want %v", addr, got, want)
+		}
+	}
+}
+
+// addrConn is a net.Conn with a fixed remote address.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func testServerConn(ip string) *ServerConn {
+	return &ServerConn{
+		transport: &transport{Conn: addrConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 4242}}},
+	}
+}
+
+func TestAuthorizedKeysAuthenticate(t *testing.T) {
+	in := `# comment
+from="192.0.2.0/24" ` + string(MarshalAuthorizedKey(dsaKey.PublicKey())) + `
+no-pty,command="uptime" ` + string(MarshalAuthorizedKey(ecdsaKey.PublicKey())) + `
+cert-authority,principals="admin" ` + string(MarshalAuthorizedKey(rsaKey.PublicKey()))
+	keys, err := ParseAuthorizedKeys([]byte(in))
+	if err != nil {
+		t.Fatalf("ParseAuthorizedKeys: %v", err)
+	}
+
+	conn := testServerConn("192.0.2.1")
+	if !keys.Authenticate(conn, "user", KeyAlgoDSA, MarshalPublicKey(dsaKey.PublicKey())) {
+		t.Errorf("DSA key rejected from an allowed address")
+	}
+	if conn.Permissions.Extensions != nil {
+		t.Errorf("unrestricted key got extensions %v", conn.Permissions.Extensions)
+	}
+	if keys.Authenticate(testServerConn("198.51.100.1"), "user", KeyAlgoDSA, MarshalPublicKey(dsaKey.PublicKey())) {
+		t.Errorf("DSA key accepted from a disallowed address")
+	}
+
+	conn = testServerConn("198.51.100.1")
+	if !keys.Authenticate(conn, "user", KeyAlgoECDSA256, MarshalPublicKey(ecdsaKey.PublicKey())) {
+		t.Fatalf("ECDSA key rejected")
+	}
+	if conn.Permissions.permits(CertExtPermitPTY) || !conn.Permissions.permits(CertExtPermitPortForwarding) {
+		t.Errorf("got extensions %v, want all but permit-pty", conn.Permissions.Extensions)
+	}
+	if got := conn.Permissions.CriticalOptions[CertOptionForceCommand]; got != "uptime" {
+		t.Errorf("got forced command %q, want %q", got, "uptime")
+	}
+
+	if keys.Authenticate(conn, "user", KeyAlgoRSA, MarshalPublicKey(rsaKey.PublicKey())) {
+		t.Errorf("cert-authority key accepted as a user key")
+	}
+
+	cert := testUserCert(t, "admin")
+	conn = testServerConn("198.51.100.1")
+	if !keys.Authenticate(conn, "user", cert.PublicKeyAlgo(), MarshalPublicKey(cert)) {
+		t.Fatalf("certificate for a listed principal rejected")
+	}
+	if !conn.Permissions.permits(CertExtPermitPTY) || conn.Permissions.permits(CertExtPermitPortForwarding) {
+		t.Errorf("got extensions %v, want those of the certificate", conn.Permissions.Extensions)
+	}
+	cert = testUserCert(t, "user")
+	if keys.Authenticate(conn, "user", cert.PublicKeyAlgo(), MarshalPublicKey(cert)) {
+		t.Errorf("certificate without a listed principal accepted")
+	}
+}
+
+func TestParseAuthorizedKeysUnsupportedOptions(t *testing.T) {
+	in := `restrict,pty ` + string(MarshalAuthorizedKey(ecdsaKey.PublicKey())) + `
+expiry-time="20300101" ` + string(MarshalAuthorizedKey(rsaKey.PublicKey())) + `
+` + string(MarshalAuthorizedKey(dsaKey.PublicKey()))
+	keys, err := ParseAuthorizedKeys([]byte(in))
+	if err != nil {
+		t.Fatalf("ParseAuthorizedKeys: %v", err)
+	}
+	conn := testServerConn("192.0.2.1")
+	if keys.Authenticate(conn, "user", KeyAlgoECDSA256, MarshalPublicKey(ecdsaKey.PublicKey())) {
+		t.Errorf("key with unsupported options accepted")
+	}
+	if keys.Authenticate(conn, "user", KeyAlgoRSA, MarshalPublicKey(rsaKey.PublicKey())) {
+		t.Errorf("key with unsupported options accepted")
+	}
+	if !keys.Authenticate(conn, "user", KeyAlgoDSA, MarshalPublicKey(dsaKey.PublicKey())) {
+		t.Errorf("key after entries with unsupported options rejected")
+	}
+}
+
+func TestPermissionsFilterChannelRequest(t *testing.T) {
+	conn := &ServerConn{Permissions: Permissions{
+		CriticalOptions: map[string]string{CertOptionForceCommand: "uptime"},
+		Extensions:      map[string]string{CertExtPermitAgentForwarding: ""},
+		Environment:     []string{"LANG=C", "BROKEN", "=x"},
+	}}
+	c := &serverChan{}
+
+	reqs, err := conn.filterChannelRequest(c, &channelRequestMsg{Request: "pty-req"})
+	if err != nil || len(reqs) != 0 {
+		t.Errorf("pty-req passed: %v, %v", reqs, err)
+	}
+	reqs, err = conn.filterChannelRequest(c, &channelRequestMsg{Request: "auth-agent-req@openssh.com"})
+	if err != nil || len(reqs) != 1 {
+		t.Errorf("auth-agent-req@openssh.com refused: %v, %v", reqs, err)
+	}
+
+	reqs, err = conn.filterChannelRequest(c, &channelRequestMsg{
+		Request:             "exec",
+		WantReply:           true,
+		RequestSpecificData: appendString(nil, "ls"),
+	})
+	if err != nil {
+		t.Fatalf("filterChannelRequest: %v", err)
+	}
+	var got []string
+	for _, r := range reqs {
+		got = append(got, r.Request+" "+safeString(string(r.RequestSpecificData)))
+	}
+	want := []string{
+		"env " + safeString(string(appendString(appendString(nil, "LANG"), "C"))),
+		"env " + safeString(string(appendString(appendString(nil, "SSH_ORIGINAL_COMMAND"), "ls"))),
+		"exec " + safeString(string(appendString(nil, "uptime"))),
+	}
+	if !reflect.DeepEqual(got, want) || !reqs[2].WantReply {
+		t.Errorf("got requests %q, want %q", got, want)
+	}
+
+	// The environment is only sent once per channel.
+	reqs, _ = conn.filterChannelRequest(c, &channelRequestMsg{Request: "shell"})
+	if len(reqs) != 1 || reqs[0].Request != "exec" {
+		t.Errorf("shell request became %v", reqs)
+	}
+}
+
+func TestPermissionsPermitOpen(t *testing.T) {
+	perms := Permissions{PermitOpen: []string{"localhost:80", "*:443", "[::1]:*"}}
+	for _, c := range []struct {
+		host string
+		port uint32
+		want bool
+	}{
+		{"localhost", 80, true},
+		{"LOCALHOST", 80, true},
+		{"localhost", 8080, false},
+		{"example.com", 443, true},
+		{"::1", 22, true},
+		{"127.0.0.1", 22, false},
+	} {
+		if got := perms.permitsOpen(c.host, c.port); got != c.want {
+			t.Errorf("permitsOpen(%s, %d) = %v, want %v", c.host, c.port, got, c.want)
+		}
+	}
+	perms.Extensions = map[string]string{}
+	if perms.permitsOpen("localhost", 80) {
+		t.Errorf("forwarding permitted without permit-port-forwarding")
+	}
+}
+
+func TestAuthorizedKeysEnforcement(t *testing.T) {
+	line := `no-pty,command="echo forced",environment="LANG=C",permitopen="127.0.0.1:80" ` +
+		string(MarshalAuthorizedKey(ecdsaKey.PublicKey()))
+	keys, err := ParseAuthorizedKeys([]byte(line))
+	if err != nil {
+		t.Fatalf("ParseAuthorizedKeys: %v", err)
+	}
+	serverConf := &ServerConfig{PublicKeyCallback: keys.Authenticate}
+	serverConf.AddHostKey(rsaKey)
+	l, err := Listen("tcp", "127.0.0.1:0", serverConf)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+
+	// The server records what reaches the application.
+	seen := make(chan string, 10)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			return
+		}
+		defer conn.Close()
+		if err := conn.Handshake(); err != nil {
+			t.Errorf("Handshake: %v", err)
+			return
+		}
+		for {
+			ch, err := conn.Accept()
+			if err != nil {
+				return
+			}
+			if ch.ChannelType() != "session" {
+				seen <- ch.ChannelType()
+				ch.Reject(Prohibited, "not here")
+				continue
+			}
+			ch.Accept()
+			go func() {
+				defer ch.Close()
+				for {
+					_, err := ch.Read(make([]byte, 1))
+					req, ok := err.(ChannelRequest)
+					if !ok {
+						return
+					}
+					seen <- req.Request + " " + safeString(string(req.Payload))
+					if req.WantReply {
+						ch.AckRequest(true)
+					}
+					if req.Request == "exec" {
+						sendStatus(0, ch.(*serverChan), t)
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	client, err := Dial("tcp", l.Addr().String(), &ClientConfig{
+		User: "testuser",
+		Auth: []ClientAuth{ClientAuthKeyring(&keychain{keys: []Signer{ecdsaKey}})},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	if err := session.RequestPty("xterm", 80, 40, TerminalModes{}); err == nil {
+		t.Errorf("pty request succeeded despite no-pty")
+	}
+	if err := session.Run("ls"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := []string{
+		"env " + safeString(string(appendString(appendString(nil, "LANG"), "C"))),
+		"env " + safeString(string(appendString(appendString(nil, "SSH_ORIGINAL_COMMAND"), "ls"))),
+		"exec " + safeString(string(appendString(nil, "echo forced"))),
+	}
+	for _, w := range want {
+		if got := <-seen; got != w {
+			t.Errorf("server got request %q, want %q", got, w)
+		}
+	}
+
+	if _, err := client.Dial("tcp", "127.0.0.2:80"); err == nil {
+		t.Errorf("forwarding to a destination not in permitopen succeeded")
+	}
+	if _, err := client.Dial("tcp", "127.0.0.1:80"); err == nil {
+		t.Errorf("forwarding reached a server that rejects it")
+	}
+	if got := <-seen; got != "direct-tcpip" {
+		t.Errorf("server saw %q, want only the permitted direct-tcpip channel", got)
+	}
+}
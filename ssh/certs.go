@@ -5,6 +5,12 @@
 package ssh
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -16,6 +22,12 @@ const (
 	CertAlgoECDSA256v01 = "ecdsa-sha2-nistp256-cert-v01@openssh.com"
 	CertAlgoECDSA384v01 = "ecdsa-sha2-nistp384-cert-v01@openssh.com"
 	CertAlgoECDSA521v01 = "ecdsa-sha2-nistp521-cert-v01@openssh.com"
+	CertAlgoED25519v01  = "ssh-ed25519-cert-v01@openssh.com"
+
+	// These select an RSA certificate with a SHA-2 signature
+	// algorithm, see RFC 8332.
+	CertSigAlgoRSASHA2256v01 = "rsa-sha2-256-cert-v01@openssh.com"
+	CertSigAlgoRSASHA2512v01 = "rsa-sha2-512-cert-v01@openssh.com"
 )
 
 // Certificate types are used to specify whether a certificate is for identification
@@ -25,6 +37,11 @@ const (
 	HostCert = 2
 )
 
+// CertTimeInfinity is the ValidBefore time of a certificate that never
+// expires. It is the largest time.Time that can be represented, and
+// is serialized as the largest 64-bit timestamp.
+var CertTimeInfinity = time.Unix(1<<63-1-62135596800, 0)
+
 type signature struct {
 	Format string
 	Blob   []byte
@@ -58,6 +75,7 @@ var certAlgoNames = map[string]string{
 	KeyAlgoECDSA256: CertAlgoECDSA256v01,
 	KeyAlgoECDSA384: CertAlgoECDSA384v01,
 	KeyAlgoECDSA521: CertAlgoECDSA521v01,
+	KeyAlgoED25519:  CertAlgoED25519v01,
 }
 
 func (c *OpenSSHCertV01) PublicKeyAlgo() string {
@@ -83,12 +101,26 @@ func parseOpenSSHCertV01(in []byte, algo string) (out *OpenSSHCertV01, rest []by
 		return
 	}
 
-	cert.Key, in, ok = ParsePublicKey(in)
+	// The key embedded in a certificate is serialized without its
+	// algorithm name, see [PROTOCOL.certkeys].
+	privAlgo := pubAlgoToPrivAlgo(algo)
+	switch privAlgo {
+	case KeyAlgoRSA:
+		cert.Key, in, ok = parseRSA(in)
+	case KeyAlgoDSA:
+		cert.Key, in, ok = parseDSA(in)
+	case KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521:
+		cert.Key, in, ok = parseECDSA(in)
+	case KeyAlgoED25519:
+		cert.Key, in, ok = parseED25519(in)
+	default:
+		ok = false
+	}
 	if !ok {
 		return
 	}
 
-	if cert.Key.PrivateKeyAlgo() != algo {
+	if cert.Key.PrivateKeyAlgo() != privAlgo {
 		ok = false
 		return
 	}
@@ -115,13 +147,13 @@ func parseOpenSSHCertV01(in []byte, algo string) (out *OpenSSHCertV01, rest []by
 	if !ok {
 		return
 	}
-	cert.ValidAfter = time.Unix(int64(va), 0)
+	cert.ValidAfter = certTime(va)
 
 	vb, in, ok := parseUint64(in)
 	if !ok {
 		return
 	}
-	cert.ValidBefore = time.Unix(int64(vb), 0)
+	cert.ValidBefore = certTime(vb)
 
 	if cert.CriticalOptions, in, ok = parseTupleList(in); !ok {
 		return
@@ -152,7 +184,7 @@ func parseOpenSSHCertV01(in []byte, algo string) (out *OpenSSHCertV01, rest []by
 }
 
 func (cert *OpenSSHCertV01) Marshal() []byte {
-	pubKey := MarshalPublicKey(cert.Key)
+	pubKey := cert.Key.Marshal()
 
 	sigKey := MarshalPublicKey(cert.SignatureKey)
 
@@ -178,8 +210,8 @@ func (cert *OpenSSHCertV01) Marshal() []byte {
 	r = marshalUint32(r, cert.Type)
 	r = marshalString(r, []byte(cert.KeyId))
 	r = marshalLengthPrefixedNameList(r, cert.ValidPrincipals)
-	r = marshalUint64(r, uint64(cert.ValidAfter.Unix()))
-	r = marshalUint64(r, uint64(cert.ValidBefore.Unix()))
+	r = marshalUint64(r, certTimeUnix(cert.ValidAfter))
+	r = marshalUint64(r, certTimeUnix(cert.ValidBefore))
 	r = marshalTupleList(r, cert.CriticalOptions)
 	r = marshalTupleList(r, cert.Extensions)
 	r = marshalString(r, cert.Reserved)
@@ -191,6 +223,42 @@ func (cert *OpenSSHCertV01) Marshal() []byte {
 	return ret
 }
 
+// bytesForSigning returns the certificate serialization covered by the
+// CA signature: everything from the algorithm name up to, but not
+// including, the signature.
+func (cert *OpenSSHCertV01) bytesForSigning() []byte {
+	c2 := *cert
+	c2.Signature = nil
+	out := MarshalPublicKey(&c2)
+	// Drop the length prefix of the (empty) signature.
+	return out[:len(out)-4]
+}
+
+// validSignature reports whether the certificate carries a valid
+// signature by its SignatureKey.
+func (cert *OpenSSHCertV01) validSignature() bool {
+	if cert.SignatureKey == nil || cert.Signature == nil {
+		return false
+	}
+	return verifySignature(cert.SignatureKey, cert.bytesForSigning(), cert.Signature)
+}
+
+// certTime converts a timestamp from the wire into a time.Time. Values
+// that do not fit in an int64 are treated as "forever".
+func certTime(t uint64) time.Time {
+	if t >= uint64(CertTimeInfinity.Unix()) {
+		return CertTimeInfinity
+	}
+	return time.Unix(int64(t), 0)
+}
+
+func certTimeUnix(t time.Time) uint64 {
+	if !t.Before(CertTimeInfinity) {
+		return 1<<64 - 1
+	}
+	return uint64(t.Unix())
+}
+
 func lengthPrefixedNameListLength(namelist []string) int {
 	length := 4 // length prefix for list
 	for _, name := range namelist {
@@ -272,6 +340,9 @@ func parseTupleList(in []byte) (out []tuple, rest []byte, ok bool) {
 
 func signatureLength(sig *signature) int {
 	length := 4 // length prefix for signature
+	if sig == nil {
+		return length
+	}
 	length += stringLength(len(sig.Format))
 	length += stringLength(len(sig.Blob))
 	return length
@@ -280,6 +351,9 @@ func signatureLength(sig *signature) int {
 func marshalSignature(to []byte, sig *signature) []byte {
 	length := uint32(signatureLength(sig) - 4)
 	to = marshalUint32(to, length)
+	if sig == nil {
+		return to
+	}
 	to = marshalString(to, []byte(sig.Format))
 	to = marshalString(to, sig.Blob)
 	return to
@@ -308,6 +382,336 @@ func parseSignature(in []byte) (out *signature, rest []byte, ok bool) {
 		return
 	}
 
-	// TODO(hanwen): this is a bug; 'rest' gets swallowed.
-	return parseSignatureBody(sigBytes)
+	if out, _, ok = parseSignatureBody(sigBytes); !ok {
+		return nil, nil, false
+	}
+	return out, rest, ok
+}
+
+// SignCert fills in the SignatureKey and Signature of the certificate
+// using authority. A random Nonce is generated if none is set. All
+// other fields must be filled in before calling SignCert; changing
+// them afterwards invalidates the signature.
+func (c *OpenSSHCertV01) SignCert(rand io.Reader, authority Signer) error {
+	if c.Key == nil {
+		return errors.New("ssh: certificate has no key")
+	}
+	if _, ok := certAlgoNames[c.Key.PublicKeyAlgo()]; !ok {
+		return errors.New("ssh: certificates are not supported for key type " + c.Key.PublicKeyAlgo())
+	}
+	if len(c.Nonce) == 0 {
+		c.Nonce = make([]byte, 32)
+		if _, err := io.ReadFull(rand, c.Nonce); err != nil {
+			return err
+		}
+	}
+
+	c.SignatureKey = authority.PublicKey()
+	c.Signature = nil
+	// OpenSSH no longer accepts SHA-1 signatures by RSA authorities.
+	algo := c.SignatureKey.PrivateKeyAlgo()
+	if _, ok := authority.(AlgorithmSigner); ok && algo == KeyAlgoRSA {
+		algo = SigAlgoRSASHA2512
+	}
+	blob, err := signWithAlgorithm(authority, rand, c.bytesForSigning(), algo)
+	if err != nil {
+		return err
+	}
+	c.Signature = &signature{
+		Format: algo,
+		Blob:   blob,
+	}
+	return nil
+}
+
+// NewCertSigner returns a Signer that presents cert as its public key
+// and signs with signer, which must hold the private key for the
+// certificate's key. It can be used as a host key with
+// ServerConfig.AddHostKey, or for public key authentication.
+func NewCertSigner(cert *OpenSSHCertV01, signer Signer) (Signer, error) {
+	if cert.Key == nil || !bytes.Equal(MarshalPublicKey(cert.Key), MarshalPublicKey(signer.PublicKey())) {
+		return nil, errors.New("ssh: signer and certificate key do not match")
+	}
+	return &certSigner{cert, signer}, nil
+}
+
+type certSigner struct {
+	cert   *OpenSSHCertV01
+	signer Signer
+}
+
+func (s *certSigner) PublicKey() PublicKey {
+	return s.cert
+}
+
+func (s *certSigner) Sign(rand io.Reader, data []byte) ([]byte, error) {
+	return s.signer.Sign(rand, data)
+}
+
+func (s *certSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) ([]byte, error) {
+	return signWithAlgorithm(s.signer, rand, data, algorithm)
+}
+
+// SetCriticalOption sets the critical option name, such as
+// force-command, to value. Options are kept sorted by name, as
+// required by [PROTOCOL.certkeys].
+func (c *OpenSSHCertV01) SetCriticalOption(name, value string) {
+	c.CriticalOptions = setTuple(c.CriticalOptions, name, value)
+}
+
+// CriticalOption returns the value of the critical option name.
+func (c *OpenSSHCertV01) CriticalOption(name string) (value string, ok bool) {
+	return getTuple(c.CriticalOptions, name)
+}
+
+// SetExtension sets the extension name, such as permit-pty, to value,
+// which is usually empty. Extensions are kept sorted by name.
+func (c *OpenSSHCertV01) SetExtension(name, value string) {
+	c.Extensions = setTuple(c.Extensions, name, value)
+}
+
+// Extension returns the value of the extension name.
+func (c *OpenSSHCertV01) Extension(name string) (value string, ok bool) {
+	return getTuple(c.Extensions, name)
+}
+
+func setTuple(list []tuple, name, value string) []tuple {
+	t := tuple{Name: name}
+	if value != "" {
+		t.Data = string(appendString(nil, value))
+	}
+
+	i := 0
+	for i < len(list) && list[i].Name < name {
+		i++
+	}
+	if i < len(list) && list[i].Name == name {
+		list[i] = t
+		return list
+	}
+	list = append(list, tuple{})
+	copy(list[i+1:], list[i:])
+	list[i] = t
+	return list
+}
+
+func getTuple(list []tuple, name string) (string, bool) {
+	for _, t := range list {
+		if t.Name == name {
+			return tupleValue(t)
+		}
+	}
+	return "", false
+}
+
+// tupleValue returns the value of a critical option or extension.
+// Values are themselves encoded as strings on the wire; an empty Data
+// field stands for the empty value.
+func tupleValue(t tuple) (string, bool) {
+	if len(t.Data) == 0 {
+		return "", true
+	}
+	value, rest, ok := parseString([]byte(t.Data))
+	if !ok || len(rest) > 0 {
+		return "", false
+	}
+	return string(value), true
+}
+
+// These critical options are defined in [PROTOCOL.certkeys] and are
+// understood by CertChecker.
+const (
+	CertOptionForceCommand  = "force-command"
+	CertOptionSourceAddress = "source-address"
+)
+
+// These extensions are defined in [PROTOCOL.certkeys]. Each grants a
+// feature that the server refuses to clients whose Permissions list
+// extensions without it.
+const (
+	CertExtPermitX11Forwarding   = "permit-X11-forwarding"
+	CertExtPermitAgentForwarding = "permit-agent-forwarding"
+	CertExtPermitPortForwarding  = "permit-port-forwarding"
+	CertExtPermitPTY             = "permit-pty"
+	CertExtPermitUserRC          = "permit-user-rc"
+)
+
+// defaultExtensions are the extensions that ssh-keygen puts in user
+// certificates by default.
+var defaultExtensions = []string{
+	CertExtPermitX11Forwarding,
+	CertExtPermitAgentForwarding,
+	CertExtPermitPortForwarding,
+	CertExtPermitPTY,
+	CertExtPermitUserRC,
+}
+
+// CertChecker validates OpenSSH user certificates. Its Authenticate
+// method can be used as ServerConfig.PublicKeyCallback.
+type CertChecker struct {
+	// SupportedCriticalOptions lists the critical options that
+	// the application understands, in addition to force-command
+	// and source-address. Certificates with other critical
+	// options are rejected.
+	SupportedCriticalOptions []string
+
+	// IsAuthority reports whether auth is a trusted authority for
+	// user certificates.
+	IsAuthority func(auth PublicKey) bool
+
+	// IsRevoked, if non-nil, is called for every certificate and
+	// should return true if it has been revoked.
+	IsRevoked func(cert *OpenSSHCertV01) bool
+
+	// Clock returns the time used to check the validity period of
+	// certificates. If nil, time.Now is used.
+	Clock func() time.Time
+
+	// UserKeyFallback, if non-nil, is called for public keys that
+	// are not certificates. If nil, such keys are rejected.
+	UserKeyFallback func(conn *ServerConn, user string, key PublicKey) bool
+}
+
+// CheckCert checks that cert is a user certificate for principal
+// that is currently valid, signed by a trusted authority and not
+// revoked, and that it carries no unsupported critical options.
+func (c *CertChecker) CheckCert(principal string, cert *OpenSSHCertV01) error {
+	if cert.Type != UserCert {
+		return errors.New("ssh: certificate is not a user certificate")
+	}
+	if cert.SignatureKey == nil || c.IsAuthority == nil || !c.IsAuthority(cert.SignatureKey) {
+		return errors.New("ssh: certificate signed by unrecognized authority")
+	}
+	if !cert.validSignature() {
+		return errors.New("ssh: certificate signature does not verify")
+	}
+	if c.IsRevoked != nil && c.IsRevoked(cert) {
+		return fmt.Errorf("ssh: certificate serial %d revoked", cert.Serial)
+	}
+
+	now := time.Now()
+	if c.Clock != nil {
+		now = c.Clock()
+	}
+	if now.Before(cert.ValidAfter) {
+		return errors.New("ssh: certificate is not yet valid")
+	}
+	if !now.Before(cert.ValidBefore) {
+		return errors.New("ssh: certificate has expired")
+	}
+
+	// As in sshd, a user certificate without principals is not valid
+	// for any user.
+	if len(cert.ValidPrincipals) == 0 {
+		return errors.New("ssh: certificate has no principals")
+	}
+	found := false
+	for _, p := range cert.ValidPrincipals {
+		if p == principal {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("ssh: principal %q not in the set of valid principals for certificate", principal)
+	}
+
+	for _, opt := range cert.CriticalOptions {
+		if _, ok := tupleValue(opt); !ok {
+			return fmt.Errorf("ssh: malformed critical option %q", opt.Name)
+		}
+		if opt.Name == CertOptionForceCommand || opt.Name == CertOptionSourceAddress {
+			continue
+		}
+		supported := false
+		for _, s := range c.SupportedCriticalOptions {
+			if s == opt.Name {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return fmt.Errorf("ssh: unsupported critical option %q in certificate", opt.Name)
+		}
+	}
+	return nil
+}
+
+// Authenticate checks a public key offered for user. Certificates
+// are validated with CheckCert, and their source-address option is
+// matched against the remote address of conn. On success, the critical
+// options and extensions of the certificate are stored in
+// conn.Permissions. Other keys are passed to UserKeyFallback.
+func (c *CertChecker) Authenticate(conn *ServerConn, user, algo string, pubkey []byte) bool {
+	key, _, ok := ParsePublicKey(pubkey)
+	if !ok {
+		return false
+	}
+	cert, ok := key.(*OpenSSHCertV01)
+	if !ok {
+		if c.UserKeyFallback == nil {
+			return false
+		}
+		return c.UserKeyFallback(conn, user, key)
+	}
+
+	if c.CheckCert(user, cert) != nil {
+		return false
+	}
+
+	perms := certPermissions(cert)
+	if src, ok := perms.CriticalOptions[CertOptionSourceAddress]; ok {
+		if conn == nil || checkSourceAddress(conn.RemoteAddr(), src) != nil {
+			return false
+		}
+	}
+
+	if conn != nil {
+		conn.Permissions = perms
+	}
+	return true
+}
+
+// certPermissions returns the critical options and extensions of
+// cert as Permissions.
+func certPermissions(cert *OpenSSHCertV01) Permissions {
+	perms := Permissions{
+		CriticalOptions: make(map[string]string),
+		Extensions:      make(map[string]string),
+	}
+	for _, opt := range cert.CriticalOptions {
+		perms.CriticalOptions[opt.Name], _ = tupleValue(opt)
+	}
+	for _, ext := range cert.Extensions {
+		perms.Extensions[ext.Name], _ = tupleValue(ext)
+	}
+	return perms
+}
+
+// checkSourceAddress checks that addr is within one of the comma
+// separated addresses or CIDR networks in sourceAddr.
+func checkSourceAddress(addr net.Addr, sourceAddr string) error {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return errors.New("ssh: source-address requires a TCP connection")
+	}
+
+	for _, sourceAddr := range strings.Split(sourceAddr, ",") {
+		if allowedIP := net.ParseIP(sourceAddr); allowedIP != nil {
+			if allowedIP.Equal(tcpAddr.IP) {
+				return nil
+			}
+		} else {
+			_, ipNet, err := net.ParseCIDR(sourceAddr)
+			if err != nil {
+				return fmt.Errorf("ssh: error parsing source-address restriction %q: %v", sourceAddr, err)
+			}
+
+			if ipNet.Contains(tcpAddr.IP) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("ssh: remote address %v is not allowed because of source-address restriction", addr)
 }
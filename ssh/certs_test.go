@@ -0,0 +1,357 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// certKeychain offers a certificate for a private key.
+type certKeychain struct {
+	cert   *OpenSSHCertV01
+	signer Signer
+}
+
+func (k *certKeychain) Key(i int) (PublicKey, error) {
+	if i != 0 {
+		return nil, nil
+	}
+	return k.cert, nil
+}
+
+func (k *certKeychain) Sign(i int, rand io.Reader, data []byte) ([]byte, error) {
+	return k.signer.Sign(rand, data)
+}
+
+// testUserCert returns a user certificate for ecdsaKey, valid for an
+// hour and signed by rsaKey.
+func testUserCert(t *testing.T, principals ...string) *OpenSSHCertV01 {
+	now := time.Now()
+	cert := &OpenSSHCertV01{
+		Nonce:           []byte{1, 2, 3},
+		Key:             ecdsaKey.PublicKey(),
+		Serial:          42,
+		Type:            UserCert,
+		KeyId:           "test",
+		ValidPrincipals: principals,
+		ValidAfter:      now.Add(-time.Hour),
+		ValidBefore:     now.Add(time.Hour),
+	}
+	cert.SetExtension("permit-pty", "")
+	signCert(t, cert, rsaKey)
+	return cert
+}
+
+func signCert(t *testing.T, cert *OpenSSHCertV01, authority Signer) {
+	if err := cert.SignCert(rand.Reader, authority); err != nil {
+		t.Fatalf("SignCert: %v", err)
+	}
+}
+
+func testCertChecker() *CertChecker {
+	return &CertChecker{
+		IsAuthority: func(auth PublicKey) bool {
+			return sameKey(auth, rsaKey.PublicKey())
+		},
+	}
+}
+
+func TestCheckCert(t *testing.T) {
+	checker := testCertChecker()
+
+	cert := testUserCert(t, "user")
+	if err := checker.CheckCert("user", cert); err != nil {
+		t.Errorf("CheckCert: %v", err)
+	}
+	if err := checker.CheckCert("root", cert); err == nil {
+		t.Errorf("CheckCert accepted wrong principal")
+	}
+
+	checker.Clock = func() time.Time { return cert.ValidBefore }
+	if err := checker.CheckCert("user", cert); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("CheckCert: got %v, want expiry error", err)
+	}
+	checker.Clock = nil
+
+	checker.IsRevoked = func(c *OpenSSHCertV01) bool { return c.Serial == 42 }
+	if err := checker.CheckCert("user", cert); err == nil {
+		t.Errorf("CheckCert accepted revoked certificate")
+	}
+	checker.IsRevoked = nil
+
+	untrusted := testUserCert(t, "user")
+	signCert(t, untrusted, dsaKey)
+	if err := checker.CheckCert("user", untrusted); err == nil {
+		t.Errorf("CheckCert accepted certificate from unknown authority")
+	}
+
+	tampered := testUserCert(t, "user")
+	tampered.ValidPrincipals = []string{"root"}
+	if err := checker.CheckCert("root", tampered); err == nil {
+		t.Errorf("CheckCert accepted certificate with bad signature")
+	}
+
+	opts := testUserCert(t, "user")
+	opts.CriticalOptions = []tuple{{"unknown-option", ""}}
+	signCert(t, opts, rsaKey)
+	if err := checker.CheckCert("user", opts); err == nil {
+		t.Errorf("CheckCert accepted unsupported critical option")
+	}
+	checker.SupportedCriticalOptions = []string{"unknown-option"}
+	if err := checker.CheckCert("user", opts); err != nil {
+		t.Errorf("CheckCert: %v", err)
+	}
+}
+
+func TestCertCheckerAuthenticate(t *testing.T) {
+	for _, c := range []struct {
+		source string
+		ok     bool
+	}{
+		{"", true},
+		{"10.0.0.0/8,127.0.0.1/32", true},
+		{"10.0.0.0/8", false},
+	} {
+		cert := testUserCert(t, "testuser")
+		cert.SetCriticalOption(CertOptionForceCommand, "true")
+		if c.source != "" {
+			cert.SetCriticalOption(CertOptionSourceAddress, c.source)
+		}
+		signCert(t, cert, rsaKey)
+
+		serverConf := &ServerConfig{
+			PublicKeyCallback: testCertChecker().Authenticate,
+		}
+		serverConf.AddHostKey(rsaKey)
+		l, err := Listen("tcp", "127.0.0.1:0", serverConf)
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		done := make(chan *ServerConn, 1)
+		go func() {
+			defer l.Close()
+			conn, err := l.Accept()
+			if err != nil {
+				done <- nil
+				return
+			}
+			if err := conn.Handshake(); err != nil {
+				conn.Close()
+				done <- nil
+				return
+			}
+			done <- conn
+		}()
+
+		clientConf := &ClientConfig{
+			User: "testuser",
+			Auth: []ClientAuth{
+				ClientAuthKeyring(&certKeychain{cert, ecdsaKey}),
+			},
+		}
+		client, err := Dial("tcp", l.Addr().String(), clientConf)
+		if (err == nil) != c.ok {
+			t.Errorf("source-address %q: got error %v, want ok=%v", c.source, err, c.ok)
+		}
+		if err == nil {
+			client.Close()
+		}
+
+		conn := <-done
+		if conn == nil {
+			continue
+		}
+		if got := conn.Permissions.CriticalOptions[CertOptionForceCommand]; got != "true" {
+			t.Errorf("got force-command %q, want %q", got, "true")
+		}
+		if _, ok := conn.Permissions.Extensions["permit-pty"]; !ok {
+			t.Errorf("permit-pty extension missing from %v", conn.Permissions.Extensions)
+		}
+		conn.Close()
+	}
+}
+
+func TestCertCheckerNoPrincipals(t *testing.T) {
+	checker := testCertChecker()
+	cert := testUserCert(t)
+	if checker.Authenticate(nil, "user", cert.PublicKeyAlgo(), MarshalPublicKey(cert)) {
+		t.Errorf("certificate without principals accepted")
+	}
+	cert = testUserCert(t, "user")
+	if !checker.Authenticate(nil, "user", cert.PublicKeyAlgo(), MarshalPublicKey(cert)) {
+		t.Errorf("certificate for user rejected")
+	}
+}
+
+func TestCertCheckerUserKeyFallback(t *testing.T) {
+	checker := testCertChecker()
+	pub := MarshalPublicKey(ecdsaKey.PublicKey())
+	if checker.Authenticate(nil, "user", KeyAlgoECDSA256, pub) {
+		t.Errorf("plain key accepted without UserKeyFallback")
+	}
+	checker.UserKeyFallback = func(conn *ServerConn, user string, key PublicKey) bool {
+		return sameKey(key, ecdsaKey.PublicKey())
+	}
+	if !checker.Authenticate(nil, "user", KeyAlgoECDSA256, pub) {
+		t.Errorf("plain key rejected by UserKeyFallback")
+	}
+}
+
+func TestSignCertRoundTrip(t *testing.T) {
+	for _, key := range []Signer{rsaKey, dsaKey, ecdsaKey} {
+		cert := &OpenSSHCertV01{
+			Key:             key.PublicKey(),
+			Serial:          1234,
+			Type:            HostCert,
+			KeyId:           "host key",
+			ValidPrincipals: []string{"example.com", "www.example.com"},
+			ValidAfter:      time.Unix(1000000000, 0),
+			ValidBefore:     CertTimeInfinity,
+		}
+		cert.SetExtension("permit-X11-forwarding", "")
+		cert.SetExtension("permit-agent-forwarding", "")
+		cert.SetCriticalOption(CertOptionSourceAddress, "192.0.2.0/24")
+		if err := cert.SignCert(rand.Reader, ecdsaKey); err != nil {
+			t.Fatalf("SignCert: %v", err)
+		}
+		if len(cert.Nonce) == 0 {
+			t.Errorf("SignCert did not fill in the nonce")
+		}
+		if cert.Extensions[0].Name != "permit-X11-forwarding" {
+			t.Errorf("extensions not sorted: %v", cert.Extensions)
+		}
+
+		out, comment, _, rest, ok := ParseAuthorizedKey(append([]byte("# certificate\n"), MarshalAuthorizedKey(cert)...))
+		if !ok || len(rest) > 0 || comment != "" {
+			t.Fatalf("ParseAuthorizedKey(%s) failed", cert.PublicKeyAlgo())
+		}
+		got, ok := out.(*OpenSSHCertV01)
+		if !ok {
+			t.Fatalf("got %T, want *OpenSSHCertV01", out)
+		}
+		if !bytes.Equal(MarshalPublicKey(got), MarshalPublicKey(cert)) {
+			t.Errorf("%s: certificate changed in round trip", cert.PublicKeyAlgo())
+		}
+		if !got.validSignature() || !got.ValidBefore.Equal(CertTimeInfinity) {
+			t.Errorf("%s: invalid certificate after round trip", cert.PublicKeyAlgo())
+		}
+		if v, ok := got.CriticalOption(CertOptionSourceAddress); !ok || v != "192.0.2.0/24" {
+			t.Errorf("got source-address %q, want %q", v, "192.0.2.0/24")
+		}
+	}
+}
+
+func TestSignCertRSASHA2(t *testing.T) {
+	cert := testUserCert(t, "user")
+	if cert.Signature.Format != SigAlgoRSASHA2512 {
+		t.Errorf("got signature format %s, want %s", cert.Signature.Format, SigAlgoRSASHA2512)
+	}
+	if !cert.validSignature() {
+		t.Errorf("rsa-sha2-512 signed certificate does not verify")
+	}
+	cert.Signature.Format = SigAlgoRSASHA2256
+	if cert.validSignature() {
+		t.Errorf("signature verified with the wrong hash")
+	}
+}
+
+func TestParseAuthorizedKeyECDSA(t *testing.T) {
+	line := append([]byte(`no-pty,command="ls" `), MarshalAuthorizedKey(ecdsaKey.PublicKey())...)
+	out, _, options, _, ok := ParseAuthorizedKey(line)
+	if !ok {
+		t.Fatalf("ParseAuthorizedKey failed for %q", line)
+	}
+	if !sameKey(out.(PublicKey), ecdsaKey.PublicKey()) {
+		t.Errorf("got key %v, want %v", out, ecdsaKey.PublicKey())
+	}
+	if len(options) != 2 {
+		t.Errorf("got options %q, want 2 options", options)
+	}
+}
+
+// hostKeyRecorder is a HostKeyChecker that accepts any key and records
+// the algorithm.
+type hostKeyRecorder struct {
+	algo string
+}
+
+func (r *hostKeyRecorder) Check(addr string, remote net.Addr, algorithm string, hostKey []byte) error {
+	r.algo = algorithm
+	return nil
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	serverConfig := &ServerConfig{
+		PasswordCallback: func(conn *ServerConn, user, password string) bool {
+			return password == "password"
+		},
+	}
+	now := time.Now()
+	hostCert := &OpenSSHCertV01{
+		Key:         ecdsaKey.PublicKey(),
+		Type:        HostCert,
+		ValidAfter:  now.Add(-time.Hour),
+		ValidBefore: now.Add(time.Hour),
+	}
+	signCert(t, hostCert, rsaKey)
+	certSigner, err := NewCertSigner(hostCert, ecdsaKey)
+	if err != nil {
+		t.Fatalf("NewCertSigner: %v", err)
+	}
+	for _, k := range []Signer{rsaKey, dsaKey, ecdsaKey, certSigner} {
+		serverConfig.AddHostKey(k)
+	}
+
+	for _, c := range []struct {
+		prefs []string
+		want  string
+	}{
+		{nil, KeyAlgoRSA},
+		{[]string{KeyAlgoRSA}, KeyAlgoRSA},
+		{[]string{SigAlgoRSASHA2256}, KeyAlgoRSA},
+		{[]string{SigAlgoRSASHA2512, KeyAlgoRSA}, KeyAlgoRSA},
+		{[]string{KeyAlgoDSA}, KeyAlgoDSA},
+		{[]string{KeyAlgoECDSA384, KeyAlgoECDSA256}, KeyAlgoECDSA256},
+		{[]string{CertAlgoRSAv01, CertAlgoECDSA256v01}, CertAlgoECDSA256v01},
+	} {
+		recorder := new(hostKeyRecorder)
+		clientConfig := &ClientConfig{
+			User:              "user",
+			Auth:              []ClientAuth{ClientAuthPassword(password("password"))},
+			HostKeyAlgorithms: c.prefs,
+			HostKeyChecker:    recorder,
+		}
+		if err := testKex(clientConfig, serverConfig); err != nil {
+			t.Errorf("%v: %v", c.prefs, err)
+			continue
+		}
+		if recorder.algo != c.want {
+			t.Errorf("%v: got host key algorithm %s, want %s", c.prefs, recorder.algo, c.want)
+		}
+	}
+
+	// Without an RSA key, the default falls back to the other types.
+	serverConfig = &ServerConfig{PasswordCallback: serverConfig.PasswordCallback}
+	serverConfig.AddHostKey(ecdsaKey)
+	recorder := new(hostKeyRecorder)
+	clientConfig := &ClientConfig{
+		User:           "user",
+		Auth:           []ClientAuth{ClientAuthPassword(password("password"))},
+		HostKeyChecker: recorder,
+	}
+	if err := testKex(clientConfig, serverConfig); err != nil || recorder.algo != KeyAlgoECDSA256 {
+		t.Errorf("ECDSA only server: got %q, %v, want %s", recorder.algo, err, KeyAlgoECDSA256)
+	}
+
+	if _, err := NewCertSigner(hostCert, rsaKey); err == nil {
+		t.Errorf("NewCertSigner accepted a signer for a different key")
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import "encoding/binary"
+
+// This file implements the ChaCha20 stream cipher in its original
+// form, with a 64 bit nonce and a 64 bit block counter, as used by
+// chacha20-poly1305@openssh.com. See http://cr.yp.to/chacha.html.
+
+const chachaBlockSize = 64
+
+// chachaBlock computes the ChaCha20 keystream block for key, nonce and
+// counter.
+func chachaBlock(out *[chachaBlockSize]byte, key *[32]byte, nonce *[8]byte, counter uint64) {
+	var in [16]uint32
+	// "expand 32-byte k"
+	in[0], in[1], in[2], in[3] = 0x61707865, 0x3320646e, 0x79622d32, 0x6b206574
+	for i := 0; i < 8; i++ {
+		in[4+i] = binary.LittleEndian.Uint32(key[4*i:])
+	}
+	in[12] = uint32(counter)
+	in[13] = uint32(counter >> 32)
+	in[14] = binary.LittleEndian.Uint32(nonce[0:])
+	in[15] = binary.LittleEndian.Uint32(nonce[4:])
+
+	x := in
+	quarterRound := func(a, b, c, d int) {
+		x[a] += x[b]
+		x[d] ^= x[a]
+		x[d] = x[d]<<16 | x[d]>>16
+		x[c] += x[d]
+		x[b] ^= x[c]
+		x[b] = x[b]<<12 | x[b]>>20
+		x[a] += x[b]
+		x[d] ^= x[a]
+		x[d] = x[d]<<8 | x[d]>>24
+		x[c] += x[d]
+		x[b] ^= x[c]
+		x[b] = x[b]<<7 | x[b]>>25
+	}
+	for i := 0; i < 20; i += 2 {
+		quarterRound(0, 4, 8, 12)
+		quarterRound(1, 5, 9, 13)
+		quarterRound(2, 6, 10, 14)
+		quarterRound(3, 7, 11, 15)
+		quarterRound(0, 5, 10, 15)
+		quarterRound(1, 6, 11, 12)
+		quarterRound(2, 7, 8, 13)
+		quarterRound(3, 4, 9, 14)
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[4*i:], x[i]+in[i])
+	}
+}
+
+// chachaXORKeyStream sets dst to src XORed with the keystream for key
+// and nonce, starting at block counter. dst and src may overlap
+// entirely or not at all.
+func chachaXORKeyStream(dst, src []byte, key *[32]byte, nonce *[8]byte, counter uint64) {
+	var block [chachaBlockSize]byte
+	for len(src) > 0 {
+		chachaBlock(&block, key, nonce, counter)
+		counter++
+		n := len(src)
+		if n > chachaBlockSize {
+			n = chachaBlockSize
+		}
+		for i := 0; i < n; i++ {
+			dst[i] = src[i] ^ block[i]
+		}
+		src, dst = src[n:], dst[n:]
+	}
+}
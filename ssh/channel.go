@@ -152,10 +152,29 @@ type serverChan struct {
 	pendingData     []byte
 	head, length    int
 
+	// sentEnvironment is set once the environment of the
+	// connection's Permissions has been delivered as env requests.
+	sentEnvironment bool
+
+	// openResult receives the client's answer for channels opened
+	// by the server with OpenChannel.
+	openResult chan error
+
 	// This lock is inferior to serverConn.lock
 	cond *sync.Cond
 }
 
+// openDone delivers the outcome of a server initiated channel open to
+// OpenChannel. Only the first outcome is delivered; once it is, later
+// confirmations and failures for the channel are ignored.
+func (c *serverChan) openDone(err error) {
+	if c.openResult == nil {
+		return
+	}
+	c.openResult <- err
+	c.openResult = nil
+}
+
 func (c *serverChan) Accept() error {
 	c.serverConn.lock.Lock()
 	defer c.serverConn.lock.Unlock()
@@ -303,7 +322,7 @@ func (c *serverChan) read(data []byte) (n int, err error, windowAdjustment uint3
 	}
 
 	for {
-		if c.theySentEOF || c.theyClosed || c.dead() {
+		if c.dead() {
 			return 0, io.EOF, 0
 		}
 
@@ -333,11 +352,20 @@ func (c *serverChan) read(data []byte) (n int, err error, windowAdjustment uint3
 			if windowAdjustment < uint32(len(c.pendingData)/2) {
 				windowAdjustment = 0
 			}
+			if c.theySentEOF || c.theyClosed {
+				// The client sends no more data.
+				windowAdjustment = 0
+			}
 			c.myWindow += windowAdjustment
 
 			return
 		}
 
+		// Data that arrived before EOF is read first.
+		if c.theySentEOF || c.theyClosed {
+			return 0, io.EOF, 0
+		}
+
 		c.cond.Wait()
 	}
 
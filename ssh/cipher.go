@@ -8,12 +8,31 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rc4"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/massiveart/go.crypto/poly1305"
 )
 
 // streamDump is used to dump the initial keystream for stream ciphers. It is a
 // a write-only buffer, and not intended for reading so do not require a mutex.
 var streamDump [512]byte
 
+// packetCipher represents a combination of SSH encryption and MAC
+// protocol. A single instance should be used for one direction only.
+type packetCipher interface {
+	// writePacket encrypts packet and writes it to w. The contents
+	// of packet are scrambled in the process.
+	writePacket(seqNum uint32, w io.Writer, rand io.Reader, packet []byte) error
+
+	// readPacket reads and decrypts a packet from r and returns its
+	// payload.
+	readPacket(seqNum uint32, r io.Reader) ([]byte, error)
+}
+
 // noneCipher implements cipher.Stream and provides no encryption. It is used
 // by the transport before the first key-exchange.
 type noneCipher struct{}
@@ -35,42 +54,60 @@ func newRC4(key, iv []byte) (cipher.Stream, error) {
 }
 
 type cipherMode struct {
-	keySize    int
-	ivSize     int
-	skip       int
-	createFunc func(key, iv []byte) (cipher.Stream, error)
+	keySize int
+	ivSize  int
+
+	// aead is set for modes that authenticate packets themselves.
+	// No MAC is negotiated for them.
+	aead bool
+
+	create func(key, iv, macKey []byte, mac *macMode) (packetCipher, error)
 }
 
-func (c *cipherMode) createCipher(key, iv []byte) (cipher.Stream, error) {
+func (c *cipherMode) createCipher(key, iv, macKey []byte, mac *macMode) (packetCipher, error) {
 	if len(key) < c.keySize {
 		panic("ssh: key length too small for cipher")
 	}
 	if len(iv) < c.ivSize {
 		panic("ssh: iv too small for cipher")
 	}
+	return c.create(key[:c.keySize], iv[:c.ivSize], macKey, mac)
+}
 
-	stream, err := c.createFunc(key[:c.keySize], iv[:c.ivSize])
-	if err != nil {
-		return nil, err
-	}
+// streamCipherMode returns the constructor for a stream cipher used
+// with a separate MAC, discarding the first skip bytes of keystream.
+func streamCipherMode(skip int, createFunc func(key, iv []byte) (cipher.Stream, error)) func(key, iv, macKey []byte, mac *macMode) (packetCipher, error) {
+	return func(key, iv, macKey []byte, mac *macMode) (packetCipher, error) {
+		stream, err := createFunc(key, iv)
+		if err != nil {
+			return nil, err
+		}
 
-	for remainingToDump := c.skip; remainingToDump > 0; {
-		dumpThisTime := remainingToDump
-		if dumpThisTime > len(streamDump) {
-			dumpThisTime = len(streamDump)
+		for remainingToDump := skip; remainingToDump > 0; {
+			dumpThisTime := remainingToDump
+			if dumpThisTime > len(streamDump) {
+				dumpThisTime = len(streamDump)
+			}
+			stream.XORKeyStream(streamDump[:dumpThisTime], streamDump[:dumpThisTime])
+			remainingToDump -= dumpThisTime
 		}
-		stream.XORKeyStream(streamDump[:dumpThisTime], streamDump[:dumpThisTime])
-		remainingToDump -= dumpThisTime
-	}
 
-	return stream, nil
+		c := &streamPacketCipher{cipher: stream}
+		if mac != nil {
+			c.mac = mac.new(macKey)
+			c.etm = mac.etm
+		}
+		return c, nil
+	}
 }
 
 // Specifies a default set of ciphers and a preference order. This is based on
 // OpenSSH's default client preference order, minus algorithms that are not
-// implemented.
+// implemented. The AEAD modes come first as they are the fastest.
 var DefaultCipherOrder = []string{
+	gcmCipherID, chacha20Poly1305ID,
 	"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	gcm256CipherID,
 	"arcfour256", "arcfour128",
 }
 
@@ -80,21 +117,404 @@ var DefaultCipherOrder = []string{
 var cipherModes = map[string]*cipherMode{
 	// Ciphers from RFC4344, which introduced many CTR-based ciphers. Algorithms
 	// are defined in the order specified in the RFC.
-	"aes128-ctr": {16, aes.BlockSize, 0, newAESCTR},
-	"aes192-ctr": {24, aes.BlockSize, 0, newAESCTR},
-	"aes256-ctr": {32, aes.BlockSize, 0, newAESCTR},
+	"aes128-ctr": {16, aes.BlockSize, false, streamCipherMode(0, newAESCTR)},
+	"aes192-ctr": {24, aes.BlockSize, false, streamCipherMode(0, newAESCTR)},
+	"aes256-ctr": {32, aes.BlockSize, false, streamCipherMode(0, newAESCTR)},
 
 	// Ciphers from RFC4345, which introduces security-improved arcfour ciphers.
 	// They are defined in the order specified in the RFC.
-	"arcfour128": {16, 0, 1536, newRC4},
-	"arcfour256": {32, 0, 1536, newRC4},
+	"arcfour128": {16, 0, false, streamCipherMode(1536, newRC4)},
+	"arcfour256": {32, 0, false, streamCipherMode(1536, newRC4)},
+
+	// AES-GCM as specified in RFC 5647, with OpenSSH's names. OpenSSH
+	// does not use the MAC negotiation described in the RFC.
+	gcmCipherID:    {16, gcmIVSize, true, newGCMCipher},
+	gcm256CipherID: {32, gcmIVSize, true, newGCMCipher},
+
+	// chacha20-poly1305 is described in OpenSSH's
+	// PROTOCOL.chacha20poly1305. It takes two 256 bit keys.
+	chacha20Poly1305ID: {64, 0, true, newChaCha20Cipher},
 }
 
 // defaultKeyExchangeOrder specifies a default set of key exchange algorithms
 // with preferences.
 var defaultKeyExchangeOrder = []string{
+	kexAlgoCurve25519SHA256, kexAlgoCurve25519SHA256LibSSH,
 	// P384 and P521 are not constant-time yet, but since we don't
 	// reuse ephemeral keys, using them for ECDH should be OK.
 	kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
-	kexAlgoDH14SHA1, kexAlgoDH1SHA1,
+	kexAlgoDHGEXSHA256, kexAlgoDH14SHA1, kexAlgoDH1SHA1,
+}
+
+// streamPacketCipher is a stream cipher combined with a separate MAC,
+// as described in RFC 4253, section 6. With an encrypt-then-MAC mode
+// the length field is sent in the clear and the MAC covers the
+// ciphertext instead of the plaintext.
+type streamPacketCipher struct {
+	mac    hash.Hash
+	etm    bool
+	cipher cipher.Stream
+}
+
+// macPrefix starts the MAC computation of a packet with its sequence
+// number.
+func (s *streamPacketCipher) macPrefix(seqNum uint32) {
+	s.mac.Reset()
+	seqNumBytes := []byte{
+		byte(seqNum >> 24),
+		byte(seqNum >> 16),
+		byte(seqNum >> 8),
+		byte(seqNum),
+	}
+	s.mac.Write(seqNumBytes)
+}
+
+// readPacket reads and decrypts a single packet from the remote peer.
+func (s *streamPacketCipher) readPacket(seqNum uint32, r io.Reader) ([]byte, error) {
+	if s.etm {
+		return s.readETMPacket(seqNum, r)
+	}
+
+	var lengthBytes = make([]byte, 5)
+	var macSize uint32
+	if _, err := io.ReadFull(r, lengthBytes); err != nil {
+		return nil, err
+	}
+
+	s.cipher.XORKeyStream(lengthBytes, lengthBytes)
+
+	if s.mac != nil {
+		s.macPrefix(seqNum)
+		s.mac.Write(lengthBytes)
+		macSize = uint32(s.mac.Size())
+	}
+
+	length := binary.BigEndian.Uint32(lengthBytes[0:4])
+	paddingLength := uint32(lengthBytes[4])
+
+	if length <= paddingLength+1 {
+		return nil, errors.New("ssh: invalid packet length, packet too small")
+	}
+
+	if length > maxPacket {
+		return nil, errors.New("ssh: invalid packet length, packet too large")
+	}
+
+	packet := make([]byte, length-1+macSize)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+	mac := packet[length-1:]
+	s.cipher.XORKeyStream(packet, packet[:length-1])
+
+	if s.mac != nil {
+		s.mac.Write(packet[:length-1])
+		if subtle.ConstantTimeCompare(s.mac.Sum(nil), mac) != 1 {
+			return nil, errors.New("ssh: MAC failure")
+		}
+	}
+
+	return packet[:length-paddingLength-1], nil
+}
+
+// readETMPacket reads a packet sent with an encrypt-then-MAC mode. The
+// length is sent in the clear, and the MAC over the length and the
+// ciphertext is checked before anything is decrypted.
+func (s *streamPacketCipher) readETMPacket(seqNum uint32, r io.Reader) ([]byte, error) {
+	var lengthBytes = make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBytes); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(lengthBytes)
+	if length <= 1 {
+		return nil, errors.New("ssh: invalid packet length, packet too small")
+	}
+	if length > maxPacket {
+		return nil, errors.New("ssh: invalid packet length, packet too large")
+	}
+
+	macSize := uint32(s.mac.Size())
+	packet := make([]byte, length+macSize)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+
+	s.macPrefix(seqNum)
+	s.mac.Write(lengthBytes)
+	s.mac.Write(packet[:length])
+	if subtle.ConstantTimeCompare(s.mac.Sum(nil), packet[length:]) != 1 {
+		return nil, errors.New("ssh: MAC failure")
+	}
+
+	s.cipher.XORKeyStream(packet[:length], packet[:length])
+	paddingLength := uint32(packet[0])
+	if length <= paddingLength+1 {
+		return nil, errors.New("ssh: invalid packet length, packet too small")
+	}
+	return packet[1 : length-paddingLength], nil
+}
+
+// writePacket encrypts and sends a packet of data to the remote peer.
+func (s *streamPacketCipher) writePacket(seqNum uint32, w io.Writer, rand io.Reader, packet []byte) error {
+	// With encrypt-then-MAC the length field is not encrypted and
+	// so does not count towards the cipher's block size.
+	encLength := 5 + len(packet)
+	if s.etm {
+		encLength -= 4
+	}
+	paddingLength := packetSizeMultiple - encLength%packetSizeMultiple
+	if paddingLength < 4 {
+		paddingLength += packetSizeMultiple
+	}
+
+	length := len(packet) + 1 + paddingLength
+	lengthBytes := []byte{
+		byte(length >> 24),
+		byte(length >> 16),
+		byte(length >> 8),
+		byte(length),
+		byte(paddingLength),
+	}
+	padding := make([]byte, paddingLength)
+	_, err := io.ReadFull(rand, padding)
+	if err != nil {
+		return err
+	}
+
+	if s.mac != nil && !s.etm {
+		s.macPrefix(seqNum)
+		s.mac.Write(lengthBytes)
+		s.mac.Write(packet)
+		s.mac.Write(padding)
+	}
+
+	// TODO(dfc) lengthBytes, packet and padding should be
+	// subslices of a single buffer
+	if s.etm {
+		s.cipher.XORKeyStream(lengthBytes[4:], lengthBytes[4:])
+	} else {
+		s.cipher.XORKeyStream(lengthBytes, lengthBytes)
+	}
+	s.cipher.XORKeyStream(packet, packet)
+	s.cipher.XORKeyStream(padding, padding)
+
+	if s.etm {
+		s.macPrefix(seqNum)
+		s.mac.Write(lengthBytes)
+		s.mac.Write(packet)
+		s.mac.Write(padding)
+	}
+
+	if _, err := w.Write(lengthBytes); err != nil {
+		return err
+	}
+	if _, err := w.Write(packet); err != nil {
+		return err
+	}
+	if _, err := w.Write(padding); err != nil {
+		return err
+	}
+
+	if s.mac != nil {
+		if _, err := w.Write(s.mac.Sum(nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// aeadPadding returns the padding length for a packet of an AEAD mode,
+// whose length field is not encrypted with the rest of the packet.
+func aeadPadding(packetLen, blockSize int) int {
+	padding := blockSize - (1+packetLen)%blockSize
+	if padding < 4 {
+		padding += blockSize
+	}
+	return padding
+}
+
+// checkAEADLength checks the length field of an AEAD mode packet.
+func checkAEADLength(length uint32, blockSize int) error {
+	if length > maxPacket {
+		return errors.New("ssh: invalid packet length, packet too large")
+	}
+	if length < 5 || length%uint32(blockSize) != 0 {
+		return errors.New("ssh: invalid packet length")
+	}
+	return nil
+}
+
+// aeadPayload strips the padding from a decrypted AEAD mode packet.
+func aeadPayload(plain []byte) ([]byte, error) {
+	padding := int(plain[0])
+	if padding < 4 || padding >= len(plain) {
+		return nil, errors.New("ssh: invalid padding length")
+	}
+	return plain[1 : len(plain)-padding], nil
+}
+
+const (
+	gcmCipherID    = "aes128-gcm@openssh.com"
+	gcm256CipherID = "aes256-gcm@openssh.com"
+	gcmIVSize      = 12
+	gcmTagSize     = 16
+)
+
+// gcmCipher implements AES-GCM, RFC 5647. The packet length is sent
+// in the clear as additional data.
+type gcmCipher struct {
+	aead cipher.AEAD
+
+	// iv is a four byte fixed field followed by an eight byte
+	// invocation counter, incremented for every packet.
+	iv []byte
+}
+
+func newGCMCipher(key, iv, macKey []byte, mac *macMode) (packetCipher, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmCipher{aead: aead, iv: append([]byte(nil), iv...)}, nil
+}
+
+func (c *gcmCipher) incIV() {
+	for i := len(c.iv) - 1; i >= 4; i-- {
+		c.iv[i]++
+		if c.iv[i] != 0 {
+			break
+		}
+	}
+}
+
+func (c *gcmCipher) writePacket(seqNum uint32, w io.Writer, rand io.Reader, packet []byte) error {
+	padding := aeadPadding(len(packet), aes.BlockSize)
+	length := 1 + len(packet) + padding
+
+	var lengthBytes [4]byte
+	binary.BigEndian.PutUint32(lengthBytes[:], uint32(length))
+
+	buf := make([]byte, length, length+gcmTagSize)
+	buf[0] = byte(padding)
+	copy(buf[1:], packet)
+	if _, err := io.ReadFull(rand, buf[1+len(packet):]); err != nil {
+		return err
+	}
+	buf = c.aead.Seal(buf[:0], c.iv, buf, lengthBytes[:])
+	c.incIV()
+
+	if _, err := w.Write(lengthBytes[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func (c *gcmCipher) readPacket(seqNum uint32, r io.Reader) ([]byte, error) {
+	var lengthBytes [4]byte
+	if _, err := io.ReadFull(r, lengthBytes[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBytes[:])
+	if err := checkAEADLength(length, aes.BlockSize); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, length+gcmTagSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	plain, err := c.aead.Open(buf[:0], c.iv, buf, lengthBytes[:])
+	if err != nil {
+		return nil, errors.New("ssh: MAC failure")
+	}
+	c.incIV()
+	return aeadPayload(plain)
+}
+
+const chacha20Poly1305ID = "chacha20-poly1305@openssh.com"
+
+// chacha20Poly1305Cipher implements chacha20-poly1305@openssh.com.
+// The second half of the key encrypts the packet length and the first
+// half the packet itself; the sequence number serves as the nonce.
+type chacha20Poly1305Cipher struct {
+	lengthKey  [32]byte
+	contentKey [32]byte
+}
+
+func newChaCha20Cipher(key, iv, macKey []byte, mac *macMode) (packetCipher, error) {
+	c := new(chacha20Poly1305Cipher)
+	copy(c.contentKey[:], key[:32])
+	copy(c.lengthKey[:], key[32:])
+	return c, nil
+}
+
+// polyKey returns the one time poly1305 key for a packet, the first
+// 32 bytes of content keystream.
+func (c *chacha20Poly1305Cipher) polyKey(nonce *[8]byte) *[32]byte {
+	var polyKey [32]byte
+	chachaXORKeyStream(polyKey[:], polyKey[:], &c.contentKey, nonce, 0)
+	return &polyKey
+}
+
+func (c *chacha20Poly1305Cipher) writePacket(seqNum uint32, w io.Writer, rand io.Reader, packet []byte) error {
+	var nonce [8]byte
+	binary.BigEndian.PutUint64(nonce[:], uint64(seqNum))
+
+	padding := aeadPadding(len(packet), 8)
+	length := 1 + len(packet) + padding
+
+	buf := make([]byte, 4+length+poly1305.TagSize)
+	binary.BigEndian.PutUint32(buf, uint32(length))
+	buf[4] = byte(padding)
+	copy(buf[5:], packet)
+	if _, err := io.ReadFull(rand, buf[5+len(packet):4+length]); err != nil {
+		return err
+	}
+
+	chachaXORKeyStream(buf[:4], buf[:4], &c.lengthKey, &nonce, 0)
+	chachaXORKeyStream(buf[4:4+length], buf[4:4+length], &c.contentKey, &nonce, 1)
+
+	var tag [poly1305.TagSize]byte
+	poly1305.Sum(&tag, buf[:4+length], c.polyKey(&nonce))
+	copy(buf[4+length:], tag[:])
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func (c *chacha20Poly1305Cipher) readPacket(seqNum uint32, r io.Reader) ([]byte, error) {
+	var nonce [8]byte
+	binary.BigEndian.PutUint64(nonce[:], uint64(seqNum))
+
+	var encLength, lengthBytes [4]byte
+	if _, err := io.ReadFull(r, encLength[:]); err != nil {
+		return nil, err
+	}
+	chachaXORKeyStream(lengthBytes[:], encLength[:], &c.lengthKey, &nonce, 0)
+	length := binary.BigEndian.Uint32(lengthBytes[:])
+	if err := checkAEADLength(length, 8); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4+length+poly1305.TagSize)
+	copy(buf, encLength[:])
+	if _, err := io.ReadFull(r, buf[4:]); err != nil {
+		return nil, err
+	}
+
+	var tag [poly1305.TagSize]byte
+	copy(tag[:], buf[4+length:])
+	if !poly1305.Verify(&tag, buf[:4+length], c.polyKey(&nonce)) {
+		return nil, errors.New("ssh: MAC failure")
+	}
+
+	plain := buf[4 : 4+length]
+	chachaXORKeyStream(plain, plain, &c.contentKey, &nonce, 1)
+	return aeadPayload(plain)
 }
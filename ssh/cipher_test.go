@@ -6,50 +6,135 @@ package ssh
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"testing"
 )
 
-// TestCipherReversal tests that each cipher factory produces ciphers that can
-// encrypt and decrypt some data successfully.
-func TestCipherReversal(t *testing.T) {
-	testData := []byte("abcdefghijklmnopqrstuvwxyz012345")
-	testKey := []byte("AbCdEfGhIjKlMnOpQrStUvWxYz012345")
+// TestPacketCiphers tests that each combination of cipher and MAC
+// produces packet ciphers that can encrypt, authenticate and decrypt
+// packets.
+func TestPacketCiphers(t *testing.T) {
+	for cipherName, cipherMode := range cipherModes {
+		for macName := range macModes {
+			testPacketCipher(t, cipherName, macName, cipherMode, macModes[macName])
+			if cipherMode.aead {
+				// The MAC is not used.
+				break
+			}
+		}
+	}
+}
+
+func testPacketCipher(t *testing.T, cipherName, macName string, cipherMode *cipherMode, macMode *macMode) {
+	testKey := []byte("AbCdEfGhIjKlMnOpQrStUvWxYz012345AbCdEfGhIjKlMnOpQrStUvWxYz012345")
 	testIv := []byte("sdflkjhsadflkjhasdflkjhsadfklhsa")
+	macKey := []byte("0123456789abcdefghijklmnopqrstuvwxyz0123456789abcdefghijklmnopqr")[:macMode.keySize]
+	name := cipherName + "/" + macName
 
-	cryptBuffer := make([]byte, 32)
+	encrypter, err := cipherMode.createCipher(testKey, testIv, macKey, macMode)
+	if err != nil {
+		t.Errorf("failed to create encrypter for %q: %s", name, err)
+		return
+	}
+	decrypter, err := cipherMode.createCipher(testKey, testIv, macKey, macMode)
+	if err != nil {
+		t.Errorf("failed to create decrypter for %q: %s", name, err)
+		return
+	}
 
-	for name, cipherMode := range cipherModes {
-		encrypter, err := cipherMode.createCipher(testKey, testIv)
-		if err != nil {
-			t.Errorf("failed to create encrypter for %q: %s", name, err)
-			continue
+	for seqNum, size := range []int{1, 16, 33, 1000} {
+		want := bytes.Repeat([]byte{byte(size)}, size)
+		packet := append([]byte(nil), want...)
+		var buf bytes.Buffer
+		if err := encrypter.writePacket(uint32(seqNum), &buf, rand.Reader, packet); err != nil {
+			t.Fatalf("%q: writePacket: %v", name, err)
+		}
+		if bytes.Contains(buf.Bytes(), want) && size > 1 {
+			t.Errorf("%q: packet was not encrypted", name)
 		}
-		decrypter, err := cipherMode.createCipher(testKey, testIv)
+		got, err := decrypter.readPacket(uint32(seqNum), &buf)
 		if err != nil {
-			t.Errorf("failed to create decrypter for %q: %s", name, err)
-			continue
+			t.Fatalf("%q: readPacket: %v", name, err)
 		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%q: got %x, want %x", name, got, want)
+		}
+	}
 
-		copy(cryptBuffer, testData)
+	// A corrupted packet must be rejected.
+	var buf bytes.Buffer
+	if err := encrypter.writePacket(4, &buf, rand.Reader, []byte("hello world")); err != nil {
+		t.Fatalf("%q: writePacket: %v", name, err)
+	}
+	corrupt := buf.Bytes()
+	corrupt[len(corrupt)-1] ^= 1
+	if _, err := decrypter.readPacket(4, &buf); err == nil {
+		t.Errorf("%q: corrupted packet was accepted", name)
+	}
+}
 
-		encrypter.XORKeyStream(cryptBuffer, cryptBuffer)
-		if name == "none" {
-			if !bytes.Equal(cryptBuffer, testData) {
-				t.Errorf("encryption made change with 'none' cipher")
-				continue
-			}
-		} else {
-			if bytes.Equal(cryptBuffer, testData) {
-				t.Errorf("encryption made no change with %q", name)
-				continue
-			}
-		}
+func TestEncryptThenMACLength(t *testing.T) {
+	mode := cipherModes["aes128-ctr"]
+	mac := macModes["hmac-sha2-256-etm@openssh.com"]
+	key := make([]byte, 32)
+	c, err := mode.createCipher(key, key, key, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := c.writePacket(0, &buf, rand.Reader, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// The length is sent in the clear, and the encrypted part is a
+	// multiple of the block size.
+	length := binary.BigEndian.Uint32(buf.Bytes())
+	if int(length)+4+mac.keySize != buf.Len() || length%packetSizeMultiple != 0 {
+		t.Errorf("got length field %d for a %d byte packet", length, buf.Len())
+	}
+}
 
-		decrypter.XORKeyStream(cryptBuffer, cryptBuffer)
-		if !bytes.Equal(cryptBuffer, testData) {
-			t.Errorf("decrypted bytes not equal to input with %q", name)
-			continue
-		}
+func TestEncryptThenMACBeforeDecrypt(t *testing.T) {
+	mode := cipherModes["aes128-ctr"]
+	mac := macModes["hmac-sha2-256-etm@openssh.com"]
+	key := make([]byte, 32)
+	encrypter, err := mode.createCipher(key, key, key, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypter, err := mode.createCipher(key, key, key, mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := encrypter.writePacket(0, &buf, rand.Reader, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// A modified padding length must not be noticed before the MAC
+	// is checked.
+	buf.Bytes()[4] ^= 0xff
+	if _, err := decrypter.readPacket(0, &buf); err == nil || err.Error() != "ssh: MAC failure" {
+		t.Errorf("got error %v, want MAC failure", err)
+	}
+}
+
+// Test vectors from RFC 7539, section A.1, which match the original
+// ChaCha20 for a zero nonce.
+func TestChaChaKeyStream(t *testing.T) {
+	var key [32]byte
+	var nonce [8]byte
+	want, _ := hex.DecodeString("76b8e0ada0f13d90405d6ae55386bd28bdd219b8a08ded1aa836efcc8b770dc7da41597c5157488d7724e03fb8d84a376a43b8f41518a11cc387b669b2ee6586" +
+		"9f07e7be5551387a98ba977c732d080dcb0f29a048e3656912c6533e32ee7aed29b721769ce64e43d57133b074d839d531ed1f28510afb45ace10a1f4b794d6f")
+	got := make([]byte, len(want))
+	chachaXORKeyStream(got, got, &key, &nonce, 0)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got keystream %x, want %x", got, want)
+	}
+	// Starting at block one yields the second block.
+	chachaXORKeyStream(got[:64], make([]byte, 64), &key, &nonce, 1)
+	if !bytes.Equal(got[:64], want[64:]) {
+		t.Errorf("got second block %x, want %x", got[:64], want[64:])
 	}
 }
 
@@ -60,3 +145,26 @@ func TestDefaultCiphersExist(t *testing.T) {
 		}
 	}
 }
+
+func TestCipherHandshakes(t *testing.T) {
+	for name := range cipherModes {
+		crypto := CryptoConfig{Ciphers: []string{name}}
+		serverConfig := &ServerConfig{
+			PasswordCallback: func(conn *ServerConn, user, password string) bool {
+				return password == "password"
+			},
+			Crypto: crypto,
+		}
+		if err := serverConfig.SetRSAPrivateKey([]byte(testServerPrivateKey)); err != nil {
+			t.Fatalf("SetRSAPrivateKey: %v", err)
+		}
+		clientConfig := &ClientConfig{
+			User:   "user",
+			Auth:   []ClientAuth{ClientAuthPassword(password("password"))},
+			Crypto: crypto,
+		}
+		if err := testKex(clientConfig, serverConfig); err != nil {
+			t.Errorf("cipher %s: %v", name, err)
+		}
+	}
+}
@@ -5,6 +5,7 @@
 package ssh
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -15,6 +16,7 @@ import (
 	"io"
 	"math/big"
 	"net"
+	"strconv"
 	"sync"
 )
 
@@ -32,7 +34,25 @@ type ClientConn struct {
 	// Address as passed to the Dial function.
 	dialAddress string
 
+	clientVersion []byte
 	serverVersion string
+
+	// hostKey and sessionId are set by the initial key exchange.
+	hostKey   []byte
+	sessionId []byte
+
+	// agentServe, if set, serves forwarded agent channels. It is
+	// protected by agentMu.
+	agentMu    sync.Mutex
+	agentServe func(io.ReadWriter) error
+
+	// x11, if set, holds the X11 forwarding setup, and x11Sessions
+	// the sessions on which X11 forwarding was requested, mapped to
+	// whether they asked for a single connection. Both are protected
+	// by x11Mu.
+	x11Mu       sync.Mutex
+	x11         *x11Forward
+	x11Sessions map[*Session]bool
 }
 
 type globalRequest struct {
@@ -47,7 +67,7 @@ func Client(c net.Conn, config *ClientConfig) (*ClientConn, error) {
 
 func clientWithAddress(c net.Conn, addr string, config *ClientConfig) (*ClientConn, error) {
 	conn := &ClientConn{
-		transport:     newTransport(c, config.rand()),
+		transport:     newTransport(c, config.rand(), &config.Crypto),
 		config:        config,
 		globalRequest: globalRequest{response: make(chan interface{}, 1)},
 		dialAddress:   addr,
@@ -63,15 +83,13 @@ func clientWithAddress(c net.Conn, addr string, config *ClientConfig) (*ClientCo
 
 // handshake performs the client side key exchange. See RFC 4253 Section 7.
 func (c *ClientConn) handshake() error {
-	var magics handshakeMagics
-
 	var version []byte
 	if len(c.config.ClientVersion) > 0 {
 		version = []byte(c.config.ClientVersion)
 	} else {
 		version = clientVersion
 	}
-	magics.clientVersion = version
+	c.clientVersion = version
 	version = append(version, '\r', '\n')
 	if _, err := c.Write(version); err != nil {
 		return err
@@ -85,34 +103,62 @@ func (c *ClientConn) handshake() error {
 	if err != nil {
 		return err
 	}
-	magics.serverVersion = version
 	c.serverVersion = string(version)
+
+	c.transport.kexInit = c.kexInitPacket
+	kexInitPacket, err := c.sendKexInit()
+	if err != nil {
+		return err
+	}
+	packet, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if err := c.keyExchange(kexInitPacket, packet); err != nil {
+		return err
+	}
+	c.transport.kex = c.keyExchange
+	return c.authenticate(c.sessionId)
+}
+
+// kexInitPacket returns the client's KEXINIT message.
+func (c *ClientConn) kexInitPacket() []byte {
 	clientKexInit := kexInitMsg{
 		KexAlgos:                c.config.Crypto.kexes(),
-		ServerHostKeyAlgos:      supportedHostKeyAlgos,
+		ServerHostKeyAlgos:      c.config.hostKeyAlgos(),
 		CiphersClientServer:     c.config.Crypto.ciphers(),
 		CiphersServerClient:     c.config.Crypto.ciphers(),
 		MACsClientServer:        c.config.Crypto.macs(),
 		MACsServerClient:        c.config.Crypto.macs(),
-		CompressionClientServer: supportedCompressions,
-		CompressionServerClient: supportedCompressions,
+		CompressionClientServer: c.config.Crypto.compressions(),
+		CompressionServerClient: c.config.Crypto.compressions(),
+	}
+	// Ask for the server-sig-algs extension, which is only sent
+	// after the initial key exchange. See RFC 8308, section 2.1.
+	if c.sessionId == nil {
+		kexes := append([]string(nil), clientKexInit.KexAlgos...)
+		clientKexInit.KexAlgos = append(kexes, extInfoClient)
 	}
-	kexInitPacket := marshal(msgKexInit, clientKexInit)
-	magics.clientKexInit = kexInitPacket
+	return marshal(msgKexInit, clientKexInit)
+}
 
-	if err := c.writePacket(kexInitPacket); err != nil {
+// keyExchange runs a key exchange, for the initial handshake or a
+// later key change, given the client's and the server's KEXINIT
+// messages.
+func (c *ClientConn) keyExchange(clientKexInitPacket, serverKexInitPacket []byte) error {
+	var clientKexInit, serverKexInit kexInitMsg
+	if err := unmarshal(&clientKexInit, clientKexInitPacket, msgKexInit); err != nil {
 		return err
 	}
-	packet, err := c.readPacket()
-	if err != nil {
+	if err := unmarshal(&serverKexInit, serverKexInitPacket, msgKexInit); err != nil {
 		return err
 	}
 
-	magics.serverKexInit = packet
-
-	var serverKexInit kexInitMsg
-	if err = unmarshal(&serverKexInit, packet, msgKexInit); err != nil {
-		return err
+	magics := handshakeMagics{
+		clientVersion: c.clientVersion,
+		serverVersion: []byte(c.serverVersion),
+		clientKexInit: clientKexInitPacket,
+		serverKexInit: serverKexInitPacket,
 	}
 
 	kexAlgo, hostKeyAlgo, ok := findAgreedAlgorithms(c.transport, &clientKexInit, &serverKexInit)
@@ -129,13 +175,18 @@ func (c *ClientConn) handshake() error {
 	}
 
 	var result *kexResult
+	var err error
 	switch kexAlgo {
+	case kexAlgoCurve25519SHA256, kexAlgoCurve25519SHA256LibSSH:
+		result, err = c.kexCurve25519(&magics, hostKeyAlgo)
 	case kexAlgoECDH256:
 		result, err = c.kexECDH(elliptic.P256(), &magics, hostKeyAlgo)
 	case kexAlgoECDH384:
 		result, err = c.kexECDH(elliptic.P384(), &magics, hostKeyAlgo)
 	case kexAlgoECDH521:
 		result, err = c.kexECDH(elliptic.P521(), &magics, hostKeyAlgo)
+	case kexAlgoDHGEXSHA256:
+		result, err = c.kexDHGroupExchange(crypto.SHA256, &magics, hostKeyAlgo)
 	case kexAlgoDH14SHA1:
 		dhGroup14Once.Do(initDHGroup14)
 		result, err = c.kexDH(crypto.SHA1, dhGroup14, &magics, hostKeyAlgo)
@@ -154,29 +205,40 @@ func (c *ClientConn) handshake() error {
 		return err
 	}
 
-	if checker := c.config.HostKeyChecker; checker != nil {
-		err = checker.Check(c.dialAddress, c.RemoteAddr(), hostKeyAlgo, result.HostKey)
-		if err != nil {
-			return err
+	if c.sessionId == nil {
+		if checker := c.config.HostKeyChecker; checker != nil {
+			keyAlgo, _ := splitSigAlgo(hostKeyAlgo)
+			err = checker.Check(c.dialAddress, c.RemoteAddr(), keyAlgo, result.HostKey)
+			if err != nil {
+				return err
+			}
 		}
+		c.hostKey = result.HostKey
+		// The session ID is the exchange hash of the initial key
+		// exchange and does not change on later ones.
+		c.sessionId = result.H
+	} else if !bytes.Equal(result.HostKey, c.hostKey) {
+		return errors.New("ssh: host key changed during key exchange")
 	}
 
-	if err = c.writePacket([]byte{msgNewKeys}); err != nil {
-		return err
-	}
-	if err = c.transport.writer.setupKeys(clientKeys, result.K, result.H, result.H, result.Hash); err != nil {
+	if err = c.transport.writer.sendNewKeys(clientKeys, result.K, result.H, c.sessionId, result.Hash); err != nil {
 		return err
 	}
-	if packet, err = c.readPacket(); err != nil {
+	packet, err := c.readPacket()
+	if err != nil {
 		return err
 	}
 	if packet[0] != msgNewKeys {
 		return UnexpectedMessageError{msgNewKeys, packet[0]}
 	}
-	if err := c.transport.reader.setupKeys(serverKeys, result.K, result.H, result.H, result.Hash); err != nil {
-		return err
-	}
-	return c.authenticate(result.H)
+	return c.transport.reader.setupKeys(serverKeys, result.K, result.H, c.sessionId, result.Hash)
+}
+
+// RequestKeyChange starts a new key exchange with the server, unless
+// one is already in progress, and waits until the new keys are used
+// for sending. Channels may be used while it runs.
+func (c *ClientConn) RequestKeyChange() error {
+	return c.transport.requestKeyChange()
 }
 
 // kexECDH performs Elliptic Curve Diffie-Hellman key exchange as
@@ -239,22 +301,78 @@ func (c *ClientConn) kexECDH(curve elliptic.Curve, magics *handshakeMagics, host
 	}, nil
 }
 
+// kexCurve25519 performs curve25519-sha256 key agreement. It reuses
+// the ECDH messages, with the raw 32 byte public values as the
+// ephemeral keys.
+func (c *ClientConn) kexCurve25519(magics *handshakeMagics, hostKeyAlgo string) (*kexResult, error) {
+	var kp curve25519KeyPair
+	if err := kp.generate(c.config.rand()); err != nil {
+		return nil, err
+	}
+
+	kexInit := kexECDHInitMsg{
+		ClientPubKey: kp.pub[:],
+	}
+	if err := c.writePacket(marshal(msgKexECDHInit, kexInit)); err != nil {
+		return nil, err
+	}
+
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	var reply kexECDHReplyMsg
+	if err = unmarshal(&reply, packet, msgKexECDHReply); err != nil {
+		return nil, err
+	}
+
+	K, err := kp.sharedSecret(reply.EphemeralPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	h := crypto.SHA256.New()
+	writeString(h, magics.clientVersion)
+	writeString(h, magics.serverVersion)
+	writeString(h, magics.clientKexInit)
+	writeString(h, magics.serverKexInit)
+	writeString(h, reply.HostKey)
+	writeString(h, kexInit.ClientPubKey)
+	writeString(h, reply.EphemeralPubKey)
+	h.Write(K)
+
+	return &kexResult{
+		H:         h.Sum(nil),
+		K:         K,
+		HostKey:   reply.HostKey,
+		Signature: reply.Signature,
+		Hash:      crypto.SHA256,
+	}, nil
+}
+
 // Verify the host key obtained in the key exchange.
 func verifyHostKeySignature(hostKeyAlgo string, hostKeyBytes []byte, data []byte, signature []byte) error {
 	hostKey, rest, ok := ParsePublicKey(hostKeyBytes)
 	if len(rest) > 0 || !ok {
 		return errors.New("ssh: could not parse hostkey")
 	}
+	keyAlgo, sigAlgo := splitSigAlgo(hostKeyAlgo)
+	if hostKey.PublicKeyAlgo() != keyAlgo {
+		return fmt.Errorf("ssh: got %s host key, want %s", hostKey.PublicKeyAlgo(), keyAlgo)
+	}
 
 	sig, rest, ok := parseSignatureBody(signature)
 	if len(rest) > 0 || !ok {
 		return errors.New("ssh: signature parse error")
 	}
-	if sig.Format != hostKeyAlgo {
+	// Certificates are signed for with their key's algorithm, and
+	// rsa-sha2-* names the signature algorithm of an RSA key.
+	if sig.Format != sigAlgo {
 		return fmt.Errorf("ssh: unexpected signature type %q", sig.Format)
 	}
 
-	if !hostKey.Verify(data, sig.Blob) {
+	if !verifySignature(hostKey, data, sig) {
 		return errors.New("ssh: host key signature error")
 	}
 	return nil
@@ -328,6 +446,84 @@ func (c *ClientConn) kexDH(hashFunc crypto.Hash, group *dhGroup, magics *handsha
 	}, nil
 }
 
+// kexDHGroupExchange performs Diffie-Hellman key agreement with a
+// group chosen by the server, as described in RFC 4419.
+func (c *ClientConn) kexDHGroupExchange(hashFunc crypto.Hash, magics *handshakeMagics, hostKeyAlgo string) (*kexResult, error) {
+	min, preferred, max := c.config.groupExchangeBits()
+	if min > preferred || preferred > max {
+		return nil, fmt.Errorf("ssh: invalid group exchange sizes %d/%d/%d", min, preferred, max)
+	}
+	request := kexDHGexRequestMsg{
+		MinBits:       uint32(min),
+		PreferredBits: uint32(preferred),
+		MaxBits:       uint32(max),
+	}
+	if err := c.writePacket(marshal(msgKexDHGexRequest, request)); err != nil {
+		return nil, err
+	}
+
+	packet, err := c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	var groupMsg kexDHGexGroupMsg
+	if err = unmarshal(&groupMsg, packet, msgKexDHGexGroup); err != nil {
+		return nil, err
+	}
+	if err := checkGroupExchangeGroup(groupMsg.G, groupMsg.P, min, max); err != nil {
+		return nil, err
+	}
+	group := &dhGroup{g: groupMsg.G, p: groupMsg.P}
+
+	x, err := groupExchangeExponent(c.config.rand(), group.p)
+	if err != nil {
+		return nil, err
+	}
+	X := new(big.Int).Exp(group.g, x, group.p)
+	if err := c.writePacket(marshal(msgKexDHGexInit, kexDHGexInitMsg{X: X})); err != nil {
+		return nil, err
+	}
+
+	packet, err = c.readPacket()
+	if err != nil {
+		return nil, err
+	}
+	var reply kexDHGexReplyMsg
+	if err = unmarshal(&reply, packet, msgKexDHGexReply); err != nil {
+		return nil, err
+	}
+
+	kInt, err := group.diffieHellman(reply.Y, x)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hashFunc.New()
+	writeString(h, magics.clientVersion)
+	writeString(h, magics.serverVersion)
+	writeString(h, magics.clientKexInit)
+	writeString(h, magics.serverKexInit)
+	writeString(h, reply.HostKey)
+	h.Write(appendU32(nil, request.MinBits))
+	h.Write(appendU32(nil, request.PreferredBits))
+	h.Write(appendU32(nil, request.MaxBits))
+	writeInt(h, group.p)
+	writeInt(h, group.g)
+	writeInt(h, X)
+	writeInt(h, reply.Y)
+	K := make([]byte, intLength(kInt))
+	marshalInt(K, kInt)
+	h.Write(K)
+
+	return &kexResult{
+		H:         h.Sum(nil),
+		K:         K,
+		HostKey:   reply.HostKey,
+		Signature: reply.Signature,
+		Hash:      hashFunc,
+	}, nil
+}
+
 // mainLoop reads incoming messages and routes channel messages
 // to their respective ClientChans.
 func (c *ClientConn) mainLoop() {
@@ -487,7 +683,7 @@ func (c *ClientConn) handleChanOpen(msg *channelOpenMsg) {
 			return
 		}
 
-		l, ok := c.forwardList.lookup(*laddr)
+		l, ok := c.forwardList.lookup(laddr)
 		if !ok {
 			// TODO: print on a more structured log.
 			fmt.Println("could not find forward list entry for", laddr)
@@ -502,22 +698,14 @@ func (c *ClientConn) handleChanOpen(msg *channelOpenMsg) {
 			c.sendConnectionFailed(msg.PeersId)
 			return
 		}
-		ch := c.newChan(c.transport)
-		ch.remoteId = msg.PeersId
-		ch.remoteWin.add(msg.PeersWindow)
-		ch.maxPacket = msg.MaxPacketSize
-
-		m := channelOpenConfirmMsg{
-			PeersId:  ch.remoteId,
-			MyId:     ch.localId,
-			MyWindow: 1 << 14,
-
-			// As per RFC 4253 6.1, 32k is also the minimum.
-			MaxPacketSize: 1 << 15,
-		}
-
-		c.writePacket(marshal(msgChannelOpenConfirm, m))
+		ch := c.acceptChan(msg)
 		l <- forward{ch, raddr}
+	case agentChannelType:
+		c.handleAgentChanOpen(msg)
+	case x11ChannelType:
+		c.handleX11ChanOpen(msg)
+	case forwardedStreamLocalChannelType:
+		c.handleStreamLocalChanOpen(msg)
 	default:
 		// unknown channel type
 		m := channelOpenFailureMsg{
@@ -530,6 +718,26 @@ func (c *ClientConn) handleChanOpen(msg *channelOpenMsg) {
 	}
 }
 
+// acceptChan confirms the channel opened by the server with msg.
+func (c *ClientConn) acceptChan(msg *channelOpenMsg) *clientChan {
+	ch := c.newChan(c.transport)
+	ch.remoteId = msg.PeersId
+	ch.remoteWin.add(msg.PeersWindow)
+	ch.maxPacket = msg.MaxPacketSize
+
+	m := channelOpenConfirmMsg{
+		PeersId:  ch.remoteId,
+		MyId:     ch.localId,
+		MyWindow: 1 << 14,
+
+		// As per RFC 4253 6.1, 32k is also the minimum.
+		MaxPacketSize: 1 << 15,
+	}
+
+	c.writePacket(marshal(msgChannelOpenConfirm, m))
+	return ch
+}
+
 // sendGlobalRequest sends a global request message as specified
 // in RFC4254 section 4. To correctly synchronise messages, a lock
 // is held internally until a response is returned.
@@ -587,6 +795,36 @@ func Dial(network, addr string, config *ClientConfig) (*ClientConn, error) {
 	return clientWithAddress(conn, addr, config)
 }
 
+// DialClient connects to addr from the remote host of c and initiates a
+// SSH handshake over the forwarded connection, as OpenSSH's ProxyJump
+// does. config applies to the new connection; its HostKeyChecker is
+// given addr, which is resolved by the remote host. Calling DialClient
+// on the result reaches further hops. When c is closed or fails, the
+// connections that were dialed through it fail as well.
+func (c *ClientConn) DialClient(addr string, config *ClientConfig) (*ClientConn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	// Dialing IP addresses with DialTCP lets the connection report
+	// the address of the next hop; host names are left to the remote
+	// host to resolve.
+	var conn net.Conn
+	if ip := net.ParseIP(host); ip != nil {
+		conn, err = c.DialTCP("tcp", nil, &net.TCPAddr{IP: ip, Port: int(port)})
+	} else {
+		conn, err = c.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return clientWithAddress(conn, addr, config)
+}
+
 // A ClientConfig structure is used to configure a ClientConn. After one has
 // been passed to an SSH function it must not be modified.
 type ClientConfig struct {
@@ -607,12 +845,27 @@ type ClientConfig struct {
 	// implies that all host keys are accepted.
 	HostKeyChecker HostKeyChecker
 
+	// HostKeyAlgorithms lists the host key algorithms the client
+	// accepts, in order of preference. If empty, RSA keys are
+	// preferred, so that servers present the same host key as to
+	// earlier versions, which only supported ssh-rsa. Servers without
+	// one are accepted with certificates, Ed25519, ECDSA or DSA keys.
+	HostKeyAlgorithms []string
+
 	// Cryptographic-related configuration.
 	Crypto CryptoConfig
 
 	// The identification string that will be used for the connection.
 	// If empty, a reasonable default is used.
 	ClientVersion string
+
+	// GroupExchangeMinBits, GroupExchangePreferredBits and
+	// GroupExchangeMaxBits are the modulus sizes requested in a
+	// diffie-hellman-group-exchange-sha256 key exchange. Zero values
+	// select 2048, 3072 and 8192 bits respectively.
+	GroupExchangeMinBits       int
+	GroupExchangePreferredBits int
+	GroupExchangeMaxBits       int
 }
 
 func (c *ClientConfig) rand() io.Reader {
@@ -622,6 +875,27 @@ func (c *ClientConfig) rand() io.Reader {
 	return c.Rand
 }
 
+func (c *ClientConfig) hostKeyAlgos() []string {
+	if len(c.HostKeyAlgorithms) == 0 {
+		return supportedHostKeyAlgos
+	}
+	return c.HostKeyAlgorithms
+}
+
+func (c *ClientConfig) groupExchangeBits() (min, preferred, max int) {
+	min, preferred, max = c.GroupExchangeMinBits, c.GroupExchangePreferredBits, c.GroupExchangeMaxBits
+	if min == 0 {
+		min = defaultGroupExchangeMin
+	}
+	if preferred == 0 {
+		preferred = defaultGroupExchangePreferred
+	}
+	if max == 0 {
+		max = defaultGroupExchangeMax
+	}
+	return
+}
+
 // Thread safe channel list.
 type chanList struct {
 	// protects concurrent access to chans
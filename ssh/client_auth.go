@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 )
 
 // authenticate authenticates with the remote server. See RFC 4252.
@@ -35,6 +36,7 @@ func (c *ClientConn) authenticate(session []byte) error {
 		}
 		if ok {
 			// success
+			c.transport.startDelayedCompression()
 			return nil
 		}
 		tried[auth.method()] = true
@@ -163,11 +165,59 @@ type ClientKeyring interface {
 	Sign(i int, rand io.Reader, data []byte) (sig []byte, err error)
 }
 
+// AlgorithmClientKeyring is a ClientKeyring that can also sign with
+// a signature algorithm other than the default for a key. It lets
+// RSA keys be used with rsa-sha2-256 and rsa-sha2-512 when the server
+// announces them in the server-sig-algs extension.
+type AlgorithmClientKeyring interface {
+	ClientKeyring
+
+	// SignWithAlgorithm is like Sign, but uses the given signature
+	// algorithm, such as rsa-sha2-256.
+	SignWithAlgorithm(i int, rand io.Reader, data []byte, algorithm string) (sig []byte, err error)
+}
+
 // "publickey" authentication, RFC 4252 Section 7.
 type publickeyAuth struct {
 	ClientKeyring
 }
 
+// algorithm returns the public key algorithm name to authenticate
+// with key, and the signature algorithm it implies. For RSA keys the
+// strongest hash that the server accepts according to its
+// server-sig-algs extension is used, see RFC 8332, section 3.3.
+func (p *publickeyAuth) algorithm(key PublicKey, t *transport) (algoname, sigAlgo string) {
+	algoname = key.PublicKeyAlgo()
+	if _, ok := p.ClientKeyring.(AlgorithmClientKeyring); !ok {
+		return splitSigAlgo(algoname)
+	}
+	serverSigAlgs := strings.Split(t.extensions[extServerSigAlgs], ",")
+	for _, sigAlgo := range []string{SigAlgoRSASHA2512, SigAlgoRSASHA2256} {
+		if !contains(serverSigAlgs, sigAlgo) {
+			continue
+		}
+		switch algoname {
+		case KeyAlgoRSA:
+			return sigAlgo, sigAlgo
+		case CertAlgoRSAv01:
+			if sigAlgo == SigAlgoRSASHA2512 {
+				return CertSigAlgoRSASHA2512v01, sigAlgo
+			}
+			return CertSigAlgoRSASHA2256v01, sigAlgo
+		}
+	}
+	_, sigAlgo = splitSigAlgo(algoname)
+	return algoname, sigAlgo
+}
+
+// sign signs data with the i'th key using sigAlgo.
+func (p *publickeyAuth) sign(i int, key PublicKey, rand io.Reader, data []byte, sigAlgo string) ([]byte, error) {
+	if sigAlgo == key.PrivateKeyAlgo() {
+		return p.Sign(i, rand, data)
+	}
+	return p.ClientKeyring.(AlgorithmClientKeyring).SignWithAlgorithm(i, rand, data, sigAlgo)
+}
+
 type publickeyAuthMsg struct {
 	User    string
 	Service string
@@ -214,17 +264,18 @@ func (p *publickeyAuth) auth(session []byte, user string, t *transport, rand io.
 	var methods []string
 	for i, key := range validKeys {
 		pubkey := MarshalPublicKey(key)
-		algoname := key.PublicKeyAlgo()
-		sign, err := p.Sign(i, rand, buildDataSignedForAuth(session, userAuthRequestMsg{
+		algoname, sigAlgo := p.algorithm(key, t)
+		sign, err := p.sign(i, key, rand, buildDataSignedForAuth(session, userAuthRequestMsg{
 			User:    user,
 			Service: serviceSSH,
 			Method:  p.method(),
-		}, []byte(algoname), pubkey))
+		}, []byte(algoname), pubkey), sigAlgo)
 		if err != nil {
 			return false, nil, err
 		}
 		// manually wrap the serialized signature in a string
-		s := serializeSignature(key.PublicKeyAlgo(), sign)
+		// For certificates, the signature is made by the underlying key.
+		s := serializeSignature(sigAlgo, sign)
 		sig := make([]byte, stringLength(len(s)))
 		marshalString(sig, s)
 		msg := publickeyAuthMsg{
@@ -254,7 +305,7 @@ func (p *publickeyAuth) auth(session []byte, user string, t *transport, rand io.
 // validateKey validates the key provided it is acceptable to the server.
 func (p *publickeyAuth) validateKey(key PublicKey, user string, t *transport) (bool, error) {
 	pubkey := MarshalPublicKey(key)
-	algoname := key.PublicKeyAlgo()
+	algoname, _ := p.algorithm(key, t)
 	msg := publickeyAuthMsg{
 		User:     user,
 		Service:  serviceSSH,
@@ -267,12 +318,11 @@ func (p *publickeyAuth) validateKey(key PublicKey, user string, t *transport) (b
 		return false, err
 	}
 
-	return p.confirmKeyAck(key, t)
+	return p.confirmKeyAck(key, algoname, t)
 }
 
-func (p *publickeyAuth) confirmKeyAck(key PublicKey, t *transport) (bool, error) {
+func (p *publickeyAuth) confirmKeyAck(key PublicKey, algoname string, t *transport) (bool, error) {
 	pubkey := MarshalPublicKey(key)
-	algoname := key.PublicKeyAlgo()
 
 	for {
 		packet, err := t.readPacket()
@@ -345,7 +395,7 @@ func ClientAuthAgent(agent *AgentClient) ClientAuth {
 	return ClientAuthKeyring(&agentKeyring{agent: agent})
 }
 
-// agentKeyring implements ClientKeyring.
+// agentKeyring implements AlgorithmClientKeyring.
 type agentKeyring struct {
 	agent *AgentClient
 	keys  []*AgentKey
@@ -371,7 +421,18 @@ func (kr *agentKeyring) Sign(i int, rand io.Reader, data []byte) (sig []byte, er
 	if key == nil {
 		return nil, errors.New("ssh: key index out of range")
 	}
-	if sig, err = kr.agent.SignRequest(key, data); err != nil {
+	return kr.SignWithAlgorithm(i, rand, data, key.PrivateKeyAlgo())
+}
+
+func (kr *agentKeyring) SignWithAlgorithm(i int, rand io.Reader, data []byte, algorithm string) (sig []byte, err error) {
+	var key PublicKey
+	if key, err = kr.Key(i); err != nil {
+		return
+	}
+	if key == nil {
+		return nil, errors.New("ssh: key index out of range")
+	}
+	if sig, err = kr.agent.SignRequestWithAlgorithm(key, data, algorithm); err != nil {
 		return
 	}
 
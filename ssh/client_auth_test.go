@@ -200,6 +200,68 @@ func TestClientAuthPublicKey(t *testing.T) {
 	c.Close()
 }
 
+// algoKeychain is a keychain that can sign with other algorithms and
+// records the last one used.
+type algoKeychain struct {
+	keychain
+	algo string
+}
+
+func (k *algoKeychain) SignWithAlgorithm(i int, rand io.Reader, data []byte, algorithm string) ([]byte, error) {
+	k.algo = algorithm
+	return k.keys[i].(AlgorithmSigner).SignWithAlgorithm(rand, data, algorithm)
+}
+
+func TestClientAuthRSASHA2(t *testing.T) {
+	var algos []string
+	serverConfig := &ServerConfig{
+		PublicKeyCallback: func(conn *ServerConn, user, algo string, pubkey []byte) bool {
+			algos = append(algos, algo)
+			return bytes.Equal(pubkey, MarshalPublicKey(rsaKey.PublicKey()))
+		},
+	}
+	serverConfig.AddHostKey(ecdsaKey)
+
+	kc := &algoKeychain{keychain: keychain{keys: []Signer{rsaKey}}}
+	clientConfig := &ClientConfig{
+		User: "testuser",
+		Auth: []ClientAuth{ClientAuthKeyring(kc)},
+	}
+	if err := testKex(clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	if kc.algo != SigAlgoRSASHA2512 {
+		t.Errorf("client signed with %q, want %s", kc.algo, SigAlgoRSASHA2512)
+	}
+	for _, algo := range algos {
+		if algo != KeyAlgoRSA {
+			t.Errorf("PublicKeyCallback got algorithm %s, want %s", algo, KeyAlgoRSA)
+		}
+	}
+}
+
+func TestClientAuthEd25519(t *testing.T) {
+	serverConfig := &ServerConfig{
+		PublicKeyCallback: func(conn *ServerConn, user, algo string, pubkey []byte) bool {
+			return algo == KeyAlgoED25519 && bytes.Equal(pubkey, MarshalPublicKey(ed25519Key.PublicKey()))
+		},
+	}
+	serverConfig.AddHostKey(ed25519Key)
+
+	recorder := new(hostKeyRecorder)
+	clientConfig := &ClientConfig{
+		User:           "testuser",
+		Auth:           []ClientAuth{ClientAuthKeyring(&keychain{keys: []Signer{ed25519Key}})},
+		HostKeyChecker: recorder,
+	}
+	if err := testKex(clientConfig, serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	if recorder.algo != KeyAlgoED25519 {
+		t.Errorf("got host key algorithm %s, want %s", recorder.algo, KeyAlgoED25519)
+	}
+}
+
 func TestClientAuthPassword(t *testing.T) {
 	config := &ClientConfig{
 		User: "testuser",
@@ -317,7 +379,9 @@ func TestClientHMAC(t *testing.T) {
 				ClientAuthKeyring(kc),
 			},
 			Crypto: CryptoConfig{
-				MACs: []string{mac},
+				// AEAD ciphers would not use the MAC.
+				Ciphers: []string{"aes128-ctr"},
+				MACs:    []string{mac},
 			},
 		}
 		c, err := Dial("tcp", newMockAuthServer(t), config)
@@ -355,7 +419,7 @@ func TestClientUnsupportedKex(t *testing.T) {
 			ClientAuthKeyring(kc),
 		},
 		Crypto: CryptoConfig{
-			KeyExchanges: []string{"diffie-hellman-group-exchange-sha256"}, // not currently supported
+			KeyExchanges: []string{"diffie-hellman-group-exchange-sha1"}, // not currently supported
 		},
 	}
 	c, err := Dial("tcp", newMockAuthServer(t), config)
@@ -1,8 +1,12 @@
 package ssh
 
 import (
+	"bytes"
+	"io"
 	"net"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func testClientVersion(t *testing.T, config *ClientConfig, expected string) {
@@ -32,3 +36,153 @@ func TestCustomClientVersion(t *testing.T) {
 func TestDefaultClientVersion(t *testing.T) {
 	testClientVersion(t, &ClientConfig{}, string(clientVersion))
 }
+
+// hopRecorder is a HostKeyChecker that accepts any key and records what
+// it was given.
+type hopRecorder struct {
+	addr   string
+	remote net.Addr
+	key    []byte
+}
+
+func (r *hopRecorder) Check(addr string, remote net.Addr, algorithm string, hostKey []byte) error {
+	r.addr, r.remote, r.key = addr, remote, hostKey
+	return nil
+}
+
+// listenHop starts a server with hostKey that serves sessions by
+// writing "hello" and connects direct-tcpip channels to their
+// destination.
+func listenHop(t *testing.T, hostKey Signer) *Listener {
+	config := &ServerConfig{PasswordCallback: serverConfig.PasswordCallback}
+	config.AddHostKey(hostKey)
+	l, err := Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveHop(conn)
+		}
+	}()
+	return l
+}
+
+func serveHop(conn *ServerConn) {
+	defer conn.Close()
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	for {
+		ch, err := conn.Accept()
+		if err != nil {
+			return
+		}
+		switch ch.ChannelType() {
+		case "session":
+			s, err := AcceptSession(ch)
+			if err != nil {
+				continue
+			}
+			go func() {
+				defer s.Close()
+				if _, err := s.Read(nil); err != nil {
+					s.AckRequest(true)
+				}
+				s.Write([]byte("hello"))
+				s.SendExitStatus(0)
+			}()
+		case "direct-tcpip":
+			d, err := ParseDirectTCPIP(ch.ExtraData())
+			if err != nil {
+				ch.Reject(ConnectionFailed, err.Error())
+				continue
+			}
+			c, err := net.Dial("tcp", net.JoinHostPort(d.Host, strconv.Itoa(int(d.Port))))
+			if err != nil {
+				ch.Reject(ConnectionFailed, err.Error())
+				continue
+			}
+			ch.Accept()
+			go func() {
+				io.Copy(c, ch)
+				c.Close()
+			}()
+			go func() {
+				io.Copy(ch, c)
+				ch.Close()
+			}()
+		default:
+			ch.Reject(UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+func TestDialClient(t *testing.T) {
+	bastion := listenHop(t, rsaKey)
+	defer bastion.Close()
+	target := listenHop(t, ecdsaKey)
+	defer target.Close()
+
+	outer, err := Dial("tcp", bastion.Addr().String(), &ClientConfig{
+		User: "testuser",
+		Auth: []ClientAuth{ClientAuthPassword(clientPassword)},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer outer.Close()
+
+	recorder := new(hopRecorder)
+	inner, err := outer.DialClient(target.Addr().String(), &ClientConfig{
+		User:           "testuser",
+		Auth:           []ClientAuth{ClientAuthPassword(clientPassword)},
+		HostKeyChecker: recorder,
+	})
+	if err != nil {
+		t.Fatalf("DialClient: %v", err)
+	}
+	defer inner.Close()
+
+	if recorder.addr != target.Addr().String() {
+		t.Errorf("got host key check for %q, want %q", recorder.addr, target.Addr())
+	}
+	if recorder.remote.String() != target.Addr().String() {
+		t.Errorf("got remote address %v, want %v", recorder.remote, target.Addr())
+	}
+	if !bytes.Equal(recorder.key, MarshalPublicKey(ecdsaKey.PublicKey())) {
+		t.Errorf("host key checker was not given the target's key")
+	}
+
+	session, err := inner.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	out, err := session.Output("true")
+	if err != nil {
+		t.Fatalf("Output: %v", err)
+	}
+	if string(out) != "hello" {
+		t.Errorf("got %q, want %q", out, "hello")
+	}
+
+	// Closing the outer connection must bring down the inner one.
+	outer.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := inner.NewSession()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("NewSession succeeded after the outer connection was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("inner connection still open after the outer connection was closed")
+	}
+}
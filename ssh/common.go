@@ -6,10 +6,15 @@ package ssh
 
 import (
 	"crypto"
+	"crypto/subtle"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"sync"
+	"time"
+
+	"github.com/massiveart/go.crypto/curve25519"
 
 	_ "crypto/sha1"
 	_ "crypto/sha256"
@@ -18,25 +23,56 @@ import (
 
 // These are string constants in the SSH protocol.
 const (
-	kexAlgoDH1SHA1  = "diffie-hellman-group1-sha1"
-	kexAlgoDH14SHA1 = "diffie-hellman-group14-sha1"
-	kexAlgoECDH256  = "ecdh-sha2-nistp256"
-	kexAlgoECDH384  = "ecdh-sha2-nistp384"
-	kexAlgoECDH521  = "ecdh-sha2-nistp521"
-	hostAlgoRSA     = "ssh-rsa"
-	hostAlgoDSA     = "ssh-dss"
-	compressionNone = "none"
-	serviceUserAuth = "ssh-userauth"
-	serviceSSH      = "ssh-connection"
+	kexAlgoDH1SHA1     = "diffie-hellman-group1-sha1"
+	kexAlgoDH14SHA1    = "diffie-hellman-group14-sha1"
+	kexAlgoECDH256     = "ecdh-sha2-nistp256"
+	kexAlgoECDH384     = "ecdh-sha2-nistp384"
+	kexAlgoECDH521     = "ecdh-sha2-nistp521"
+	kexAlgoDHGEXSHA256 = "diffie-hellman-group-exchange-sha256"
+	hostAlgoRSA        = "ssh-rsa"
+	hostAlgoDSA        = "ssh-dss"
+	compressionNone    = "none"
+	serviceUserAuth    = "ssh-userauth"
+	serviceSSH         = "ssh-connection"
+
+	// curve25519-sha256 is specified in RFC 8731; OpenSSH also knows it
+	// under its original libssh.org name.
+	kexAlgoCurve25519SHA256       = "curve25519-sha256"
+	kexAlgoCurve25519SHA256LibSSH = "curve25519-sha256@libssh.org"
 )
 
 var supportedKexAlgos = []string{
+	kexAlgoCurve25519SHA256, kexAlgoCurve25519SHA256LibSSH,
 	kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521,
-	kexAlgoDH14SHA1, kexAlgoDH1SHA1,
+	kexAlgoDHGEXSHA256, kexAlgoDH14SHA1, kexAlgoDH1SHA1,
 }
 
-var supportedHostKeyAlgos = []string{hostAlgoRSA}
-var supportedCompressions = []string{compressionNone}
+// supportedHostKeyAlgos lists the host key algorithms a client accepts
+// by default, in order of preference. ssh-rsa was once the only host key
+// algorithm, so RSA keys come first: host keys recorded by existing
+// HostKeyCheckers and known_hosts files keep matching servers that have
+// other keys too. Of the rest, certificates are preferred over plain
+// keys, as in OpenSSH.
+var supportedHostKeyAlgos = []string{
+	KeyAlgoRSA, SigAlgoRSASHA2512, SigAlgoRSASHA2256,
+	CertAlgoED25519v01,
+	CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01,
+	CertSigAlgoRSASHA2512v01, CertSigAlgoRSASHA2256v01,
+	CertAlgoRSAv01, CertAlgoDSAv01,
+	KeyAlgoED25519,
+	KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521,
+	KeyAlgoDSA,
+}
+
+// serverSigAlgs lists the public key signature algorithms that the
+// server accepts for user authentication. It is sent to clients in
+// the server-sig-algs extension, see RFC 8308, section 3.1.
+var serverSigAlgs = []string{
+	KeyAlgoED25519,
+	KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521,
+	SigAlgoRSASHA2512, SigAlgoRSASHA2256,
+	SigAlgoRSA, KeyAlgoDSA,
+}
 
 // hashFuncs keeps the mapping of supported algorithms to their respective
 // hashes needed for signature verification.
@@ -95,6 +131,47 @@ func initDHGroup14() {
 	}
 }
 
+// curve25519KeyPair is an ephemeral key pair for curve25519-sha256
+// key agreement.
+type curve25519KeyPair struct {
+	priv [32]byte
+	pub  [32]byte
+}
+
+// generate fills kp with a fresh key pair. curve25519 clamps the
+// private scalar itself, so any 32 random bytes will do.
+func (kp *curve25519KeyPair) generate(rand io.Reader) error {
+	if _, err := io.ReadFull(rand, kp.priv[:]); err != nil {
+		return err
+	}
+	curve25519.ScalarBaseMult(&kp.pub, &kp.priv)
+	return nil
+}
+
+// sharedSecret computes the shared secret with the peer's public key
+// and returns it encoded as an mpint, ready for hashing as K.
+func (kp *curve25519KeyPair) sharedSecret(theirPub []byte) ([]byte, error) {
+	if len(theirPub) != 32 {
+		return nil, errors.New("ssh: peer's curve25519 public value has wrong length")
+	}
+	var their, secret [32]byte
+	copy(their[:], theirPub)
+	curve25519.ScalarMult(&secret, &kp.priv, &their)
+
+	// A low order point yields an all zero secret, which must be
+	// rejected.
+	var zeros [32]byte
+	if subtle.ConstantTimeCompare(secret[:], zeros[:]) == 1 {
+		return nil, errors.New("ssh: peer's curve25519 public value has wrong order")
+	}
+
+	// The secret is interpreted as a big-endian integer.
+	k := new(big.Int).SetBytes(secret[:])
+	K := make([]byte, intLength(k))
+	marshalInt(K, k)
+	return K, nil
+}
+
 // UnexpectedMessageError results when the SSH message that we received didn't
 // match what we wanted.
 type UnexpectedMessageError struct {
@@ -130,6 +207,16 @@ func findCommonAlgorithm(clientAlgos []string, serverAlgos []string) (commonAlgo
 	return
 }
 
+// contains reports whether list contains s.
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
 func findCommonCipher(clientCiphers []string, serverCiphers []string) (commonCipher string, ok bool) {
 	for _, clientCipher := range clientCiphers {
 		for _, serverCipher := range serverCiphers {
@@ -142,6 +229,29 @@ func findCommonCipher(clientCiphers []string, serverCiphers []string) (commonCip
 	return
 }
 
+func findCommonMAC(clientMACs []string, serverMACs []string) (commonMAC string, ok bool) {
+	for _, clientMAC := range clientMACs {
+		for _, serverMAC := range serverMACs {
+			// reject the MAC if we have no macModes definition
+			if clientMAC == serverMAC && macModes[clientMAC] != nil {
+				return clientMAC, true
+			}
+		}
+	}
+	return
+}
+
+func findCommonCompression(clientAlgos []string, serverAlgos []string) (commonAlgo string, ok bool) {
+	for _, clientAlgo := range clientAlgos {
+		for _, serverAlgo := range serverAlgos {
+			if clientAlgo == serverAlgo && isSupportedCompression(clientAlgo) {
+				return clientAlgo, true
+			}
+		}
+	}
+	return
+}
+
 func findAgreedAlgorithms(transport *transport, clientKexInit, serverKexInit *kexInitMsg) (kexAlgo, hostKeyAlgo string, ok bool) {
 	kexAlgo, ok = findCommonAlgorithm(clientKexInit.KexAlgos, serverKexInit.KexAlgos)
 	if !ok {
@@ -163,22 +273,29 @@ func findAgreedAlgorithms(transport *transport, clientKexInit, serverKexInit *ke
 		return
 	}
 
-	transport.writer.macAlgo, ok = findCommonAlgorithm(clientKexInit.MACsClientServer, serverKexInit.MACsClientServer)
-	if !ok {
-		return
+	// AEAD ciphers authenticate packets themselves, so no MAC is
+	// negotiated for them.
+	transport.writer.macAlgo, transport.reader.macAlgo = "", ""
+	if !cipherModes[transport.writer.cipherAlgo].aead {
+		transport.writer.macAlgo, ok = findCommonMAC(clientKexInit.MACsClientServer, serverKexInit.MACsClientServer)
+		if !ok {
+			return
+		}
 	}
 
-	transport.reader.macAlgo, ok = findCommonAlgorithm(clientKexInit.MACsServerClient, serverKexInit.MACsServerClient)
-	if !ok {
-		return
+	if !cipherModes[transport.reader.cipherAlgo].aead {
+		transport.reader.macAlgo, ok = findCommonMAC(clientKexInit.MACsServerClient, serverKexInit.MACsServerClient)
+		if !ok {
+			return
+		}
 	}
 
-	transport.writer.compressionAlgo, ok = findCommonAlgorithm(clientKexInit.CompressionClientServer, serverKexInit.CompressionClientServer)
+	transport.writer.compressionAlgo, ok = findCommonCompression(clientKexInit.CompressionClientServer, serverKexInit.CompressionClientServer)
 	if !ok {
 		return
 	}
 
-	transport.reader.compressionAlgo, ok = findCommonAlgorithm(clientKexInit.CompressionServerClient, serverKexInit.CompressionServerClient)
+	transport.reader.compressionAlgo, ok = findCommonCompression(clientKexInit.CompressionServerClient, serverKexInit.CompressionServerClient)
 	if !ok {
 		return
 	}
@@ -199,6 +316,40 @@ type CryptoConfig struct {
 
 	// The allowed MAC algorithms. If unspecified then DefaultMACOrder is used.
 	MACs []string
+
+	// The allowed compression algorithms. If unspecified then
+	// DefaultCompressionOrder is used by clients and
+	// DefaultServerCompressionOrder by servers.
+	Compressions []string
+
+	// RekeyThreshold is the number of bytes that may be sent or
+	// received with one set of keys before a new key exchange is
+	// started. If zero, 1 gigabyte is used, as RFC 4253, section 9
+	// recommends.
+	RekeyThreshold uint64
+
+	// RekeyInterval is the time after which a new key exchange is
+	// started, once there is data to send. If zero, one hour is used.
+	RekeyInterval time.Duration
+}
+
+const (
+	defaultRekeyThreshold = 1 << 30
+	defaultRekeyInterval  = time.Hour
+)
+
+func (c *CryptoConfig) rekeyThreshold() uint64 {
+	if c.RekeyThreshold == 0 {
+		return defaultRekeyThreshold
+	}
+	return c.RekeyThreshold
+}
+
+func (c *CryptoConfig) rekeyInterval() time.Duration {
+	if c.RekeyInterval == 0 {
+		return defaultRekeyInterval
+	}
+	return c.RekeyInterval
 }
 
 func (c *CryptoConfig) ciphers() []string {
@@ -222,6 +373,20 @@ func (c *CryptoConfig) macs() []string {
 	return c.MACs
 }
 
+func (c *CryptoConfig) compressions() []string {
+	if c.Compressions == nil {
+		return DefaultCompressionOrder
+	}
+	return c.Compressions
+}
+
+func (c *CryptoConfig) serverCompressions() []string {
+	if c.Compressions == nil {
+		return DefaultServerCompressionOrder
+	}
+	return c.Compressions
+}
+
 // serialize a signed slice according to RFC 4254 6.6. The name should
 // be a key type name, rather than a cert type name.
 func serializeSignature(name string, sig []byte) []byte {
@@ -241,7 +406,7 @@ func serializeSignature(name string, sig []byte) []byte {
 // generating an authorized_keys or host_keys file.
 func MarshalPublicKey(key PublicKey) []byte {
 	// See also RFC 4253 6.6.
-	algoname := key.PrivateKeyAlgo()
+	algoname := key.PublicKeyAlgo()
 	blob := key.Marshal()
 
 	length := stringLength(len(algoname))
@@ -269,10 +434,40 @@ func pubAlgoToPrivAlgo(pubAlgo string) string {
 		return KeyAlgoECDSA384
 	case CertAlgoECDSA521v01:
 		return KeyAlgoECDSA521
+	case CertAlgoED25519v01:
+		return KeyAlgoED25519
 	}
 	return pubAlgo
 }
 
+// splitSigAlgo splits a host key or public key authentication
+// algorithm name into the name of the key type and the name of the
+// signature algorithm. The two only differ for RSA keys, for which
+// the algorithm name also selects the hash, see RFC 8332.
+func splitSigAlgo(algo string) (keyAlgo, sigAlgo string) {
+	switch algo {
+	case SigAlgoRSASHA2256, SigAlgoRSASHA2512:
+		return KeyAlgoRSA, algo
+	case CertSigAlgoRSASHA2256v01:
+		return CertAlgoRSAv01, SigAlgoRSASHA2256
+	case CertSigAlgoRSASHA2512v01:
+		return CertAlgoRSAv01, SigAlgoRSASHA2512
+	}
+	return algo, pubAlgoToPrivAlgo(algo)
+}
+
+// hostKeyAlgosFor returns the host key algorithm names that may be
+// used with key, in order of preference.
+func hostKeyAlgosFor(key PublicKey) []string {
+	switch key.PublicKeyAlgo() {
+	case KeyAlgoRSA:
+		return []string{SigAlgoRSASHA2512, SigAlgoRSASHA2256, KeyAlgoRSA}
+	case CertAlgoRSAv01:
+		return []string{CertSigAlgoRSASHA2512v01, CertSigAlgoRSASHA2256v01, CertAlgoRSAv01}
+	}
+	return []string{key.PublicKeyAlgo()}
+}
+
 // buildDataSignedForAuth returns the data that is signed in order to prove
 // posession of a private key. See RFC 4252, section 7.
 func buildDataSignedForAuth(sessionId []byte, req userAuthRequestMsg, algo, pubKey []byte) []byte {
@@ -334,6 +529,14 @@ func appendString(buf []byte, s string) []byte {
 	return buf
 }
 
+// appendMPInt appends n in the mpint format of RFC 4251, section 5.
+func appendMPInt(buf []byte, n *big.Int) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, intLength(n))...)
+	marshalInt(buf[start:], n)
+	return buf
+}
+
 func appendBool(buf []byte, b bool) []byte {
 	if b {
 		buf = append(buf, 1)
@@ -0,0 +1,499 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+const (
+	compressionZlib = "zlib"
+	// zlib@openssh.com is zlib that only starts once the user is
+	// authenticated.
+	compressionZlibOpenSSH = "zlib@openssh.com"
+)
+
+// DefaultCompressionOrder lists the compression algorithms offered by
+// clients when CryptoConfig.Compressions is unset. Since "none" comes
+// first, a client using it only compresses if the server insists.
+var DefaultCompressionOrder = []string{compressionNone, compressionZlibOpenSSH, compressionZlib}
+
+// DefaultServerCompressionOrder lists the compression algorithms
+// offered by servers when CryptoConfig.Compressions is unset. As in
+// OpenSSH 7.4 and later, it leaves out "zlib", which would let clients
+// send compressed data before they are authenticated. Servers that need
+// it must list it in CryptoConfig.Compressions.
+var DefaultServerCompressionOrder = []string{compressionNone, compressionZlibOpenSSH}
+
+func isSupportedCompression(algo string) bool {
+	switch algo {
+	case compressionNone, compressionZlib, compressionZlibOpenSSH:
+		return true
+	}
+	return false
+}
+
+// packetCompression compresses or decompresses the payloads of
+// consecutive packets in one direction. As described in RFC 4253,
+// section 6.2, the compression context carries over from one packet to
+// the next.
+type packetCompression interface {
+	// transform returns the compressed or decompressed packet.
+	transform(packet []byte) ([]byte, error)
+
+	// close releases the resources held by the compression context.
+	close()
+}
+
+// zlibCompressor compresses outgoing packets.
+type zlibCompressor struct {
+	buf bytes.Buffer
+	w   *zlib.Writer
+}
+
+func newZlibCompressor() packetCompression {
+	c := new(zlibCompressor)
+	c.w = zlib.NewWriter(&c.buf)
+	return c
+}
+
+func (c *zlibCompressor) transform(packet []byte) ([]byte, error) {
+	c.buf.Reset()
+	if _, err := c.w.Write(packet); err != nil {
+		return nil, err
+	}
+	// Flushing ends the compressed data for the packet on a byte
+	// boundary, so the peer can decompress it without waiting for
+	// the next packet.
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), c.buf.Bytes()...), nil
+}
+
+func (c *zlibCompressor) close() {}
+
+// zlibDecompressor decompresses incoming packets. An inflater runs in
+// its own goroutine, which is fed packets one at a time and blocks for
+// the next packet when it needs more input. compress/flate cannot be
+// used this way: it only returns decoded data at the end of a stored
+// block or of the stream, which suits the sync flushes of
+// compress/zlib, but OpenSSH ends each packet with a partial flush, an
+// empty fixed block, so flate would hold back every packet until the
+// next one arrived.
+type zlibDecompressor struct {
+	// input and output are only used by the goroutine between
+	// receiving from wake and sending on done.
+	input  []byte
+	output bytes.Buffer
+
+	// wake hands input to the goroutine; closing it stops the
+	// goroutine. done reports that the input is consumed, or why
+	// decompression failed.
+	wake chan bool
+	done chan error
+	err  error
+}
+
+func newZlibDecompressor() packetCompression {
+	d := &zlibDecompressor{
+		wake: make(chan bool),
+		done: make(chan error, 1),
+	}
+	go d.run()
+	return d
+}
+
+func (d *zlibDecompressor) run() {
+	if _, ok := <-d.wake; !ok {
+		return
+	}
+	f := &inflater{r: d, out: &d.output}
+	d.done <- f.inflate()
+}
+
+// ReadByte returns the next byte of compressed input, waiting for the
+// next packet once the current one is consumed.
+func (d *zlibDecompressor) ReadByte() (byte, error) {
+	for len(d.input) == 0 {
+		d.done <- nil
+		if _, ok := <-d.wake; !ok {
+			return 0, io.EOF
+		}
+	}
+	c := d.input[0]
+	d.input = d.input[1:]
+	return c, nil
+}
+
+func (d *zlibDecompressor) transform(packet []byte) ([]byte, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.input = packet
+	d.output.Reset()
+	d.wake <- true
+	if d.err = <-d.done; d.err != nil {
+		return nil, d.err
+	}
+	return append([]byte(nil), d.output.Bytes()...), nil
+}
+
+func (d *zlibDecompressor) close() {
+	close(d.wake)
+}
+
+var (
+	errCorruptCompression = errors.New("ssh: corrupt compressed data")
+	errCompressionEnded   = errors.New("ssh: compressed stream ended")
+)
+
+// Base values and extra bits of the length and distance codes, from
+// RFC 1951, section 3.2.5.
+var (
+	lengthBase  = [29]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [29]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [30]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [30]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+	// codeLengthOrder is the order in which the code length code
+	// lengths of a dynamic block are sent.
+	codeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+const (
+	maxCodeBits = 15
+	windowSize  = 1 << 15
+)
+
+// huffman is a canonical Huffman code: the number of codes of each
+// length, and the symbols in code order.
+type huffman struct {
+	count  [maxCodeBits + 1]int
+	symbol []int
+}
+
+// newHuffman builds the code for the given code lengths. As in zlib,
+// the code must be complete, except that a single code of one bit or
+// no code at all is accepted; decoding an unused code fails.
+func newHuffman(lengths []int) (*huffman, error) {
+	h := &huffman{symbol: make([]int, len(lengths))}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		left -= h.count[l]
+		if left < 0 {
+			return nil, errCorruptCompression
+		}
+	}
+	codes := len(lengths) - h.count[0]
+	if left > 0 && codes > 0 && !(codes == 1 && h.count[1] == 1) {
+		return nil, errCorruptCompression
+	}
+	var offset [maxCodeBits + 1]int
+	for l := 1; l < maxCodeBits; l++ {
+		offset[l+1] = offset[l] + h.count[l]
+	}
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offset[l]] = sym
+			offset[l]++
+		}
+	}
+	return h, nil
+}
+
+var fixedLiteralCode, fixedDistanceCode *huffman
+
+func init() {
+	var lengths [288]int
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	fixedLiteralCode, _ = newHuffman(lengths[:])
+	// Distance codes 30 and 31 complete the code but never occur.
+	for i := 0; i < 32; i++ {
+		lengths[i] = 5
+	}
+	fixedDistanceCode, _ = newHuffman(lengths[:32])
+}
+
+// inflater decodes a zlib stream (RFC 1950 and RFC 1951), writing each
+// byte to out as soon as it is decoded.
+type inflater struct {
+	r   io.ByteReader
+	out *bytes.Buffer
+
+	bits  uint32
+	nbits uint
+
+	window  [windowSize]byte
+	written int
+}
+
+func (f *inflater) readBits(n uint) (int, error) {
+	for f.nbits < n {
+		c, err := f.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		f.bits |= uint32(c) << f.nbits
+		f.nbits += 8
+	}
+	v := int(f.bits & (1<<n - 1))
+	f.bits >>= n
+	f.nbits -= n
+	return v, nil
+}
+
+func (f *inflater) decode(h *huffman) (int, error) {
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeBits; l++ {
+		b, err := f.readBits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= b
+		count := h.count[l]
+		if code-first < count {
+			return h.symbol[index+code-first], nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, errCorruptCompression
+}
+
+func (f *inflater) emit(b byte) {
+	f.window[f.written%windowSize] = b
+	f.written++
+	f.out.WriteByte(b)
+}
+
+// inflate decodes the stream until it ends or reading fails. It never
+// returns nil.
+func (f *inflater) inflate() error {
+	cmf, err := f.readBits(8)
+	if err != nil {
+		return err
+	}
+	flg, err := f.readBits(8)
+	if err != nil {
+		return err
+	}
+	// Only deflate without a preset dictionary is valid.
+	if cmf&0x0f != 8 || (cmf<<8|flg)%31 != 0 || flg&0x20 != 0 {
+		return errCorruptCompression
+	}
+	for {
+		final, err := f.readBits(1)
+		if err != nil {
+			return err
+		}
+		typ, err := f.readBits(2)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 0:
+			err = f.storedBlock()
+		case 1:
+			err = f.codes(fixedLiteralCode, fixedDistanceCode)
+		case 2:
+			err = f.dynamicBlock()
+		default:
+			err = errCorruptCompression
+		}
+		if err != nil {
+			return err
+		}
+		if final == 1 {
+			return errCompressionEnded
+		}
+	}
+}
+
+func (f *inflater) storedBlock() error {
+	// Stored blocks start on a byte boundary.
+	f.bits, f.nbits = 0, 0
+	n, err := f.readBits(16)
+	if err != nil {
+		return err
+	}
+	complement, err := f.readBits(16)
+	if err != nil {
+		return err
+	}
+	if n != ^complement&0xffff {
+		return errCorruptCompression
+	}
+	for ; n > 0; n-- {
+		c, err := f.readBits(8)
+		if err != nil {
+			return err
+		}
+		f.emit(byte(c))
+	}
+	return f.checkSize()
+}
+
+func (f *inflater) dynamicBlock() error {
+	nlen, err := f.readBits(5)
+	if err != nil {
+		return err
+	}
+	ndist, err := f.readBits(5)
+	if err != nil {
+		return err
+	}
+	ncode, err := f.readBits(4)
+	if err != nil {
+		return err
+	}
+	nlen += 257
+	ndist++
+	ncode += 4
+	if nlen > 286 || ndist > 30 {
+		return errCorruptCompression
+	}
+
+	var lengths [286 + 30]int
+	for i := 0; i < ncode; i++ {
+		if lengths[codeLengthOrder[i]], err = f.readBits(3); err != nil {
+			return err
+		}
+	}
+	lencode, err := newHuffman(lengths[:19])
+	if err != nil {
+		return err
+	}
+
+	for i := range lengths {
+		lengths[i] = 0
+	}
+	for i := 0; i < nlen+ndist; {
+		sym, err := f.decode(lencode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = sym
+			i++
+			continue
+		}
+		var repeat, length int
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errCorruptCompression
+			}
+			length = lengths[i-1]
+			repeat, err = f.readBits(2)
+			repeat += 3
+		case 17:
+			repeat, err = f.readBits(3)
+			repeat += 3
+		default:
+			repeat, err = f.readBits(7)
+			repeat += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+repeat > nlen+ndist {
+			return errCorruptCompression
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[i] = length
+			i++
+		}
+	}
+	// The end of block code must be present.
+	if lengths[256] == 0 {
+		return errCorruptCompression
+	}
+
+	literalCode, err := newHuffman(lengths[:nlen])
+	if err != nil {
+		return err
+	}
+	distanceCode, err := newHuffman(lengths[nlen : nlen+ndist])
+	if err != nil {
+		return err
+	}
+	return f.codes(literalCode, distanceCode)
+}
+
+// codes decodes the literals and back references of a Huffman coded
+// block, up to and including its end of block code.
+func (f *inflater) codes(literalCode, distanceCode *huffman) error {
+	for {
+		sym, err := f.decode(literalCode)
+		if err != nil {
+			return err
+		}
+		switch {
+		case sym < 256:
+			f.emit(byte(sym))
+		case sym == 256:
+			return nil
+		default:
+			sym -= 257
+			if sym >= len(lengthBase) {
+				return errCorruptCompression
+			}
+			extra, err := f.readBits(lengthExtra[sym])
+			if err != nil {
+				return err
+			}
+			length := lengthBase[sym] + extra
+
+			sym, err = f.decode(distanceCode)
+			if err != nil {
+				return err
+			}
+			if sym >= len(distBase) {
+				return errCorruptCompression
+			}
+			if extra, err = f.readBits(distExtra[sym]); err != nil {
+				return err
+			}
+			dist := distBase[sym] + extra
+			if dist > f.written || dist > windowSize {
+				return errCorruptCompression
+			}
+			for ; length > 0; length-- {
+				f.emit(f.window[(f.written-dist)%windowSize])
+			}
+		}
+		if err := f.checkSize(); err != nil {
+			return err
+		}
+	}
+}
+
+// checkSize limits the data a single packet may decompress to.
+func (f *inflater) checkSize() error {
+	if f.out.Len() > maxPacket {
+		return errors.New("ssh: decompressed packet too large")
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"testing"
+)
+
+func TestZlibPackets(t *testing.T) {
+	random := make([]byte, 40000)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		t.Fatal(err)
+	}
+	packets := [][]byte{
+		[]byte("hello"),
+		bytes.Repeat([]byte("hello world "), 5000),
+		random,
+		random[:1000],
+		{msgChannelData},
+		random,
+	}
+
+	c := newZlibCompressor()
+	d := newZlibDecompressor()
+	defer d.close()
+	for i, packet := range packets {
+		compressed, err := c.transform(packet)
+		if err != nil {
+			t.Fatalf("packet %d: compress: %v", i, err)
+		}
+		got, err := d.transform(compressed)
+		if err != nil {
+			t.Fatalf("packet %d: decompress: %v", i, err)
+		}
+		if !bytes.Equal(got, packet) {
+			t.Fatalf("packet %d: got %d bytes back, want %d", i, len(got), len(packet))
+		}
+	}
+}
+
+// TestInflateChunks checks that the inflater handles all block types
+// and input split at arbitrary points.
+func TestInflateChunks(t *testing.T) {
+	random := make([]byte, 100000)
+	if _, err := io.ReadFull(rand.Reader, random); err != nil {
+		t.Fatal(err)
+	}
+	data := append(bytes.Repeat([]byte("abcabcabd"), 10000), random...)
+
+	for _, level := range []int{zlib.NoCompression, zlib.BestSpeed, zlib.BestCompression, zlib.HuffmanOnly} {
+		var buf bytes.Buffer
+		w, err := zlib.NewWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+		w.Flush()
+		compressed := buf.Bytes()
+
+		d := newZlibDecompressor()
+		var got []byte
+		for i := 0; i < len(compressed); i += 777 {
+			end := i + 777
+			if end > len(compressed) {
+				end = len(compressed)
+			}
+			out, err := d.transform(compressed[i:end])
+			if err != nil {
+				t.Fatalf("level %d: %v", level, err)
+			}
+			got = append(got, out...)
+		}
+		d.close()
+		if !bytes.Equal(got, data) {
+			t.Errorf("level %d: decompressed data differs", level)
+		}
+	}
+}
+
+// partialFlushPackets holds messages compressed by zlib at level 6 with
+// Z_PARTIAL_FLUSH after each one, as OpenSSH compresses packets.
+var partialFlushPackets = []struct {
+	data, compressed string
+}{
+	{"hello", "789cca48cdc9c90708"},
+	{"hello hello hello, world", "a00c10a18044ea2894e717e5a40004"},
+	{
+		"The quick brown fox jumps over the lazy dog. The quick brown fox jumps over the lazy dog. The quick brown fox jumps over the lazy dog. Pack my box with five dozen liquor jugs, how vexingly quick daft zebras jump! Sphinx of black quartz, judge my vow.",
+		"a06d4c8e1086812098caf0773916aa200109af0e90b5d66d2b7acb1429f0ee9e9ea72184625f1fc8c8cd43f18e7759b704ae14910776a21f5858cff89f7c17c35b0fc821359b0d94ad3450270f6743e138b63a4d30dc5069b75ebbe3975f84cae824a348df831b1e9bb17e072b487785431131f769d045d37553b9cda700",
+	},
+	{"hello", "02870240"},
+}
+
+// flateReader lets compress/zlib read the input of a zlibDecompressor.
+type flateReader struct {
+	*zlibDecompressor
+}
+
+func (r flateReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	p[0] = c
+	return 1, nil
+}
+
+// newFlateDecompressor returns a zlibDecompressor that uses
+// compress/zlib instead of the inflater.
+func newFlateDecompressor() *zlibDecompressor {
+	d := &zlibDecompressor{
+		wake: make(chan bool),
+		done: make(chan error, 1),
+	}
+	go func() {
+		if _, ok := <-d.wake; !ok {
+			return
+		}
+		r, err := zlib.NewReader(flateReader{d})
+		buf := make([]byte, 1024)
+		for err == nil {
+			var n int
+			n, err = r.Read(buf)
+			d.output.Write(buf[:n])
+		}
+		d.done <- err
+	}()
+	return d
+}
+
+func TestInflatePartialFlush(t *testing.T) {
+	d := newZlibDecompressor()
+	defer d.close()
+	for i, p := range partialFlushPackets {
+		compressed, _ := hex.DecodeString(p.compressed)
+		got, err := d.transform(compressed)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if string(got) != p.data {
+			t.Errorf("packet %d: got %q, want %q", i, got, p.data)
+		}
+	}
+
+	// compress/flate decodes sync flushed packets as they come...
+	c := newZlibCompressor()
+	fd := newFlateDecompressor()
+	for i, p := range partialFlushPackets {
+		compressed, err := c.transform([]byte(p.data))
+		if err != nil {
+			t.Fatalf("packet %d: compress: %v", i, err)
+		}
+		if got, err := fd.transform(compressed); err != nil || string(got) != p.data {
+			t.Errorf("packet %d: flate with sync flushes got %q, %v, want %q", i, got, err, p.data)
+		}
+	}
+	fd.close()
+
+	// ...but not partially flushed ones. Should this change, the
+	// inflater can give way to compress/flate.
+	fd = newFlateDecompressor()
+	defer fd.close()
+	compressed, _ := hex.DecodeString(partialFlushPackets[0].compressed)
+	if got, err := fd.transform(compressed); err == nil && string(got) == partialFlushPackets[0].data {
+		t.Errorf("compress/flate now decodes partially flushed packets")
+	}
+}
+
+func TestNewHuffman(t *testing.T) {
+	for _, c := range []struct {
+		lengths []int
+		ok      bool
+	}{
+		{[]int{1, 1}, true},
+		{[]int{2, 1, 3, 3}, true},
+		{[]int{0, 1, 0}, true}, // a single one bit code
+		{[]int{0, 0, 0}, true}, // no code
+		{[]int{2, 2}, false},   // incomplete
+		{[]int{0, 2, 0}, false},
+		{[]int{1, 1, 1}, false}, // oversubscribed
+	} {
+		if _, err := newHuffman(c.lengths); (err == nil) != c.ok {
+			t.Errorf("newHuffman(%v): got %v", c.lengths, err)
+		}
+	}
+}
+
+// inflateAll decodes a whole zlib stream with the inflater.
+func inflateAll(stream []byte) ([]byte, error) {
+	var out bytes.Buffer
+	f := &inflater{r: bytes.NewReader(stream), out: &out}
+	err := f.inflate()
+	if err == errCompressionEnded {
+		err = nil
+	}
+	return out.Bytes(), err
+}
+
+// TestInflateDifferential compares the inflater with compress/flate on
+// random streams and on corrupted copies of them.
+func TestInflateDifferential(t *testing.T) {
+	rnd := mathrand.New(mathrand.NewSource(1))
+	levels := []int{zlib.HuffmanOnly, zlib.NoCompression, zlib.BestSpeed, zlib.DefaultCompression, zlib.BestCompression}
+	for i := 0; i < 100; i++ {
+		// Data from a small alphabet compresses to back references
+		// and dynamic blocks.
+		data := make([]byte, rnd.Intn(10000))
+		alphabet := 1 + rnd.Intn(255)
+		for j := range data {
+			data[j] = byte(rnd.Intn(alphabet))
+		}
+		var buf bytes.Buffer
+		w, _ := zlib.NewWriterLevel(&buf, levels[rnd.Intn(len(levels))])
+		w.Write(data[:len(data)/2])
+		w.Flush()
+		w.Write(data[len(data)/2:])
+		w.Close()
+		stream := buf.Bytes()
+
+		if got, err := inflateAll(stream); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("stream %x: got %d bytes, %v, want %d bytes", stream, len(got), err, len(data))
+		}
+
+		// The header and the checksum, which the inflater does not
+		// check, are left alone.
+		body := stream[:len(stream)-4]
+		for j := 0; j < 20; j++ {
+			corrupt := append([]byte(nil), body...)
+			corrupt[2+rnd.Intn(len(corrupt)-2)] ^= 1 << uint(rnd.Intn(8))
+
+			want, wantErr := ioutil.ReadAll(flate.NewReader(bytes.NewReader(corrupt[2:])))
+			if wantErr == nil && len(want) > maxPacket {
+				continue
+			}
+			got, err := inflateAll(corrupt)
+			if (err == nil) != (wantErr == nil) {
+				t.Errorf("stream %x: got error %v, compress/flate got %v", corrupt, err, wantErr)
+			} else if err == nil && !bytes.Equal(got, want) {
+				t.Errorf("stream %x: output differs from compress/flate", corrupt)
+			}
+		}
+	}
+}
+
+func TestInflateCorrupt(t *testing.T) {
+	d := newZlibDecompressor()
+	defer d.close()
+	if _, err := d.transform([]byte{0x78, 0x9c, 0xff, 0xff, 0xff}); err == nil {
+		t.Errorf("corrupt data was accepted")
+	}
+}
+
+func TestCompressionHandshake(t *testing.T) {
+	for _, algo := range []string{compressionZlib, compressionZlibOpenSSH} {
+		crypto := CryptoConfig{Compressions: []string{algo}}
+		client, server := rekeyConns(t, crypto, crypto)
+		conn, err := client.Dial("tcp", "127.0.0.1:22")
+		if err != nil {
+			t.Fatalf("%s: Dial: %v", algo, err)
+		}
+		testEcho(t, conn, 64*1024, func() {
+			if err := client.RequestKeyChange(); err != nil {
+				t.Errorf("%s: RequestKeyChange: %v", algo, err)
+			}
+		})
+		client.transport.writer.Lock()
+		compressed := client.transport.writer.compression != nil
+		client.transport.writer.Unlock()
+		if !compressed {
+			t.Errorf("%s: client is not compressing", algo)
+		}
+		if server.transport.reader.compressionAlgo != algo {
+			t.Errorf("%s: server negotiated %q", algo, server.transport.reader.compressionAlgo)
+		}
+		conn.Close()
+		client.Close()
+	}
+}
+
+func TestServerCompressionDefault(t *testing.T) {
+	for _, c := range []struct {
+		algo string
+		ok   bool
+	}{
+		{compressionZlibOpenSSH, true},
+		{compressionZlib, false},
+	} {
+		serverConfig := &ServerConfig{
+			PasswordCallback: func(conn *ServerConn, user, password string) bool {
+				return password == "password"
+			},
+		}
+		if err := serverConfig.SetRSAPrivateKey([]byte(testServerPrivateKey)); err != nil {
+			t.Fatalf("SetRSAPrivateKey: %v", err)
+		}
+		clientConfig := &ClientConfig{
+			User:   "user",
+			Auth:   []ClientAuth{ClientAuthPassword(password("password"))},
+			Crypto: CryptoConfig{Compressions: []string{c.algo}},
+		}
+		if err := testKex(clientConfig, serverConfig); (err == nil) != c.ok {
+			t.Errorf("%s: got %v, want ok=%v", c.algo, err, c.ok)
+		}
+	}
+}
@@ -127,6 +127,30 @@ func ExampleDial() {
 	fmt.Println(b.String())
 }
 
+func ExampleParsePrivateKeyWithPassphrase() {
+	pemBytes, err := ioutil.ReadFile("id_ed25519")
+	if err != nil {
+		log.Fatalf("unable to read private key: %v", err)
+	}
+
+	// Try the key without a passphrase first, and only prompt for
+	// one if the key turns out to be encrypted.
+	signer, err := ParsePrivateKey(pemBytes)
+	if _, ok := err.(*PassphraseMissingError); ok {
+		fmt.Print("Enter passphrase: ")
+		passphrase, readErr := terminal.ReadPassword(0)
+		fmt.Println()
+		if readErr != nil {
+			log.Fatalf("unable to read passphrase: %v", readErr)
+		}
+		signer, err = ParsePrivateKeyWithPassphrase(pemBytes, passphrase)
+	}
+	if err != nil {
+		log.Fatalf("unable to parse private key: %v", err)
+	}
+	fmt.Println(signer.PublicKey().PublicKeyAlgo())
+}
+
 func ExampleClientConn_Listen() {
 	config := &ClientConfig{
 		User: "username",
@@ -0,0 +1,159 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// fingerprintBlob returns the data that fingerprints are computed over.
+// Like OpenSSH, it uses the key inside a certificate rather than the
+// certificate itself.
+func fingerprintBlob(pubKey PublicKey) []byte {
+	if cert, ok := pubKey.(*OpenSSHCertV01); ok {
+		pubKey = cert.Key
+	}
+	return MarshalPublicKey(pubKey)
+}
+
+// FingerprintLegacyMD5 returns the MD5 fingerprint of pubKey as
+// colon-separated hex bytes, as printed by older versions of OpenSSH.
+func FingerprintLegacyMD5(pubKey PublicKey) string {
+	sum := md5.Sum(fingerprintBlob(pubKey))
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(hex, ":")
+}
+
+// FingerprintSHA256 returns the SHA-256 fingerprint of pubKey in the
+// form printed by ssh-keygen -l, "SHA256:" followed by the unpadded
+// base64 encoding of the digest.
+func FingerprintSHA256(pubKey PublicKey) string {
+	sum := sha256.Sum256(fingerprintBlob(pubKey))
+	return "SHA256:" + strings.TrimRight(base64.StdEncoding.EncodeToString(sum[:]), "=")
+}
+
+// RandomArt returns the "drunken bishop" visualization of the SHA-256
+// fingerprint of pubKey, as printed by ssh-keygen -lv. The result
+// consists of 11 lines, each terminated by a newline. See "The drunken
+// bishop: An analysis of the OpenSSH fingerprint visualization
+// algorithm" by Loss, Limmer and von Gernler.
+func RandomArt(pubKey PublicKey) string {
+	sum := sha256.Sum256(fingerprintBlob(pubKey))
+	return randomArt(sum[:], randomArtTitle(pubKey), "SHA256")
+}
+
+const (
+	randomArtWidth  = 17
+	randomArtHeight = 9
+
+	// randomArtSymbols are drawn for squares visited 0, 1, 2, ...
+	// times. The last two mark the start and end of the walk.
+	randomArtSymbols = " .o+=*BOX@%&#/^SE"
+)
+
+// randomArtTitle returns the key type and size shown at the top of the
+// picture, such as "[RSA 2048]".
+func randomArtTitle(pubKey PublicKey) string {
+	key, suffix := pubKey, ""
+	if cert, ok := pubKey.(*OpenSSHCertV01); ok {
+		key, suffix = cert.Key, "-CERT"
+	}
+
+	var name string
+	var bits int
+	switch k := key.(type) {
+	case *rsaPublicKey:
+		name, bits = "RSA", k.N.BitLen()
+	case *dsaPublicKey:
+		name, bits = "DSA", k.P.BitLen()
+	case *ecdsaPublicKey:
+		name, bits = "ECDSA", k.Params().BitSize
+	case *ed25519PublicKey:
+		name, bits = "ED25519", 256
+	default:
+		return "[" + strings.ToUpper(key.PublicKeyAlgo()) + "]"
+	}
+
+	title := fmt.Sprintf("[%s%s %d]", name, suffix, bits)
+	if len(title) > randomArtWidth {
+		title = "[" + name + suffix + "]"
+	}
+	return title
+}
+
+// randomArt draws the walk that digest describes. Starting in the
+// center of the field, each pair of bits moves the bishop one square
+// diagonally, least significant bits first.
+func randomArt(digest []byte, title, hashName string) string {
+	var field [randomArtWidth][randomArtHeight]int
+	maxSymbol := len(randomArtSymbols) - 1
+
+	x, y := randomArtWidth/2, randomArtHeight/2
+	for _, b := range digest {
+		for i := 0; i < 4; i++ {
+			if b&1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if b&2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			x = clamp(x, 0, randomArtWidth-1)
+			y = clamp(y, 0, randomArtHeight-1)
+			if field[x][y] < maxSymbol-2 {
+				field[x][y]++
+			}
+			b >>= 2
+		}
+	}
+	field[randomArtWidth/2][randomArtHeight/2] = maxSymbol - 1
+	field[x][y] = maxSymbol
+
+	var out []byte
+	out = appendRandomArtBorder(out, title)
+	for y := 0; y < randomArtHeight; y++ {
+		out = append(out, '|')
+		for x := 0; x < randomArtWidth; x++ {
+			out = append(out, randomArtSymbols[field[x][y]])
+		}
+		out = append(out, "|\n"...)
+	}
+	out = appendRandomArtBorder(out, "["+hashName+"]")
+	return string(out)
+}
+
+// appendRandomArtBorder appends a horizontal border with label centered
+// in it, rounding to the left.
+func appendRandomArtBorder(out []byte, label string) []byte {
+	if len(label) > randomArtWidth {
+		label = label[:randomArtWidth]
+	}
+	left := (randomArtWidth - len(label)) / 2
+	out = append(out, '+')
+	out = append(out, strings.Repeat("-", left)...)
+	out = append(out, label...)
+	out = append(out, strings.Repeat("-", randomArtWidth-left-len(label))...)
+	return append(out, "+\n"...)
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
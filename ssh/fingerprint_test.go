@@ -0,0 +1,136 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"crypto/md5"
+	"testing"
+)
+
+// The expected values were printed by ssh-keygen -l and -lv.
+var fingerprintTests = []struct {
+	key       string
+	md5       string
+	sha256    string
+	randomArt string
+}{
+	{
+		key:    "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAFLXUeUn0OexzcYu4UdnRbl60NKGNaS2AgH623zl9yN",
+		md5:    "ef:72:7e:8b:06:ba:bc:17:f6:3f:2b:e1:f6:0a:52:a9",
+		sha256: "SHA256:1STGuRnDX+5qH/KI0a2rf1dWYFmqCYeI1exwiJVLbPA",
+		randomArt: `+--[ED25519 256]--+
+|      .=oBo..  o.|
+|      .+BoX=  =. |
+|      .oE=+*o+.. |
+|        ..+o.o. .|
+|        S   o.  .|
+|           . .. o|
+|          . o.o..|
+|           oo=...|
+|          o+=+o. |
++----[SHA256]-----+
+`,
+	},
+	{
+		key:    "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQDKID78P8UAzQt7QRgNSzfvWE9B40bwvUZg+sdAep+PfRfLNv6ZtAAtSfUTBF+bTC8g406HPotO3d96oGjINaxc4oUnHS0Zr5ZVk94mJI3TIRRvAbrm7bB2VRdSbKWjkRcYjX7WgJbyUk92RwJvZH5eXd3R58lInnO3eoM7gkjPWw==",
+		sha256: "SHA256:en82hMQlfOm6puu0L6qgUb3qJZ+m5iV6FrJazRmyDAI",
+		randomArt: `+---[RSA 1024]----+
+|         .   .   |
+|          o +    |
+|E        . =     |
+|.  .      o .    |
+|o o o   S. o     |
+|o+.= + .  o .    |
+|.oB.B . o  o     |
+|.=+O.. o.oo +    |
+|=*=o+..o=*oo .   |
++----[SHA256]-----+
+`,
+	},
+	{
+		key:    "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBFh+Tepm+S55XmaH3vijsPiwP8xKH8cahRGr7SBV0WQFYtjgyfrKKS6s7R0MFJ0Ao4UnfSFi6bomrEaqLDN6zMQ=",
+		md5:    "32:d1:d0:bf:f8:0a:07:0d:2f:8d:d2:0f:74:50:23:a6",
+		sha256: "SHA256:0o1wvRMiR7Hf0fhslSF6DSPFbzYlxdv7zwHxiCCauXM",
+		randomArt: `+---[ECDSA 256]---+
+|        o. .o= +.|
+|       . o  o+* =|
+|      o.=.o.ooo+=|
+|      +*.=.+o++B.|
+|     +. S =..o*.o|
+|      ..   . ... |
+|     o E       ..|
+|      o        .o|
+|                +|
++----[SHA256]-----+
+`,
+	},
+	// Fingerprints of certificates are those of the certified key.
+	{
+		key:    "ssh-ed25519-cert-v01@openssh.com AAAAIHNzaC1lZDI1NTE5LWNlcnQtdjAxQG9wZW5zc2guY29tAAAAICM+hMaEN+CTnmjU6NUIpzulH9iX5w+KnkSbQ2Rayax7AAAAIJ3SdE0KFW2fa13agv14GiGw0TYcgpOI4NsOJMdOJW6SAAAAAAAAAAAAAAABAAAAAmlkAAAAAAAAAAAAAAAA//////////8AAAAAAAAAggAAABVwZXJtaXQtWDExLWZvcndhcmRpbmcAAAAAAAAAF3Blcm1pdC1hZ2VudC1mb3J3YXJkaW5nAAAAAAAAABZwZXJtaXQtcG9ydC1mb3J3YXJkaW5nAAAAAAAAAApwZXJtaXQtcHR5AAAAAAAAAA5wZXJtaXQtdXNlci1yYwAAAAAAAAAAAAAAMwAAAAtzc2gtZWQyNTUxOQAAACAHfN+PcWyIygNX1bev7WNPaWD3N8Qkz9VEyH9727EfIgAAAFMAAAALc3NoLWVkMjU1MTkAAABABv9qry8f88DVahK/aNtQBO55u5I5/SWcyj7NBWpCDJfY9ZQnxir/c7t40ws4/2SSZSxtZCB4iRTMP1+scuezCA==",
+		md5:    "8e:bf:05:19:0e:e0:3d:d0:0d:7b:26:d8:58:95:62:62",
+		sha256: "SHA256:S35UmB6JylutSvCoqMbXkNK/EuYPJw7zwt3s4M5yPJU",
+		randomArt: `+-[ED25519-CERT]--+
+|                 |
+|         . +     |
+|        . = .    |
+|     . . o o     |
+|  . o + S +      |
+| . * E = +       |
+|oo*+X.+ + .      |
+| BBX=* . .       |
+|= B*=+o          |
++----[SHA256]-----+
+`,
+	},
+}
+
+func TestFingerprints(t *testing.T) {
+	for _, test := range fingerprintTests {
+		out, _, _, _, ok := ParseAuthorizedKey([]byte(test.key))
+		if !ok {
+			t.Fatalf("ParseAuthorizedKey(%q) failed", test.key)
+		}
+		key := out.(PublicKey)
+		if got := FingerprintLegacyMD5(key); test.md5 != "" && got != test.md5 {
+			t.Errorf("%s: got MD5 fingerprint %s, want %s", key.PublicKeyAlgo(), got, test.md5)
+		}
+		if got := FingerprintSHA256(key); got != test.sha256 {
+			t.Errorf("%s: got SHA-256 fingerprint %s, want %s", key.PublicKeyAlgo(), got, test.sha256)
+		}
+		if got := RandomArt(key); got != test.randomArt {
+			t.Errorf("%s: got random art\n%s\nwant\n%s", key.PublicKeyAlgo(), got, test.randomArt)
+		}
+	}
+}
+
+func TestRandomArtMD5(t *testing.T) {
+	// ssh-keygen -lv -E md5 on the ECDSA key above.
+	want := `+---[ECDSA 256]---+
+|      =oo        |
+|     o =..       |
+|    E + o.       |
+|     o O  .      |
+|    . O S. .     |
+|     . B. .      |
+|      . o.       |
+|       o  .      |
+|        ..       |
++------[MD5]------+
+`
+	out, _, _, _, _ := ParseAuthorizedKey([]byte(fingerprintTests[2].key))
+	key := out.(PublicKey)
+	sum := md5.Sum(MarshalPublicKey(key))
+	if got := randomArt(sum[:], randomArtTitle(key), "MD5"); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRandomArtCertTitle(t *testing.T) {
+	// "[ED25519-CERT 256]" is too wide, see the test vectors above.
+	cert := &OpenSSHCertV01{Key: ecdsaKey.PublicKey()}
+	if got, want := randomArtTitle(cert), "[ECDSA-CERT 256]"; got != want {
+		t.Errorf("got title %q, want %q", got, want)
+	}
+}
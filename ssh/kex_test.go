@@ -7,6 +7,8 @@ package ssh
 // Key exchange tests.
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"net"
 	"testing"
@@ -51,7 +53,12 @@ func testKexAlgorithm(algo string) error {
 		Auth:   []ClientAuth{ClientAuthPassword(password("password"))},
 		Crypto: crypto,
 	}
+	return testKex(&clientConfig, &serverConfig)
+}
 
+// testKex runs a handshake between a client and a server with the
+// given configurations.
+func testKex(clientConfig *ClientConfig, serverConfig *ServerConfig) error {
 	conn1, conn2, err := pipe()
 	if err != nil {
 		return err
@@ -60,14 +67,14 @@ func testKexAlgorithm(algo string) error {
 	defer conn1.Close()
 	defer conn2.Close()
 
-	server := Server(conn2, &serverConfig)
+	server := Server(conn2, serverConfig)
 	serverHS := make(chan error, 1)
 	go func() {
 		serverHS <- server.Handshake()
 	}()
 
 	// Client runs the handshake.
-	_, err = Client(conn1, &clientConfig)
+	_, err = Client(conn1, clientConfig)
 	if err != nil {
 		return fmt.Errorf("Client: %v", err)
 	}
@@ -82,9 +89,58 @@ func testKexAlgorithm(algo string) error {
 }
 
 func TestKexAlgorithms(t *testing.T) {
-	for _, algo := range []string{kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521, kexAlgoDH1SHA1, kexAlgoDH14SHA1} {
+	for _, algo := range []string{kexAlgoCurve25519SHA256, kexAlgoCurve25519SHA256LibSSH, kexAlgoECDH256, kexAlgoECDH384, kexAlgoECDH521, kexAlgoDHGEXSHA256, kexAlgoDH1SHA1, kexAlgoDH14SHA1} {
 		if err := testKexAlgorithm(algo); err != nil {
 			t.Errorf("algorithm %s: %v", algo, err)
 		}
 	}
 }
+
+// Test vectors from RFC 7748, section 6.1.
+func TestCurve25519SharedSecret(t *testing.T) {
+	fromHex := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	var alice, bob curve25519KeyPair
+	copy(alice.priv[:], fromHex("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"))
+	copy(bob.priv[:], fromHex("5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb"))
+	if err := alice.generate(bytes.NewReader(alice.priv[:])); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.generate(bytes.NewReader(bob.priv[:])); err != nil {
+		t.Fatal(err)
+	}
+	if want := fromHex("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"); !bytes.Equal(alice.pub[:], want) {
+		t.Errorf("got public key %x, want %x", alice.pub, want)
+	}
+	if want := fromHex("de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"); !bytes.Equal(bob.pub[:], want) {
+		t.Errorf("got public key %x, want %x", bob.pub, want)
+	}
+
+	// The secret is 4a5d...1742 with a high bit of zero, so the mpint
+	// needs no padding.
+	want := append([]byte{0, 0, 0, 32}, fromHex("4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742")...)
+	for _, c := range []struct {
+		kp  *curve25519KeyPair
+		pub []byte
+	}{{&alice, bob.pub[:]}, {&bob, alice.pub[:]}} {
+		K, err := c.kp.sharedSecret(c.pub)
+		if err != nil {
+			t.Fatalf("sharedSecret: %v", err)
+		}
+		if !bytes.Equal(K, want) {
+			t.Errorf("got K %x, want %x", K, want)
+		}
+	}
+
+	if _, err := alice.sharedSecret(make([]byte, 32)); err == nil {
+		t.Errorf("sharedSecret accepted a low order point")
+	}
+	if _, err := alice.sharedSecret(bob.pub[:31]); err == nil {
+		t.Errorf("sharedSecret accepted a short public value")
+	}
+}
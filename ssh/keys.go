@@ -12,12 +12,16 @@ import (
 	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
+
+	"github.com/massiveart/go.crypto/ed25519"
 )
 
 // These constants represent the algorithm names for key types supported by this
@@ -28,8 +32,24 @@ const (
 	KeyAlgoECDSA256 = "ecdsa-sha2-nistp256"
 	KeyAlgoECDSA384 = "ecdsa-sha2-nistp384"
 	KeyAlgoECDSA521 = "ecdsa-sha2-nistp521"
+	KeyAlgoED25519  = "ssh-ed25519"
+)
+
+// These constants name the signature algorithms for RSA keys, see RFC
+// 8332. SigAlgoRSA, which uses SHA-1, is the default for RSA keys.
+const (
+	SigAlgoRSA        = "ssh-rsa"
+	SigAlgoRSASHA2256 = "rsa-sha2-256"
+	SigAlgoRSASHA2512 = "rsa-sha2-512"
 )
 
+// rsaSigHashes maps the RSA signature algorithms to their hashes.
+var rsaSigHashes = map[string]crypto.Hash{
+	SigAlgoRSA:        crypto.SHA1,
+	SigAlgoRSASHA2256: crypto.SHA256,
+	SigAlgoRSASHA2512: crypto.SHA512,
+}
+
 // parsePubKey parses a public key according to RFC 4253, section 6.6.
 func parsePubKey(in []byte) (pubKey PublicKey, rest []byte, ok bool) {
 	algo, in, ok := parseString(in)
@@ -44,7 +64,9 @@ func parsePubKey(in []byte) (pubKey PublicKey, rest []byte, ok bool) {
 		return parseDSA(in)
 	case KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521:
 		return parseECDSA(in)
-	case CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01:
+	case KeyAlgoED25519:
+		return parseED25519(in)
+	case CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01, CertAlgoED25519v01:
 		return parseOpenSSHCertV01(in, string(algo))
 	}
 	return nil, nil, false
@@ -76,6 +98,17 @@ func parseAuthorizedKey(in []byte) (out interface{}, comment string, ok bool) {
 	return
 }
 
+// isAuthorizedKeyAlgo reports whether algo is a key type that may
+// appear in an authorized_keys file.
+func isAuthorizedKeyAlgo(algo string) bool {
+	switch algo {
+	case KeyAlgoRSA, KeyAlgoDSA, KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521, KeyAlgoED25519,
+		CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01, CertAlgoED25519v01:
+		return true
+	}
+	return false
+}
+
 // ParseAuthorizedKeys parses a public key from an authorized_keys
 // file used in OpenSSH according to the sshd(8) manual page.
 func ParseAuthorizedKey(in []byte) (out interface{}, comment string, options []string, rest []byte, ok bool) {
@@ -106,21 +139,11 @@ func ParseAuthorizedKey(in []byte) (out interface{}, comment string, options []s
 		}
 
 		field := string(in[:i])
-		switch field {
-		case KeyAlgoRSA, KeyAlgoDSA:
+		if isAuthorizedKeyAlgo(field) {
 			out, comment, ok = parseAuthorizedKey(in[i:])
 			if ok {
 				return
 			}
-		case KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521:
-			// We don't support these keys.
-			in = rest
-			continue
-		case CertAlgoRSAv01, CertAlgoDSAv01,
-			CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01:
-			// We don't support these certificates.
-			in = rest
-			continue
 		}
 
 		// No key type recognised. Maybe there's an options field at
@@ -161,8 +184,7 @@ func ParseAuthorizedKey(in []byte) (out interface{}, comment string, options []s
 		}
 
 		field = string(in[:i])
-		switch field {
-		case KeyAlgoRSA, KeyAlgoDSA:
+		if isAuthorizedKeyAlgo(field) {
 			out, comment, ok = parseAuthorizedKey(in[i:])
 			if ok {
 				options = candidateOptions
@@ -226,6 +248,44 @@ type Signer interface {
 	Sign(rand io.Reader, data []byte) ([]byte, error)
 }
 
+// An AlgorithmSigner is a Signer that can also sign with a signature
+// algorithm other than the default for its key, such as rsa-sha2-256
+// for an RSA key.
+type AlgorithmSigner interface {
+	Signer
+
+	// SignWithAlgorithm is like Sign, but uses the given signature
+	// algorithm.
+	SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) ([]byte, error)
+}
+
+// signWithAlgorithm signs data with signer, using the signature
+// algorithm algo.
+func signWithAlgorithm(signer Signer, rand io.Reader, data []byte, algo string) ([]byte, error) {
+	if algo == signer.PublicKey().PrivateKeyAlgo() {
+		return signer.Sign(rand, data)
+	}
+	if s, ok := signer.(AlgorithmSigner); ok {
+		return s.SignWithAlgorithm(rand, data, algo)
+	}
+	return nil, fmt.Errorf("ssh: signer does not support signature algorithm %s", algo)
+}
+
+// verifySignature reports whether sig is a valid signature of data by
+// key. Besides the default algorithm of the key, sig may use any
+// other signature algorithm for its type.
+func verifySignature(key PublicKey, data []byte, sig *signature) bool {
+	k := key
+	if cert, ok := key.(*OpenSSHCertV01); ok {
+		k = cert.Key
+	}
+	if rsaKey, ok := k.(*rsaPublicKey); ok {
+		hash, ok := rsaSigHashes[sig.Format]
+		return ok && rsaKey.verifyHash(hash, data, sig.Blob)
+	}
+	return sig.Format == key.PrivateKeyAlgo() && key.Verify(data, sig.Blob)
+}
+
 type rsaPublicKey rsa.PublicKey
 
 func (r *rsaPublicKey) PrivateKeyAlgo() string {
@@ -273,10 +333,14 @@ func (r *rsaPublicKey) Marshal() []byte {
 }
 
 func (r *rsaPublicKey) Verify(data []byte, sig []byte) bool {
-	h := crypto.SHA1.New()
+	return r.verifyHash(crypto.SHA1, data, sig)
+}
+
+func (r *rsaPublicKey) verifyHash(hash crypto.Hash, data []byte, sig []byte) bool {
+	h := hash.New()
 	h.Write(data)
 	digest := h.Sum(nil)
-	return rsa.VerifyPKCS1v15((*rsa.PublicKey)(r), crypto.SHA1, digest, sig) == nil
+	return rsa.VerifyPKCS1v15((*rsa.PublicKey)(r), hash, digest, sig) == nil
 }
 
 type rsaPrivateKey struct {
@@ -288,10 +352,18 @@ func (r *rsaPrivateKey) PublicKey() PublicKey {
 }
 
 func (r *rsaPrivateKey) Sign(rand io.Reader, data []byte) ([]byte, error) {
-	h := crypto.SHA1.New()
+	return r.SignWithAlgorithm(rand, data, SigAlgoRSA)
+}
+
+func (r *rsaPrivateKey) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) ([]byte, error) {
+	hash, ok := rsaSigHashes[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("ssh: unsupported signature algorithm %s for RSA key", algorithm)
+	}
+	h := hash.New()
 	h.Write(data)
 	digest := h.Sum(nil)
-	return rsa.SignPKCS1v15(rand, r.PrivateKey, crypto.SHA1, digest)
+	return rsa.SignPKCS1v15(rand, r.PrivateKey, hash, digest)
 }
 
 type dsaPublicKey dsa.PublicKey
@@ -379,9 +451,11 @@ func (k *dsaPrivateKey) Sign(rand io.Reader, data []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	// r and s are left padded to 20 bytes each.
 	sig := make([]byte, 40)
-	copy(sig[:20], r.Bytes())
-	copy(sig[20:], s.Bytes())
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[20-len(rb):20], rb)
+	copy(sig[40-len(sb):], sb)
 	return sig, nil
 }
 
@@ -515,9 +589,63 @@ func (k *ecdsaPrivateKey) Sign(rand io.Reader, data []byte) ([]byte, error) {
 	return sig, nil
 }
 
-// NewPrivateKey takes a pointer to rsa, dsa or ecdsa PrivateKey
-// returns a corresponding Signer instance. EC keys should use P256,
-// P384 or P521.
+type ed25519PublicKey [ed25519.PublicKeySize]byte
+
+func (k *ed25519PublicKey) PrivateKeyAlgo() string {
+	return KeyAlgoED25519
+}
+
+func (k *ed25519PublicKey) PublicKeyAlgo() string {
+	return k.PrivateKeyAlgo()
+}
+
+// parseED25519 parses an Ed25519 key, which is serialized as a string
+// holding the 32-byte public key, see RFC 8709, section 4.
+func parseED25519(in []byte) (out PublicKey, rest []byte, ok bool) {
+	var keyBytes []byte
+	if keyBytes, in, ok = parseString(in); !ok {
+		return
+	}
+	if len(keyBytes) != ed25519.PublicKeySize {
+		return nil, nil, false
+	}
+	key := new(ed25519PublicKey)
+	copy(key[:], keyBytes)
+	return key, in, true
+}
+
+func (k *ed25519PublicKey) Marshal() []byte {
+	ret := make([]byte, stringLength(len(k)))
+	marshalString(ret, k[:])
+	return ret
+}
+
+func (k *ed25519PublicKey) Verify(data []byte, sigBlob []byte) bool {
+	if len(sigBlob) != ed25519.SignatureSize {
+		return false
+	}
+	var sig [ed25519.SignatureSize]byte
+	copy(sig[:], sigBlob)
+	return ed25519.Verify((*[ed25519.PublicKeySize]byte)(k), data, &sig)
+}
+
+type ed25519PrivateKey struct {
+	key *[ed25519.PrivateKeySize]byte
+}
+
+func (k *ed25519PrivateKey) PublicKey() PublicKey {
+	pub := new(ed25519PublicKey)
+	copy(pub[:], k.key[32:])
+	return pub
+}
+
+func (k *ed25519PrivateKey) Sign(rand io.Reader, data []byte) ([]byte, error) {
+	return ed25519.Sign(k.key, data)[:], nil
+}
+
+// NewPrivateKey takes a pointer to rsa, dsa or ecdsa PrivateKey, or
+// to an Ed25519 private key, and returns a corresponding Signer
+// instance. EC keys should use P256, P384 or P521.
 func NewSignerFromKey(k interface{}) (Signer, error) {
 	var sshKey Signer
 	switch t := k.(type) {
@@ -531,14 +659,18 @@ func NewSignerFromKey(k interface{}) (Signer, error) {
 		}
 
 		sshKey = &ecdsaPrivateKey{t}
+	case *[ed25519.PrivateKeySize]byte:
+		key := *t
+		sshKey = &ed25519PrivateKey{&key}
 	default:
 		return nil, fmt.Errorf("ssh: unsupported key type %T", k)
 	}
 	return sshKey, nil
 }
 
-// NewPublicKey takes a pointer to rsa, dsa or ecdsa PublicKey
-// and returns a corresponding ssh PublicKey instance. EC keys should use P256, P384 or P521.
+// NewPublicKey takes a pointer to rsa, dsa or ecdsa PublicKey, or to
+// an Ed25519 public key, and returns a corresponding ssh PublicKey
+// instance. EC keys should use P256, P384 or P521.
 func NewPublicKey(k interface{}) (PublicKey, error) {
 	var sshKey PublicKey
 	switch t := k.(type) {
@@ -551,20 +683,60 @@ func NewPublicKey(k interface{}) (PublicKey, error) {
 		sshKey = (*ecdsaPublicKey)(t)
 	case *dsa.PublicKey:
 		sshKey = (*dsaPublicKey)(t)
+	case *[ed25519.PublicKeySize]byte:
+		key := ed25519PublicKey(*t)
+		sshKey = &key
 	default:
 		return nil, fmt.Errorf("ssh: unsupported key type %T", k)
 	}
 	return sshKey, nil
 }
 
+// PassphraseMissingError is returned when parsing an encrypted private
+// key without a passphrase.
+type PassphraseMissingError struct {
+	// PublicKey is set if the key format stores the public key
+	// unencrypted, as OpenSSH's own format does.
+	PublicKey PublicKey
+}
+
+func (e *PassphraseMissingError) Error() string {
+	return "ssh: private key is encrypted, a passphrase is required"
+}
+
 // ParsePublicKey parses a PEM encoded private key. Currently, only
-// PKCS#1, RSA and ECDSA private keys are supported.
+// PKCS#1 RSA, ECDSA, PKCS#8 Ed25519 and OpenSSH private keys are
+// supported. If the key is encrypted, a *PassphraseMissingError is
+// returned.
 func ParsePrivateKey(pemBytes []byte) (Signer, error) {
+	return parsePrivateKey(pemBytes, nil)
+}
+
+// ParsePrivateKeyWithPassphrase is like ParsePrivateKey, but decrypts
+// keys protected by passphrase. Both OpenSSH private keys and PEM blocks
+// with a "Proc-Type: 4,ENCRYPTED" header are supported. If passphrase is
+// incorrect, x509.IncorrectPasswordError is returned.
+func ParsePrivateKeyWithPassphrase(pemBytes, passphrase []byte) (Signer, error) {
+	return parsePrivateKey(pemBytes, passphrase)
+}
+
+func parsePrivateKey(pemBytes, passphrase []byte) (Signer, error) {
 	block, _ := pem.Decode(pemBytes)
 	if block == nil {
 		return nil, errors.New("ssh: no key found")
 	}
 
+	if x509.IsEncryptedPEMBlock(block) {
+		if len(passphrase) == 0 {
+			return nil, &PassphraseMissingError{}
+		}
+		der, err := x509.DecryptPEMBlock(block, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: block.Type, Bytes: der}
+	}
+
 	var rawkey interface{}
 	switch block.Type {
 	case "RSA PRIVATE KEY":
@@ -579,6 +751,14 @@ func ParsePrivateKey(pemBytes []byte) (Signer, error) {
 			return nil, err
 		}
 		rawkey = ec
+	case "PRIVATE KEY":
+		key, err := parsePKCS8Ed25519(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rawkey = key
+	case opensshKeyBlock:
+		return parseOpenSSHPrivateKey(block.Bytes, passphrase)
 
 		// TODO(hanwen): find doc for format and implement PEM parsing
 		// for DSA keys.
@@ -588,3 +768,37 @@ func ParsePrivateKey(pemBytes []byte) (Signer, error) {
 
 	return NewSignerFromKey(rawkey)
 }
+
+// oidEd25519 identifies Ed25519 keys, see RFC 8410, section 3.
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// pkcs8 is the ASN.1 structure of an unencrypted PKCS#8 private key,
+// see RFC 5208, section 5.
+type pkcs8 struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// parsePKCS8Ed25519 parses an Ed25519 private key in PKCS#8 form, as
+// described in RFC 8410, section 7.
+func parsePKCS8Ed25519(der []byte) (*[ed25519.PrivateKeySize]byte, error) {
+	var key pkcs8
+	if _, err := asn1.Unmarshal(der, &key); err != nil {
+		return nil, err
+	}
+	if !key.Algo.Algorithm.Equal(oidEd25519) {
+		return nil, fmt.Errorf("ssh: unsupported PKCS#8 key algorithm %v", key.Algo.Algorithm)
+	}
+	var seed []byte
+	if _, err := asn1.Unmarshal(key.PrivateKey, &seed); err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("ssh: invalid Ed25519 private key")
+	}
+	var s [ed25519.SeedSize]byte
+	copy(s[:], seed)
+	_, priv := ed25519.NewKeyFromSeed(&s)
+	return priv, nil
+}
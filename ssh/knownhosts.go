@@ -0,0 +1,472 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Markers that may precede the host patterns of a known_hosts line,
+// see the SSH_KNOWN_HOSTS FILE FORMAT section of sshd(8).
+const (
+	markerCertAuthority = "@cert-authority"
+	markerRevoked       = "@revoked"
+)
+
+// hashedHostPrefix introduces a hostname hashed with HMAC-SHA1, as
+// written by ssh-keygen -H.
+const hashedHostPrefix = "|1|"
+
+type knownHostsLine struct {
+	marker   string
+	patterns []hostPattern
+	key      PublicKey
+}
+
+// hostPattern is a single entry of the comma separated host list.
+type hostPattern struct {
+	negate bool
+
+	// For plain patterns.
+	pattern string
+
+	// For hashed entries.
+	salt, hash []byte
+}
+
+func (p *hostPattern) match(host string) bool {
+	if p.hash != nil {
+		return bytes.Equal(hashHost(host, p.salt), p.hash)
+	}
+	return wildcardMatch(p.pattern, host)
+}
+
+// match reports whether any of the given host names matches the
+// line. A matching negated pattern excludes the host altogether.
+func (l *knownHostsLine) match(hosts []string) bool {
+	matched := false
+	for _, h := range hosts {
+		for i := range l.patterns {
+			p := &l.patterns[i]
+			if !p.match(h) {
+				continue
+			}
+			if p.negate {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// wildcardMatch matches s against a pattern that may contain the
+// wildcards '*' (any sequence) and '?' (any single character).
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = pattern[1:]
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if wildcardMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+func hashHost(host string, salt []byte) []byte {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return mac.Sum(nil)
+}
+
+// HashHostname returns the hashed form of a host name or address as
+// used in known_hosts files, with a fresh random salt.
+func HashHostname(host string) (string, error) {
+	salt := make([]byte, sha1.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	return encodeHashedHost(salt, hashHost(strings.ToLower(host), salt)), nil
+}
+
+func encodeHashedHost(salt, hash []byte) string {
+	return hashedHostPrefix + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(hash)
+}
+
+func parseHostPattern(p string) (hostPattern, error) {
+	var hp hostPattern
+	if strings.HasPrefix(p, "!") {
+		hp.negate = true
+		p = p[1:]
+	}
+	if !strings.HasPrefix(p, hashedHostPrefix) {
+		hp.pattern = strings.ToLower(p)
+		return hp, nil
+	}
+
+	parts := strings.Split(p[len(hashedHostPrefix):], "|")
+	if len(parts) != 2 {
+		return hp, errors.New("ssh: invalid hashed host")
+	}
+	var err error
+	if hp.salt, err = base64.StdEncoding.DecodeString(parts[0]); err != nil {
+		return hp, errors.New("ssh: invalid hashed host salt")
+	}
+	if hp.hash, err = base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return hp, errors.New("ssh: invalid hashed host hash")
+	}
+	return hp, nil
+}
+
+// normalizeHost returns the form in which a host address is written to
+// known_hosts files: the bare host name for the default port, and
+// "[host]:port" otherwise.
+func normalizeHost(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "22"
+	}
+	host = strings.ToLower(host)
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+// HostKeyError is returned by KnownHosts.Check if the host key offered
+// by the server could not be verified.
+type HostKeyError struct {
+	// Host is the normalized host name that was looked up.
+	Host string
+
+	// Key is the key offered by the server.
+	Key PublicKey
+
+	// Known lists the keys on record for the host, if any.
+	Known []PublicKey
+
+	// Revoked is set if the key is marked as @revoked.
+	Revoked bool
+}
+
+// Unknown reports whether there were no keys on record for the host, so
+// that the key may be added for trust-on-first-use.
+func (e *HostKeyError) Unknown() bool {
+	return !e.Revoked && len(e.Known) == 0
+}
+
+// Changed reports whether the host presented a key different from the
+// ones on record.
+func (e *HostKeyError) Changed() bool {
+	return !e.Revoked && len(e.Known) > 0
+}
+
+func (e *HostKeyError) Error() string {
+	switch {
+	case e.Revoked:
+		return fmt.Sprintf("ssh: host key for %s is revoked", e.Host)
+	case e.Changed():
+		return fmt.Sprintf("ssh: host key for %s has changed", e.Host)
+	}
+	return fmt.Sprintf("ssh: host %s is not in known_hosts", e.Host)
+}
+
+// KnownHosts is a HostKeyChecker for host keys listed in the OpenSSH
+// known_hosts format. It supports hashed host names, [host]:port
+// entries, wildcard and negated patterns, and the @revoked and
+// @cert-authority markers.
+type KnownHosts struct {
+	// HashHostnames causes entries written by Add to have their
+	// host names hashed.
+	HashHostnames bool
+
+	// Clock is used to check the validity period of host
+	// certificates. If nil, time.Now is used.
+	Clock func() time.Time
+
+	mu    sync.Mutex
+	lines []knownHostsLine
+	path  string
+}
+
+// ParseKnownHosts parses the contents of a known_hosts file. As in
+// OpenSSH, lines that cannot be parsed or that have key types this
+// package does not support, such as legacy RSA1 keys, are ignored.
+func ParseKnownHosts(in []byte) (*KnownHosts, error) {
+	k := new(KnownHosts)
+	k.parse(in)
+	return k, nil
+}
+
+// LoadKnownHosts reads the known_hosts file at path. A missing file is
+// treated as an empty one. Entries added with Add are appended to the
+// file.
+func LoadKnownHosts(path string) (*KnownHosts, error) {
+	k := &KnownHosts{path: path}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	k.parse(data)
+	return k, nil
+}
+
+func (k *KnownHosts) parse(in []byte) {
+	for len(in) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(in, '\n'); i != -1 {
+			line, in = in[:i], in[i+1:]
+		} else {
+			line, in = in, nil
+		}
+		if l, ok := parseKnownHostsLine(line); ok {
+			k.lines = append(k.lines, l)
+		}
+	}
+}
+
+// parseKnownHostsLine parses a single line. As in OpenSSH, it returns
+// ok == false for comments and for lines that cannot be used, such as
+// lines with an unknown marker, too few fields, or a key that cannot be
+// decoded or has an unsupported type.
+func parseKnownHostsLine(line []byte) (l knownHostsLine, ok bool) {
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return
+	}
+
+	if strings.HasPrefix(fields[0], "@") {
+		l.marker = fields[0]
+		if l.marker != markerCertAuthority && l.marker != markerRevoked {
+			return l, false
+		}
+		fields = fields[1:]
+	}
+	if len(fields) < 3 {
+		return l, false
+	}
+
+	for _, p := range strings.Split(fields[0], ",") {
+		if p == "" {
+			continue
+		}
+		hp, err := parseHostPattern(p)
+		if err != nil {
+			return l, false
+		}
+		l.patterns = append(l.patterns, hp)
+	}
+
+	keyBytes, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return l, false
+	}
+	key, _, keyOk := ParsePublicKey(keyBytes)
+	if !keyOk || key.PublicKeyAlgo() != fields[1] {
+		return l, false
+	}
+	l.key = key
+	return l, true
+}
+
+// hostNames returns the names under which the server may be listed.
+func hostNames(addr string, remote net.Addr) []string {
+	names := []string{normalizeHost(addr)}
+	// Connections forwarded through another host, such as those of
+	// ClientConn.DialClient, may have an unspecified remote address.
+	if tcp, ok := remote.(*net.TCPAddr); ok && !tcp.IP.IsUnspecified() {
+		ip := normalizeHost(net.JoinHostPort(tcp.IP.String(), fmt.Sprint(tcp.Port)))
+		if ip != names[0] {
+			names = append(names, ip)
+		}
+	}
+	return names
+}
+
+func sameKey(a, b PublicKey) bool {
+	return bytes.Equal(MarshalPublicKey(a), MarshalPublicKey(b))
+}
+
+// Check implements the HostKeyChecker interface. If the key cannot
+// be verified, the returned error is a *HostKeyError.
+func (k *KnownHosts) Check(addr string, remote net.Addr, algorithm string, hostKey []byte) error {
+	key, _, ok := ParsePublicKey(hostKey)
+	if !ok {
+		return errors.New("ssh: could not parse host key")
+	}
+
+	names := hostNames(addr, remote)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if cert, ok := key.(*OpenSSHCertV01); ok {
+		if k.revoked(cert.SignatureKey) || k.revoked(cert.Key) {
+			return &HostKeyError{Host: names[0], Key: key, Revoked: true}
+		}
+		if k.trustedCert(names, cert) {
+			return nil
+		}
+		// Fall back to the key embedded in the certificate.
+		key = cert.Key
+	}
+
+	if k.revoked(key) {
+		return &HostKeyError{Host: names[0], Key: key, Revoked: true}
+	}
+
+	var known []PublicKey
+	for i := range k.lines {
+		l := &k.lines[i]
+		if l.marker != "" || !l.match(names) {
+			continue
+		}
+		if sameKey(l.key, key) {
+			return nil
+		}
+		known = append(known, l.key)
+	}
+	return &HostKeyError{Host: names[0], Key: key, Known: known}
+}
+
+// revoked reports whether key is listed as @revoked. Revocations apply
+// regardless of the host patterns of the entry.
+func (k *KnownHosts) revoked(key PublicKey) bool {
+	for i := range k.lines {
+		l := &k.lines[i]
+		if l.marker == markerRevoked && sameKey(l.key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustedCert reports whether cert is a valid host certificate for
+// one of names, signed by an authority listed for the host.
+func (k *KnownHosts) trustedCert(names []string, cert *OpenSSHCertV01) bool {
+	trusted := false
+	for i := range k.lines {
+		l := &k.lines[i]
+		if l.marker == markerCertAuthority && l.match(names) && sameKey(l.key, cert.SignatureKey) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted || cert.Type != HostCert || !cert.validSignature() {
+		return false
+	}
+
+	now := time.Now()
+	if k.Clock != nil {
+		now = k.Clock()
+	}
+	if now.Before(cert.ValidAfter) || !now.Before(cert.ValidBefore) {
+		return false
+	}
+
+	if len(cert.ValidPrincipals) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(names[0])
+	if err != nil {
+		host = names[0]
+	}
+	host = strings.Trim(host, "[]")
+	for _, p := range cert.ValidPrincipals {
+		if strings.ToLower(p) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// KnownHostsLine returns a line in known_hosts format that lists key
+// for the given addresses, which may be of the form "host" or
+// "host:port".
+func KnownHostsLine(addresses []string, key PublicKey) string {
+	var hosts []string
+	for _, a := range addresses {
+		hosts = append(hosts, normalizeHost(a))
+	}
+	return strings.Join(hosts, ",") + " " + strings.TrimSpace(string(MarshalAuthorizedKey(key)))
+}
+
+// Add records key as the host key for the server at addr and remote.
+// It is meant to be used after Check failed with an error whose
+// Unknown method returns true. If the KnownHosts was created with
+// LoadKnownHosts, the entry is also appended to the file.
+func (k *KnownHosts) Add(addr string, remote net.Addr, key PublicKey) error {
+	names := hostNames(addr, remote)
+
+	var out []string
+	if k.HashHostnames {
+		for _, n := range names {
+			h, err := HashHostname(n)
+			if err != nil {
+				return err
+			}
+			out = append(out, h+" "+strings.TrimSpace(string(MarshalAuthorizedKey(key))))
+		}
+	} else {
+		out = append(out, KnownHostsLine(names, key))
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, s := range out {
+		l, ok := parseKnownHostsLine([]byte(s))
+		if !ok {
+			return errors.New("ssh: unsupported key type")
+		}
+		k.lines = append(k.lines, l)
+		buf.WriteString(s)
+		buf.WriteByte('\n')
+	}
+
+	if k.path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(k.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
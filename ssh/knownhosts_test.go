@@ -0,0 +1,263 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Generated with ssh-keygen: a host key, a CA key and a host
+// certificate for "example.com" signed by the CA.
+const (
+	testHostKeyLine = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBFEZzNUwIpjmkr1RQbI0bAGEQTSB8yne11BYZTRPwZRgDjVbk+C7Xa2G7kXPluUAnkpZw1tqwcEYb/0VZzlXoY4="
+	testCAKeyLine   = "ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBLPTzCye76qFFAy6HTa0K/hSzuSqHhN1Oh30roCu9Yb8GvM8nIlxexO/Rn1IS4rOJl/eQ9Ld8HQVWf7SFP3lx9U="
+	testHostCert    = "ecdsa-sha2-nistp256-cert-v01@openssh.com AAAAKGVjZHNhLXNoYTItbmlzdHAyNTYtY2VydC12MDFAb3BlbnNzaC5jb20AAAAgG7anE2aSlUILH0LSk4vvIO38AOiIYwAMlOMTGOD5FfsAAAAIbmlzdHAyNTYAAABBBFEZzNUwIpjmkr1RQbI0bAGEQTSB8yne11BYZTRPwZRgDjVbk+C7Xa2G7kXPluUAnkpZw1tqwcEYb/0VZzlXoY4AAAAAAAAABwAAAAIAAAAGaG9zdGlkAAAADwAAAAtleGFtcGxlLmNvbQAAAAAAAAAA//////////8AAAAAAAAAAAAAAAAAAABoAAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBLPTzCye76qFFAy6HTa0K/hSzuSqHhN1Oh30roCu9Yb8GvM8nIlxexO/Rn1IS4rOJl/eQ9Ld8HQVWf7SFP3lx9UAAABkAAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAABJAAAAIQDP6pa2hBiyBOSxz4CNux67/cR5vOsDP78eTjc6UXilQQAAACACxd+U35O0rzPI+/CFf3dYpErp/6dXZtSdD4GTVLEDwQ== host"
+
+	// testHostKeyLine hashed by ssh-keygen -H for "example.com"
+	// and "[example.org]:2222".
+	testHashedHosts = `|1|SmXlL+Te3h5KthsDnaMEwo1KoHU=|99vzXdEE+qtJLE8KIrEeZF3IyXg= ` + testHostKeyLine + `
+|1|ANfmprTfgii2jHFEOCXCWPFU2Zo=|8nChZRZRLI8hMarxMO7HItIb128= ` + testHostKeyLine + `
+`
+)
+
+func parseTestKey(t *testing.T, line string) PublicKey {
+	out, _, _, _, ok := ParseAuthorizedKey([]byte(line))
+	if !ok {
+		t.Fatalf("could not parse %q", line)
+	}
+	return out.(PublicKey)
+}
+
+func checkKnownHosts(k *KnownHosts, addr string, key PublicKey) error {
+	return k.Check(addr, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}, key.PublicKeyAlgo(), MarshalPublicKey(key))
+}
+
+func TestWildcardMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "example.org", false},
+		{"*.example.com", "a.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"host?", "host1", true},
+		{"host?", "host12", false},
+		{"*", "", true},
+		{"[*]:2222", "[example.org]:2222", true},
+	} {
+		if got := wildcardMatch(c.pattern, c.s); got != c.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", c.pattern, c.s, got, c.want)
+		}
+	}
+}
+
+func TestKnownHostsPatterns(t *testing.T) {
+	rsaLine := strings.TrimSpace(string(MarshalAuthorizedKey(rsaKey.PublicKey())))
+	k, err := ParseKnownHosts([]byte(`# comment
+*.example.com,!bad.example.com ` + rsaLine + `
+[other.example.org]:2222 ` + rsaLine + `
+`))
+	if err != nil {
+		t.Fatalf("ParseKnownHosts: %v", err)
+	}
+
+	for _, c := range []struct {
+		addr string
+		ok   bool
+	}{
+		{"good.example.com:22", true},
+		{"GOOD.Example.COM:22", true},
+		{"bad.example.com:22", false},
+		{"good.example.com:2222", false},
+		{"other.example.org:2222", true},
+		{"other.example.org:22", false},
+	} {
+		err := checkKnownHosts(k, c.addr, rsaKey.PublicKey())
+		if (err == nil) != c.ok {
+			t.Errorf("Check(%q): got %v, want ok=%v", c.addr, err, c.ok)
+		}
+	}
+}
+
+func TestKnownHostsHashed(t *testing.T) {
+	k, err := ParseKnownHosts([]byte(testHashedHosts))
+	if err != nil {
+		t.Fatalf("ParseKnownHosts: %v", err)
+	}
+	key := parseTestKey(t, testHostKeyLine)
+	for _, addr := range []string{"example.com:22", "example.org:2222"} {
+		if err := checkKnownHosts(k, addr, key); err != nil {
+			t.Errorf("Check(%q): %v", addr, err)
+		}
+	}
+	if err := checkKnownHosts(k, "example.org:22", key); err == nil {
+		t.Errorf("Check succeeded for unlisted host")
+	}
+
+	h, err := HashHostname("example.net")
+	if err != nil {
+		t.Fatalf("HashHostname: %v", err)
+	}
+	k, err = ParseKnownHosts([]byte(h + " " + testHostKeyLine))
+	if err != nil {
+		t.Fatalf("ParseKnownHosts: %v", err)
+	}
+	if err := checkKnownHosts(k, "example.net:22", key); err != nil {
+		t.Errorf("Check of HashHostname entry: %v", err)
+	}
+}
+
+func TestKnownHostsErrors(t *testing.T) {
+	k, err := ParseKnownHosts([]byte("example.com " + testHostKeyLine + "\n"))
+	if err != nil {
+		t.Fatalf("ParseKnownHosts: %v", err)
+	}
+
+	err = checkKnownHosts(k, "example.com:22", rsaKey.PublicKey())
+	if e, ok := err.(*HostKeyError); !ok || !e.Changed() || len(e.Known) != 1 {
+		t.Errorf("got %v, want changed host key error", err)
+	}
+
+	err = checkKnownHosts(k, "example.org:22", rsaKey.PublicKey())
+	if e, ok := err.(*HostKeyError); !ok || !e.Unknown() {
+		t.Errorf("got %v, want unknown host key error", err)
+	}
+
+	k, err = ParseKnownHosts([]byte("@revoked * " + testHostKeyLine + "\nexample.com " + testHostKeyLine + "\n"))
+	if err != nil {
+		t.Fatalf("ParseKnownHosts: %v", err)
+	}
+	err = checkKnownHosts(k, "example.com:22", parseTestKey(t, testHostKeyLine))
+	if e, ok := err.(*HostKeyError); !ok || !e.Revoked {
+		t.Errorf("got %v, want revoked host key error", err)
+	}
+
+}
+
+func TestKnownHostsSkipsBadLines(t *testing.T) {
+	k, err := ParseKnownHosts([]byte(`@bogus example.org ` + testHostKeyLine + `
+example.org ssh-rsa
+example.org 1024 35 1234567890
+example.org ssh-rsa !!!notbase64!!!
+|1|bogus ` + testHostKeyLine + `
+example.com ` + testHostKeyLine + `
+`))
+	if err != nil {
+		t.Fatalf("ParseKnownHosts: %v", err)
+	}
+	key := parseTestKey(t, testHostKeyLine)
+	if err := checkKnownHosts(k, "example.com:22", key); err != nil {
+		t.Errorf("Check of entry after bad lines: %v", err)
+	}
+	err = checkKnownHosts(k, "example.org:22", key)
+	if e, ok := err.(*HostKeyError); !ok || !e.Unknown() {
+		t.Errorf("got %v, want unknown host key error", err)
+	}
+}
+
+func TestKnownHostsCertAuthority(t *testing.T) {
+	out, _, ok := parseAuthorizedKey([]byte(strings.SplitN(testHostCert, " ", 2)[1]))
+	if !ok {
+		t.Fatalf("could not parse host certificate")
+	}
+	cert := out.(*OpenSSHCertV01)
+	if cert.Serial != 7 || cert.KeyId != "hostid" || cert.Type != HostCert || !cert.ValidBefore.Equal(CertTimeInfinity) {
+		t.Errorf("unexpected certificate contents: %+v", cert)
+	}
+	if !cert.validSignature() {
+		t.Fatalf("signature of ssh-keygen certificate does not verify")
+	}
+
+	k, err := ParseKnownHosts([]byte("@cert-authority *.com " + testCAKeyLine + "\n"))
+	if err != nil {
+		t.Fatalf("ParseKnownHosts: %v", err)
+	}
+	if err := checkKnownHosts(k, "example.com:22", cert); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+	// Principal mismatch.
+	if err := checkKnownHosts(k, "other.com:22", cert); err == nil {
+		t.Errorf("Check succeeded for host not in principals")
+	}
+	// CA not trusted for this host.
+	if err := checkKnownHosts(k, "example.org:22", cert); err == nil {
+		t.Errorf("Check succeeded for host without trusted CA")
+	}
+
+	// A certificate we sign ourselves, which expired.
+	c2 := *cert
+	c2.ValidPrincipals = nil
+	c2.ValidBefore = time.Now().Add(-time.Hour)
+	signCert(t, &c2, rsaKey)
+
+	k, err = ParseKnownHosts([]byte("@cert-authority * " + strings.TrimSpace(string(MarshalAuthorizedKey(rsaKey.PublicKey())))))
+	if err != nil {
+		t.Fatalf("ParseKnownHosts: %v", err)
+	}
+	if err := checkKnownHosts(k, "example.com:22", &c2); err == nil {
+		t.Errorf("Check succeeded for expired certificate")
+	}
+	k.Clock = func() time.Time { return c2.ValidBefore.Add(-time.Minute) }
+	if err := checkKnownHosts(k, "example.com:22", &c2); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+}
+
+func TestKnownHostsAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knownhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_hosts")
+
+	for _, hash := range []bool{false, true} {
+		os.Remove(path)
+		k, err := LoadKnownHosts(path)
+		if err != nil {
+			t.Fatalf("LoadKnownHosts: %v", err)
+		}
+		k.HashHostnames = hash
+
+		key := rsaKey.PublicKey()
+		err = checkKnownHosts(k, "example.com:2222", key)
+		if e, ok := err.(*HostKeyError); !ok || !e.Unknown() {
+			t.Fatalf("got %v, want unknown host key error", err)
+		}
+		if err := k.Add("example.com:2222", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 2222}, key); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+		if err := checkKnownHosts(k, "example.com:2222", key); err != nil {
+			t.Errorf("Check after Add: %v", err)
+		}
+
+		k, err = LoadKnownHosts(path)
+		if err != nil {
+			t.Fatalf("LoadKnownHosts: %v", err)
+		}
+		if err := checkKnownHosts(k, "example.com:2222", key); err != nil {
+			t.Errorf("Check after reload: %v", err)
+		}
+		data, _ := ioutil.ReadFile(path)
+		if hashed := strings.HasPrefix(string(data), hashedHostPrefix); hashed != hash {
+			t.Errorf("got file %q, want hashed=%v", data, hash)
+		}
+	}
+}
+
+func TestKnownHostsLine(t *testing.T) {
+	got := KnownHostsLine([]string{"Example.com:22", "example.org:2222"}, rsaKey.PublicKey())
+	want := "example.com,[example.org]:2222 " + strings.TrimSpace(string(MarshalAuthorizedKey(rsaKey.PublicKey())))
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -9,12 +9,17 @@ package ssh
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"hash"
 )
 
 type macMode struct {
 	keySize int
-	new     func(key []byte) hash.Hash
+	// etm is set for the encrypt-then-MAC modes, which MAC the
+	// ciphertext and leave the packet length unencrypted.
+	etm bool
+	new func(key []byte) hash.Hash
 }
 
 // truncatingMAC wraps around a hash.Hash and truncates the output digest to
@@ -45,14 +50,35 @@ func (t truncatingMAC) BlockSize() int { return t.hmac.BlockSize() }
 
 // Specifies a default set of MAC algorithms and a preference order.
 // This is based on RFC 4253, section 6.4, with the removal of the
-// hmac-md5 variants as they have reached the end of their useful life.
-var DefaultMACOrder = []string{"hmac-sha1", "hmac-sha1-96"}
+// hmac-md5 variants as they have reached the end of their useful life,
+// and the addition of the SHA-2 MACs of RFC 6668 and OpenSSH's
+// encrypt-then-MAC variants, which are preferred.
+var DefaultMACOrder = []string{
+	"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+	"hmac-sha2-256", "hmac-sha2-512",
+	"hmac-sha1-etm@openssh.com", "hmac-sha1", "hmac-sha1-96",
+}
 
 var macModes = map[string]*macMode{
-	"hmac-sha1": {20, func(key []byte) hash.Hash {
+	"hmac-sha2-512-etm@openssh.com": {64, true, func(key []byte) hash.Hash {
+		return hmac.New(sha512.New, key)
+	}},
+	"hmac-sha2-256-etm@openssh.com": {32, true, func(key []byte) hash.Hash {
+		return hmac.New(sha256.New, key)
+	}},
+	"hmac-sha2-512": {64, false, func(key []byte) hash.Hash {
+		return hmac.New(sha512.New, key)
+	}},
+	"hmac-sha2-256": {32, false, func(key []byte) hash.Hash {
+		return hmac.New(sha256.New, key)
+	}},
+	"hmac-sha1-etm@openssh.com": {20, true, func(key []byte) hash.Hash {
+		return hmac.New(sha1.New, key)
+	}},
+	"hmac-sha1": {20, false, func(key []byte) hash.Hash {
 		return hmac.New(sha1.New, key)
 	}},
-	"hmac-sha1-96": {20, func(key []byte) hash.Hash {
+	"hmac-sha1-96": {20, false, func(key []byte) hash.Hash {
 		return truncatingMAC{12, hmac.New(sha1.New, key)}
 	}},
 }
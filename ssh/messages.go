@@ -10,6 +10,7 @@ import (
 	"io"
 	"math/big"
 	"reflect"
+	"sort"
 )
 
 // These are SSH message type numbers. They are scattered around several
@@ -21,6 +22,7 @@ const (
 	msgDebug          = 4
 	msgServiceRequest = 5
 	msgServiceAccept  = 6
+	msgExtInfo        = 7
 
 	msgKexInit = 20
 	msgNewKeys = 21
@@ -32,6 +34,12 @@ const (
 	msgKexECDHInit  = 30
 	msgKexECDHReply = 31
 
+	// Diffie-Hellman group exchange
+	msgKexDHGexGroup   = 31
+	msgKexDHGexInit    = 32
+	msgKexDHGexReply   = 33
+	msgKexDHGexRequest = 34
+
 	// Standard authentication messages
 	msgUserAuthRequest  = 50
 	msgUserAuthFailure  = 51
@@ -75,6 +83,59 @@ type disconnectMsg struct {
 	Language string
 }
 
+// See RFC 8308, section 2.3. Payload holds NumExtensions pairs of
+// extension name and value.
+type extInfoMsg struct {
+	NumExtensions uint32
+	Payload       []byte `ssh:"rest"`
+}
+
+// These are the names used in extension negotiation, see RFC 8308.
+const (
+	extInfoClient    = "ext-info-c"
+	extServerSigAlgs = "server-sig-algs"
+)
+
+// marshalExtInfo returns an SSH_MSG_EXT_INFO message carrying the
+// given extensions.
+func marshalExtInfo(extensions map[string]string) []byte {
+	names := make([]string, 0, len(extensions))
+	for name := range extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var msg extInfoMsg
+	for _, name := range names {
+		msg.Payload = appendString(msg.Payload, name)
+		msg.Payload = appendString(msg.Payload, extensions[name])
+	}
+	msg.NumExtensions = uint32(len(names))
+	return marshal(msgExtInfo, msg)
+}
+
+// parseExtInfo parses an SSH_MSG_EXT_INFO message.
+func parseExtInfo(packet []byte) (map[string]string, error) {
+	var msg extInfoMsg
+	if err := unmarshal(&msg, packet, msgExtInfo); err != nil {
+		return nil, err
+	}
+	extensions := make(map[string]string)
+	payload := msg.Payload
+	for i := uint32(0); i < msg.NumExtensions; i++ {
+		var name, value []byte
+		var ok bool
+		if name, payload, ok = parseString(payload); !ok {
+			return nil, ParseError{msgExtInfo}
+		}
+		if value, payload, ok = parseString(payload); !ok {
+			return nil, ParseError{msgExtInfo}
+		}
+		extensions[string(name)] = string(value)
+	}
+	return extensions, nil
+}
+
 // See RFC 4253, section 7.1.
 type kexInitMsg struct {
 	Cookie                  [16]byte
@@ -113,6 +174,31 @@ type kexDHReplyMsg struct {
 	Signature []byte
 }
 
+// See RFC 4419, section 3.
+type kexDHGexRequestMsg struct {
+	MinBits       uint32
+	PreferredBits uint32
+	MaxBits       uint32
+}
+
+// See RFC 4419, section 3.
+type kexDHGexGroupMsg struct {
+	P *big.Int
+	G *big.Int
+}
+
+// See RFC 4419, section 3.
+type kexDHGexInitMsg struct {
+	X *big.Int
+}
+
+// See RFC 4419, section 3.
+type kexDHGexReplyMsg struct {
+	HostKey   []byte
+	Y         *big.Int
+	Signature []byte
+}
+
 // See RFC 4253, section 10.
 type serviceRequestMsg struct {
 	Service string
@@ -203,6 +289,7 @@ type channelEOFMsg struct {
 type globalRequestMsg struct {
 	Type      string
 	WantReply bool
+	Data      []byte `ssh:"rest"`
 }
 
 // See RFC 4254, section 4
@@ -0,0 +1,140 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Default modulus sizes, in bits, that a client asks for in a
+// diffie-hellman-group-exchange-sha256 key exchange.
+const (
+	defaultGroupExchangeMin       = 2048
+	defaultGroupExchangePreferred = 3072
+	defaultGroupExchangeMax       = 8192
+)
+
+// These are the values of the type and tests fields of the OpenSSH
+// moduli file that matter to us.
+const (
+	moduliTypeSafe      = 2
+	moduliTestComposite = 0x01
+)
+
+type modulus struct {
+	bits int
+	g, p *big.Int
+}
+
+// Moduli is a set of Diffie-Hellman groups for the server side of
+// diffie-hellman-group-exchange-sha256, as found in OpenSSH's moduli
+// file. Its Group method is suitable for ServerConfig.GroupExchangeGroup.
+type Moduli struct {
+	moduli []modulus
+}
+
+// ParseModuli parses the contents of an OpenSSH moduli file (see
+// moduli(5)). Entries that are not safe primes or that failed the
+// primality tests are skipped.
+func ParseModuli(data []byte) (*Moduli, error) {
+	m := new(Moduli)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 7 {
+			return nil, fmt.Errorf("ssh: moduli line %d: got %d fields, want 7", lineNum, len(f))
+		}
+		typ, err1 := strconv.Atoi(f[1])
+		tests, err2 := strconv.Atoi(f[2])
+		size, err3 := strconv.Atoi(f[4])
+		g, ok1 := new(big.Int).SetString(f[5], 16)
+		p, ok2 := new(big.Int).SetString(f[6], 16)
+		if err1 != nil || err2 != nil || err3 != nil || !ok1 || !ok2 {
+			return nil, fmt.Errorf("ssh: moduli line %d: malformed entry", lineNum)
+		}
+		// The size field is one less than the modulus length.
+		if p.BitLen() != size+1 {
+			return nil, fmt.Errorf("ssh: moduli line %d: modulus has %d bits, want %d", lineNum, p.BitLen(), size+1)
+		}
+		if typ != moduliTypeSafe || tests == 0 || tests&moduliTestComposite != 0 {
+			continue
+		}
+		m.moduli = append(m.moduli, modulus{p.BitLen(), g, p})
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Group returns a group whose modulus is between min and max bits
+// long. Like OpenSSH, it picks the smallest size of at least
+// preferred bits, or failing that the largest size available, and
+// chooses at random among the groups of that size.
+func (m *Moduli) Group(min, preferred, max int) (g, p *big.Int, err error) {
+	best := 0
+	for _, mod := range m.moduli {
+		if mod.bits < min || mod.bits > max {
+			continue
+		}
+		if (mod.bits >= preferred && (best < preferred || mod.bits < best)) ||
+			(mod.bits < preferred && mod.bits > best) {
+			best = mod.bits
+		}
+	}
+	var candidates []modulus
+	for _, mod := range m.moduli {
+		if mod.bits == best {
+			candidates = append(candidates, mod)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil, fmt.Errorf("ssh: no modulus of %d to %d bits", min, max)
+	}
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(candidates))))
+	if err != nil {
+		return nil, nil, err
+	}
+	mod := candidates[i.Int64()]
+	return mod.g, mod.p, nil
+}
+
+// checkGroupExchangeGroup validates the group the server chose for
+// the bounds the client asked for.
+func checkGroupExchangeGroup(g, p *big.Int, min, max int) error {
+	if p.BitLen() < min || p.BitLen() > max {
+		return fmt.Errorf("ssh: server offered a %d bit modulus, want %d to %d bits", p.BitLen(), min, max)
+	}
+	if p.Bit(0) == 0 {
+		return errors.New("ssh: server offered an even modulus")
+	}
+	pMinus1 := new(big.Int).Sub(p, bigOne)
+	if g.Cmp(bigOne) <= 0 || g.Cmp(pMinus1) >= 0 {
+		return errors.New("ssh: server offered an invalid generator")
+	}
+	return nil
+}
+
+// groupExchangeExponent picks a random private exponent in [2, (p-1)/2).
+func groupExchangeExponent(random io.Reader, p *big.Int) (*big.Int, error) {
+	q := new(big.Int).Rsh(p, 1)
+	x, err := rand.Int(random, q.Sub(q, big.NewInt(2)))
+	if err != nil {
+		return nil, err
+	}
+	return x.Add(x, big.NewInt(2)), nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+// testModuli returns a moduli file holding the Oakley groups 2 and 14,
+// followed by copies of them that must be skipped.
+func testModuli() string {
+	dhGroup1Once.Do(initDHGroup1)
+	dhGroup14Once.Do(initDHGroup14)
+	line := func(typ, tests int, p *big.Int) string {
+		return fmt.Sprintf("20130101000000 %d %d 100 %d 2 %X\n", typ, tests, p.BitLen()-1, p)
+	}
+	return "# Time Type Tests Tries Size Generator Modulus\n" +
+		line(2, 6, dhGroup1.p) +
+		line(2, 6, dhGroup14.p) +
+		line(4, 6, dhGroup14.p) + // not a safe prime
+		line(2, 7, dhGroup1.p) // composite
+}
+
+func TestParseModuli(t *testing.T) {
+	m, err := ParseModuli([]byte(testModuli()))
+	if err != nil {
+		t.Fatalf("ParseModuli: %v", err)
+	}
+	if len(m.moduli) != 2 {
+		t.Fatalf("got %d moduli, want 2", len(m.moduli))
+	}
+
+	for _, c := range []struct {
+		min, preferred, max int
+		want                int
+	}{
+		{1024, 1024, 8192, 1024},
+		{1024, 1536, 8192, 2048},
+		{1024, 4096, 8192, 2048},
+		{2048, 2048, 2048, 2048},
+		{512, 512, 1024, 1024},
+		{3072, 3072, 8192, 0},
+	} {
+		g, p, err := m.Group(c.min, c.preferred, c.max)
+		if c.want == 0 {
+			if err == nil {
+				t.Errorf("Group(%d, %d, %d) succeeded", c.min, c.preferred, c.max)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Group(%d, %d, %d): %v", c.min, c.preferred, c.max, err)
+			continue
+		}
+		if p.BitLen() != c.want || g.Int64() != 2 {
+			t.Errorf("Group(%d, %d, %d) = %d bit modulus, want %d", c.min, c.preferred, c.max, p.BitLen(), c.want)
+		}
+	}
+
+	for _, bad := range []string{
+		"20130101000000 2 6 100 2047 2\n",
+		"20130101000000 2 6 100 1023 2 zz\n",
+		fmt.Sprintf("20130101000000 2 6 100 2047 2 %X\n", dhGroup1.p),
+	} {
+		if _, err := ParseModuli([]byte(bad)); err == nil {
+			t.Errorf("ParseModuli(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestKexGroupExchange(t *testing.T) {
+	m, err := ParseModuli([]byte(testModuli()))
+	if err != nil {
+		t.Fatalf("ParseModuli: %v", err)
+	}
+	crypto := CryptoConfig{KeyExchanges: []string{kexAlgoDHGEXSHA256}}
+	serverConfig := &ServerConfig{
+		PasswordCallback: func(conn *ServerConn, user, password string) bool {
+			return password == "password"
+		},
+		Crypto: crypto,
+	}
+	if err := serverConfig.SetRSAPrivateKey([]byte(testServerPrivateKey)); err != nil {
+		t.Fatalf("SetRSAPrivateKey: %v", err)
+	}
+	var offered int
+	serverConfig.GroupExchangeGroup = func(min, preferred, max int) (g, p *big.Int, err error) {
+		g, p, err = m.Group(min, preferred, max)
+		if err == nil {
+			offered = p.BitLen()
+		}
+		return
+	}
+	clientConfig := &ClientConfig{
+		User:                       "user",
+		Auth:                       []ClientAuth{ClientAuthPassword(password("password"))},
+		Crypto:                     crypto,
+		GroupExchangeMinBits:       1024,
+		GroupExchangePreferredBits: 1024,
+		GroupExchangeMaxBits:       4096,
+	}
+	if err := testKex(clientConfig, serverConfig); err != nil {
+		t.Fatalf("group exchange: %v", err)
+	}
+	if offered != 1024 {
+		t.Errorf("server offered a %d bit group, want 1024", offered)
+	}
+
+	// The client rejects groups outside the requested bounds.
+	serverConfig.GroupExchangeGroup = func(min, preferred, max int) (g, p *big.Int, err error) {
+		return m.Group(1024, 1024, 1024)
+	}
+	clientConfig.GroupExchangeMinBits = 2048
+	clientConfig.GroupExchangePreferredBits = 2048
+	if err := testKex(clientConfig, serverConfig); err == nil {
+		t.Errorf("client accepted a group that is too small")
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/massiveart/go.crypto/bcrypt_pbkdf"
+)
+
+// OpenSSH's own private key format is described in PROTOCOL.key in the
+// OpenSSH sources. It is written by ssh-keygen as a PEM block of type
+// "OPENSSH PRIVATE KEY".
+
+const (
+	opensshKeyMagic  = "openssh-key-v1\x00"
+	opensshKeyBlock  = "OPENSSH PRIVATE KEY"
+	opensshKeyCipher = "aes256-ctr"
+	opensshKeyKDF    = "bcrypt"
+
+	// opensshKeyRounds is the bcrypt_pbkdf work factor used by
+	// ssh-keygen by default.
+	opensshKeyRounds = 16
+)
+
+// opensshKeyCiphers lists the key sizes of the ciphers that can protect
+// private keys. All of them are AES modes, so the IV and block size is
+// aes.BlockSize.
+var opensshKeyCiphers = map[string]struct {
+	keySize int
+	cbc     bool
+}{
+	"aes128-ctr": {16, false},
+	"aes192-ctr": {24, false},
+	"aes256-ctr": {32, false},
+	"aes128-cbc": {16, true},
+	"aes256-cbc": {32, true},
+}
+
+// opensshKeyCrypt encrypts or decrypts data in place with the named
+// cipher, using a key and IV derived from passphrase.
+func opensshKeyCrypt(name string, passphrase, salt []byte, rounds int, data []byte, decrypt bool) error {
+	mode, ok := opensshKeyCiphers[name]
+	if !ok {
+		return fmt.Errorf("ssh: unsupported private key cipher %q", name)
+	}
+	if len(data)%aes.BlockSize != 0 {
+		return errors.New("ssh: private key has invalid length")
+	}
+	k, err := bcrypt_pbkdf.Key(passphrase, salt, rounds, mode.keySize+aes.BlockSize)
+	if err != nil {
+		return err
+	}
+	key, iv := k[:mode.keySize], k[mode.keySize:]
+	if !mode.cbc {
+		stream, err := newAESCTR(key, iv)
+		if err != nil {
+			return err
+		}
+		stream.XORKeyStream(data, data)
+		return nil
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if decrypt {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	} else {
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	}
+	return nil
+}
+
+// parseOpenSSHPrivateKey parses the contents of an "OPENSSH PRIVATE
+// KEY" PEM block. Encrypted keys are decrypted with passphrase, or
+// rejected with a *PassphraseMissingError if passphrase is empty.
+func parseOpenSSHPrivateKey(in, passphrase []byte) (Signer, error) {
+	if !bytes.HasPrefix(in, []byte(opensshKeyMagic)) {
+		return nil, errors.New("ssh: invalid openssh private key")
+	}
+	in = in[len(opensshKeyMagic):]
+
+	var cipherName, kdfName, kdfOpts, pubKey, priv []byte
+	var numKeys uint32
+	var ok bool
+	if cipherName, in, ok = parseString(in); !ok {
+		return nil, errShortPrivateKey
+	}
+	if kdfName, in, ok = parseString(in); !ok {
+		return nil, errShortPrivateKey
+	}
+	if kdfOpts, in, ok = parseString(in); !ok {
+		return nil, errShortPrivateKey
+	}
+	if numKeys, in, ok = parseUint32(in); !ok {
+		return nil, errShortPrivateKey
+	}
+	if numKeys != 1 {
+		return nil, errors.New("ssh: openssh private key files must contain exactly one key")
+	}
+	if pubKey, in, ok = parseString(in); !ok {
+		return nil, errShortPrivateKey
+	}
+	if priv, in, ok = parseString(in); !ok || len(in) != 0 {
+		return nil, errShortPrivateKey
+	}
+
+	encrypted := string(cipherName) != "none"
+	if encrypted {
+		if len(passphrase) == 0 {
+			pub, _, _ := ParsePublicKey(pubKey)
+			return nil, &PassphraseMissingError{PublicKey: pub}
+		}
+		if string(kdfName) != opensshKeyKDF {
+			return nil, fmt.Errorf("ssh: unsupported private key KDF %q", kdfName)
+		}
+		salt, opts, ok := parseString(kdfOpts)
+		if !ok {
+			return nil, errShortPrivateKey
+		}
+		rounds, opts, ok := parseUint32(opts)
+		if !ok || len(opts) != 0 {
+			return nil, errShortPrivateKey
+		}
+		priv = append([]byte(nil), priv...)
+		if err := opensshKeyCrypt(string(cipherName), passphrase, salt, int(rounds), priv, true); err != nil {
+			return nil, err
+		}
+	} else if string(kdfName) != "none" || len(kdfOpts) != 0 {
+		return nil, errors.New("ssh: unencrypted openssh private key has KDF options")
+	}
+
+	// The check values are random, but identical in a correctly
+	// decrypted key.
+	check1, priv, ok := parseUint32(priv)
+	if !ok {
+		return nil, errShortPrivateKey
+	}
+	check2, priv, ok := parseUint32(priv)
+	if !ok {
+		return nil, errShortPrivateKey
+	}
+	if check1 != check2 {
+		if encrypted {
+			return nil, x509.IncorrectPasswordError
+		}
+		return nil, errors.New("ssh: invalid openssh private key")
+	}
+
+	signer, priv, ok := parseAgentPrivateKey(priv)
+	if !ok {
+		return nil, errors.New("ssh: invalid openssh private key")
+	}
+	if _, priv, ok = parseString(priv); !ok {
+		return nil, errShortPrivateKey
+	}
+	for i, b := range priv {
+		if b != byte(i+1) {
+			return nil, errors.New("ssh: invalid openssh private key padding")
+		}
+	}
+	if !bytes.Equal(MarshalPublicKey(signer.PublicKey()), pubKey) {
+		return nil, errors.New("ssh: openssh private key does not match its public key")
+	}
+	return signer, nil
+}
+
+var errShortPrivateKey = errors.New("ssh: openssh private key is truncated")
+
+// MarshalPrivateKey encodes key, which must be a pointer to an rsa, dsa
+// or ecdsa PrivateKey or to an Ed25519 private key, as a PEM block in
+// OpenSSH's private key format, which ssh-keygen and ssh read. If
+// passphrase is not empty, the key is encrypted with aes256-ctr under a
+// key derived from passphrase with bcrypt_pbkdf. Randomness is read
+// from rand.
+func MarshalPrivateKey(rand io.Reader, key interface{}, comment string, passphrase []byte) (*pem.Block, error) {
+	signer, err := NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes, err := marshalAgentPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var check [4]byte
+	if _, err := io.ReadFull(rand, check[:]); err != nil {
+		return nil, err
+	}
+	priv := append(check[:], check[:]...)
+	priv = append(priv, keyBytes...)
+	priv = appendString(priv, comment)
+
+	cipherName, kdfName, kdfOpts := "none", "none", ""
+	blockSize := 8
+	var salt []byte
+	if len(passphrase) > 0 {
+		cipherName, kdfName = opensshKeyCipher, opensshKeyKDF
+		blockSize = aes.BlockSize
+		salt = make([]byte, 16)
+		if _, err := io.ReadFull(rand, salt); err != nil {
+			return nil, err
+		}
+		kdfOpts = string(appendU32(appendString(nil, string(salt)), opensshKeyRounds))
+	}
+	for i := 1; len(priv)%blockSize != 0; i++ {
+		priv = append(priv, byte(i))
+	}
+	if len(passphrase) > 0 {
+		if err := opensshKeyCrypt(cipherName, passphrase, salt, opensshKeyRounds, priv, false); err != nil {
+			return nil, err
+		}
+	}
+
+	out := []byte(opensshKeyMagic)
+	out = appendString(out, cipherName)
+	out = appendString(out, kdfName)
+	out = appendString(out, kdfOpts)
+	out = appendU32(out, 1)
+	out = appendString(out, string(MarshalPublicKey(signer.PublicKey())))
+	out = appendString(out, string(priv))
+	return &pem.Block{Type: opensshKeyBlock, Bytes: out}, nil
+}
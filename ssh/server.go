@@ -12,9 +12,12 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 
 	_ "crypto/sha1"
@@ -39,7 +42,11 @@ type ServerConfig struct {
 
 	// PublicKeyCallback, if non-nil, is called when a client attempts public
 	// key authentication. It must return true iff the given public key is
-	// valid for the given user.
+	// valid for the given user. The callback may record restrictions for
+	// the key in conn.Permissions; these are retained if authentication
+	// with that key succeeds. CertChecker.Authenticate can be used to
+	// accept OpenSSH user certificates. algo is the type of the key,
+	// such as ssh-rsa, even if the client signs with rsa-sha2-256.
 	PublicKeyCallback func(conn *ServerConn, user, algo string, pubkey []byte) bool
 
 	// KeyboardInteractiveCallback, if non-nil, is called when
@@ -51,8 +58,38 @@ type ServerConfig struct {
 	// unknown.
 	KeyboardInteractiveCallback func(conn *ServerConn, user string, client ClientKeyboardInteractive) bool
 
+	// LocalForwardCallback, if non-nil, is called when the client opens
+	// a direct-tcpip channel, asking the server to connect to host and
+	// port. If it returns false, the channel is rejected; otherwise it
+	// is returned by ServerConn.Accept, and ParseDirectTCPIP decodes its
+	// extra data.
+	LocalForwardCallback func(conn *ServerConn, host string, port uint32) bool
+
+	// RemoteForwardCallback, if non-nil, is called when the client asks
+	// the server to listen on host and port with a tcpip-forward
+	// request. If it returns true, the server listens there until the
+	// request is cancelled or the connection ends, and opens a
+	// forwarded-tcpip channel to the client for every connection. If
+	// RemoteForwardCallback is nil, such requests are refused.
+	RemoteForwardCallback func(conn *ServerConn, host string, port uint32) bool
+
+	// LocalUnixForwardCallback and RemoteUnixForwardCallback are the
+	// counterparts of LocalForwardCallback and RemoteForwardCallback
+	// for unix sockets, called for direct-streamlocal@openssh.com
+	// channels and streamlocal-forward@openssh.com requests. Channels
+	// are decoded with ParseDirectStreamLocal.
+	LocalUnixForwardCallback  func(conn *ServerConn, socketPath string) bool
+	RemoteUnixForwardCallback func(conn *ServerConn, socketPath string) bool
+
 	// Cryptographic-related configuration.
 	Crypto CryptoConfig
+
+	// GroupExchangeGroup, if non-nil, is called to choose the group for
+	// a diffie-hellman-group-exchange-sha256 key exchange with a
+	// modulus of min to max bits, ideally preferred bits. The Group
+	// method of Moduli may be used here. If nil, the 2048 bit group of
+	// diffie-hellman-group14-sha1 is offered.
+	GroupExchangeGroup func(min, preferred, max int) (g, p *big.Int, err error)
 }
 
 func (c *ServerConfig) rand() io.Reader {
@@ -62,8 +99,26 @@ func (c *ServerConfig) rand() io.Reader {
 	return c.Rand
 }
 
+func (c *ServerConfig) groupExchangeGroup(min, preferred, max int) (*dhGroup, error) {
+	if c.GroupExchangeGroup != nil {
+		g, p, err := c.GroupExchangeGroup(min, preferred, max)
+		if err != nil {
+			return nil, err
+		}
+		return &dhGroup{g: g, p: p}, nil
+	}
+	dhGroup14Once.Do(initDHGroup14)
+	if bits := dhGroup14.p.BitLen(); bits < min || bits > max {
+		return nil, fmt.Errorf("ssh: no modulus of %d to %d bits", min, max)
+	}
+	return dhGroup14, nil
+}
+
 // AddHostKey adds a private key as a host key. If an existing host
-// key exists with the same algorithm, it is overwritten.
+// key exists with the same algorithm, it is overwritten. The server
+// offers the algorithms of all its host keys, so RSA, DSA and ECDSA
+// keys, and host certificates made with NewCertSigner, can be used
+// side by side.
 func (s *ServerConfig) AddHostKey(key Signer) {
 	for i, k := range s.hostKeys {
 		if k.PublicKey().PublicKeyAlgo() == key.PublicKey().PublicKeyAlgo() {
@@ -91,13 +146,142 @@ func (s *ServerConfig) SetRSAPrivateKey(pemBytes []byte) error {
 // cachedPubKey contains the results of querying whether a public key is
 // acceptable for a user. The cache only applies to a single ServerConn.
 type cachedPubKey struct {
-	user, algo string
-	pubKey     []byte
-	result     bool
+	user, algo  string
+	pubKey      []byte
+	result      bool
+	permissions Permissions
 }
 
 const maxCachedPubKeys = 16
 
+// Permissions holds restrictions that the authentication callbacks
+// attach to a connection, such as the options of an OpenSSH
+// certificate or authorized_keys entry. ServerConn enforces them as
+// channels are opened and requests arrive:
+//
+// Port forwarding, pty-req, x11-req and auth-agent-req@openssh.com
+// requests are refused unless the corresponding permit-* extension is
+// present. If Extensions is nil, everything is permitted.
+//
+// If the force-command option is set, shell, exec and subsystem
+// requests are turned into an exec request for the forced command,
+// preceded by an env request setting SSH_ORIGINAL_COMMAND to the
+// command the client asked for, if any.
+//
+// Other options, such as permit-user-rc, are left to the application.
+type Permissions struct {
+	// CriticalOptions maps option names to their values, e.g.
+	// "force-command" to the command to run, or "source-address"
+	// to the list of permitted client networks.
+	CriticalOptions map[string]string
+
+	// Extensions maps extension names to their values, e.g.
+	// "permit-pty" to "".
+	Extensions map[string]string
+
+	// PermitOpen, if non-empty, lists the "host:port" destinations
+	// that direct-tcpip channels may connect to. Either part may be
+	// "*".
+	PermitOpen []string
+
+	// Environment holds "NAME=value" pairs, which are passed to the
+	// application as env requests ahead of the first shell, exec or
+	// subsystem request of each session. Entries without a name are
+	// skipped.
+	Environment []string
+}
+
+// permits reports whether the permit-* extension ext is granted.
+func (p *Permissions) permits(ext string) bool {
+	if p.Extensions == nil {
+		return true
+	}
+	_, ok := p.Extensions[ext]
+	return ok
+}
+
+// permitsOpen reports whether port forwarding to host and port is
+// allowed.
+func (p *Permissions) permitsOpen(host string, port uint32) bool {
+	if !p.permits(CertExtPermitPortForwarding) {
+		return false
+	}
+	if len(p.PermitOpen) == 0 {
+		return true
+	}
+	for _, dest := range p.PermitOpen {
+		h, pt, err := net.SplitHostPort(dest)
+		if err != nil {
+			continue
+		}
+		if (h == "*" || strings.EqualFold(h, host)) && (pt == "*" || pt == strconv.Itoa(int(port))) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestExtensions maps channel requests to the extensions that
+// permit them.
+var requestExtensions = map[string]string{
+	"pty-req":                    CertExtPermitPTY,
+	"x11-req":                    CertExtPermitX11Forwarding,
+	"auth-agent-req@openssh.com": CertExtPermitAgentForwarding,
+}
+
+// filterChannelRequest applies s.Permissions to a request on channel
+// c. It returns the requests to deliver to the application, which
+// are none if msg is refused.
+func (s *ServerConn) filterChannelRequest(c *serverChan, msg *channelRequestMsg) ([]*channelRequestMsg, error) {
+	if ext, ok := requestExtensions[msg.Request]; ok && !s.Permissions.permits(ext) {
+		if !msg.WantReply {
+			return nil, nil
+		}
+		return nil, c.writePacket(marshal(msgChannelFailure, channelRequestFailureMsg{
+			PeersId: c.remoteId,
+		}))
+	}
+
+	switch msg.Request {
+	case "shell", "exec", "subsystem":
+	default:
+		return []*channelRequestMsg{msg}, nil
+	}
+
+	var reqs []*channelRequestMsg
+	env := func(name, value string) {
+		reqs = append(reqs, &channelRequestMsg{
+			PeersId:             msg.PeersId,
+			Request:             "env",
+			RequestSpecificData: appendString(appendString(nil, name), value),
+		})
+	}
+	if !c.sentEnvironment {
+		c.sentEnvironment = true
+		for _, kv := range s.Permissions.Environment {
+			i := strings.Index(kv, "=")
+			if i <= 0 {
+				continue
+			}
+			env(kv[:i], kv[i+1:])
+		}
+	}
+
+	cmd, ok := s.Permissions.CriticalOptions[CertOptionForceCommand]
+	if !ok {
+		return append(reqs, msg), nil
+	}
+	if msg.Request != "shell" {
+		if orig, _, ok := parseString(msg.RequestSpecificData); ok {
+			env("SSH_ORIGINAL_COMMAND", string(orig))
+		}
+	}
+	forced := *msg
+	forced.Request = "exec"
+	forced.RequestSpecificData = appendString(nil, cmd)
+	return append(reqs, &forced), nil
+}
+
 // A ServerConn represents an incoming connection.
 type ServerConn struct {
 	*transport
@@ -125,6 +309,14 @@ type ServerConn struct {
 	// Handshake is called. It should not be modified.
 	ClientVersion []byte
 
+	// Permissions holds the restrictions recorded by the public key
+	// callback for the key the client authenticated with.
+	Permissions Permissions
+
+	// forwards holds the listeners of the client's tcpip-forward
+	// requests.
+	forwards remoteForwards
+
 	// Initial H used for the session ID. Once assigned this must not change
 	// even during subsequent key exchanges.
 	sessionId []byte
@@ -134,7 +326,7 @@ type ServerConn struct {
 // using c as the underlying transport.
 func Server(c net.Conn, config *ServerConfig) *ServerConn {
 	return &ServerConn{
-		transport: newTransport(c, config.rand()),
+		transport: newTransport(c, config.rand(), &config.Crypto),
 		channels:  make(map[uint32]*serverChan),
 		config:    config,
 	}
@@ -142,7 +334,7 @@ func Server(c net.Conn, config *ServerConfig) *ServerConn {
 
 // kexECDH performs Elliptic Curve Diffie-Hellman key agreement on a
 // ServerConnection, as documented in RFC 5656, section 4.
-func (s *ServerConn) kexECDH(curve elliptic.Curve, magics *handshakeMagics, priv Signer) (result *kexResult, err error) {
+func (s *ServerConn) kexECDH(curve elliptic.Curve, magics *handshakeMagics, priv Signer, sigAlgo string) (result *kexResult, err error) {
 	packet, err := s.readPacket()
 	if err != nil {
 		return
@@ -195,7 +387,7 @@ func (s *ServerConn) kexECDH(curve elliptic.Curve, magics *handshakeMagics, priv
 
 	// H is already a hash, but the hostkey signing will apply its
 	// own key specific hash algorithm.
-	sig, err := signAndMarshal(priv, s.config.rand(), H)
+	sig, err := signAndMarshal(priv, sigAlgo, s.config.rand(), H)
 	if err != nil {
 		return nil, err
 	}
@@ -219,6 +411,151 @@ func (s *ServerConn) kexECDH(curve elliptic.Curve, magics *handshakeMagics, priv
 	}, nil
 }
 
+// kexCurve25519 performs curve25519-sha256 key agreement on a
+// ServerConnection.
+func (s *ServerConn) kexCurve25519(magics *handshakeMagics, priv Signer, sigAlgo string) (result *kexResult, err error) {
+	packet, err := s.readPacket()
+	if err != nil {
+		return
+	}
+
+	var kexInit kexECDHInitMsg
+	if err = unmarshal(&kexInit, packet, msgKexECDHInit); err != nil {
+		return
+	}
+
+	var kp curve25519KeyPair
+	if err = kp.generate(s.config.rand()); err != nil {
+		return nil, err
+	}
+
+	K, err := kp.sharedSecret(kexInit.ClientPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyBytes := MarshalPublicKey(priv.PublicKey())
+
+	h := crypto.SHA256.New()
+	writeString(h, magics.clientVersion)
+	writeString(h, magics.serverVersion)
+	writeString(h, magics.clientKexInit)
+	writeString(h, magics.serverKexInit)
+	writeString(h, hostKeyBytes)
+	writeString(h, kexInit.ClientPubKey)
+	writeString(h, kp.pub[:])
+	h.Write(K)
+
+	H := h.Sum(nil)
+
+	sig, err := signAndMarshal(priv, sigAlgo, s.config.rand(), H)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := kexECDHReplyMsg{
+		EphemeralPubKey: kp.pub[:],
+		HostKey:         hostKeyBytes,
+		Signature:       sig,
+	}
+	if err := s.writePacket(marshal(msgKexECDHReply, reply)); err != nil {
+		return nil, err
+	}
+
+	return &kexResult{
+		H:       H,
+		K:       K,
+		HostKey: reply.HostKey,
+		Hash:    crypto.SHA256,
+	}, nil
+}
+
+// kexDHGroupExchange performs Diffie-Hellman key agreement on a
+// ServerConnection with a group chosen by the server, as described in
+// RFC 4419.
+func (s *ServerConn) kexDHGroupExchange(hashFunc crypto.Hash, magics *handshakeMagics, priv Signer, sigAlgo string) (result *kexResult, err error) {
+	packet, err := s.readPacket()
+	if err != nil {
+		return
+	}
+	var request kexDHGexRequestMsg
+	if err = unmarshal(&request, packet, msgKexDHGexRequest); err != nil {
+		return
+	}
+	if request.MinBits > request.PreferredBits || request.PreferredBits > request.MaxBits {
+		return nil, errors.New("ssh: invalid group exchange request")
+	}
+
+	group, err := s.config.groupExchangeGroup(int(request.MinBits), int(request.PreferredBits), int(request.MaxBits))
+	if err != nil {
+		return nil, err
+	}
+	if err = s.writePacket(marshal(msgKexDHGexGroup, kexDHGexGroupMsg{P: group.p, G: group.g})); err != nil {
+		return
+	}
+
+	packet, err = s.readPacket()
+	if err != nil {
+		return
+	}
+	var kexInit kexDHGexInitMsg
+	if err = unmarshal(&kexInit, packet, msgKexDHGexInit); err != nil {
+		return
+	}
+
+	y, err := groupExchangeExponent(s.config.rand(), group.p)
+	if err != nil {
+		return
+	}
+	Y := new(big.Int).Exp(group.g, y, group.p)
+	kInt, err := group.diffieHellman(kexInit.X, y)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyBytes := MarshalPublicKey(priv.PublicKey())
+
+	h := hashFunc.New()
+	writeString(h, magics.clientVersion)
+	writeString(h, magics.serverVersion)
+	writeString(h, magics.clientKexInit)
+	writeString(h, magics.serverKexInit)
+	writeString(h, hostKeyBytes)
+	h.Write(appendU32(nil, request.MinBits))
+	h.Write(appendU32(nil, request.PreferredBits))
+	h.Write(appendU32(nil, request.MaxBits))
+	writeInt(h, group.p)
+	writeInt(h, group.g)
+	writeInt(h, kexInit.X)
+	writeInt(h, Y)
+	K := make([]byte, intLength(kInt))
+	marshalInt(K, kInt)
+	h.Write(K)
+
+	H := h.Sum(nil)
+
+	sig, err := signAndMarshal(priv, sigAlgo, s.config.rand(), H)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := kexDHGexReplyMsg{
+		HostKey:   hostKeyBytes,
+		Y:         Y,
+		Signature: sig,
+	}
+	if err = s.writePacket(marshal(msgKexDHGexReply, reply)); err != nil {
+		return
+	}
+
+	return &kexResult{
+		H:       H,
+		K:       K,
+		HostKey: hostKeyBytes,
+		Hash:    hashFunc,
+	}, nil
+}
+
 // validateECPublicKey checks that the point is a valid public key for
 // the given curve. See [SEC1], 3.2.2
 func validateECPublicKey(curve elliptic.Curve, x, y *big.Int) bool {
@@ -250,7 +587,7 @@ func validateECPublicKey(curve elliptic.Curve, x, y *big.Int) bool {
 }
 
 // kexDH performs Diffie-Hellman key agreement on a ServerConnection.
-func (s *ServerConn) kexDH(group *dhGroup, hashFunc crypto.Hash, magics *handshakeMagics, priv Signer) (result *kexResult, err error) {
+func (s *ServerConn) kexDH(group *dhGroup, hashFunc crypto.Hash, magics *handshakeMagics, priv Signer, sigAlgo string) (result *kexResult, err error) {
 	packet, err := s.readPacket()
 	if err != nil {
 		return
@@ -290,7 +627,7 @@ func (s *ServerConn) kexDH(group *dhGroup, hashFunc crypto.Hash, magics *handsha
 
 	// H is already a hash, but the hostkey signing will apply its
 	// own key specific hash algorithm.
-	sig, err := signAndMarshal(priv, s.config.rand(), H)
+	sig, err := signAndMarshal(priv, sigAlgo, s.config.rand(), H)
 	if err != nil {
 		return nil, err
 	}
@@ -311,15 +648,15 @@ func (s *ServerConn) kexDH(group *dhGroup, hashFunc crypto.Hash, magics *handsha
 	}, nil
 }
 
-// signAndMarshal signs the data with the appropriate algorithm,
+// signAndMarshal signs the data with the signature algorithm algo,
 // and serializes the result in SSH wire format.
-func signAndMarshal(k Signer, rand io.Reader, data []byte) ([]byte, error) {
-	sig, err := k.Sign(rand, data)
+func signAndMarshal(k Signer, algo string, rand io.Reader, data []byte) ([]byte, error) {
+	sig, err := signWithAlgorithm(k, rand, data, algo)
 	if err != nil {
 		return nil, err
 	}
 
-	return serializeSignature(k.PublicKey().PrivateKeyAlgo(), sig), nil
+	return serializeSignature(algo, sig), nil
 }
 
 // serverVersion is the fixed identification string that Server will use.
@@ -338,11 +675,20 @@ func (s *ServerConn) Handshake() (err error) {
 	if err != nil {
 		return
 	}
-	if err = s.clientInitHandshake(nil, nil); err != nil {
+
+	s.transport.kexInit = s.kexInitPacket
+	var kexInitPacket, packet []byte
+	if kexInitPacket, err = s.sendKexInit(); err != nil {
+		return
+	}
+	if packet, err = s.readPacket(); err != nil {
+		return
+	}
+	if err = s.keyExchange(kexInitPacket, packet); err != nil {
 		return
 	}
+	s.transport.kex = s.keyExchange
 
-	var packet []byte
 	if packet, err = s.readPacket(); err != nil {
 		return
 	}
@@ -366,37 +712,48 @@ func (s *ServerConn) Handshake() (err error) {
 	return
 }
 
-func (s *ServerConn) clientInitHandshake(clientKexInit *kexInitMsg, clientKexInitPacket []byte) (err error) {
+// kexInitPacket returns the server's KEXINIT message.
+func (s *ServerConn) kexInitPacket() []byte {
 	serverKexInit := kexInitMsg{
 		KexAlgos:                s.config.Crypto.kexes(),
 		CiphersClientServer:     s.config.Crypto.ciphers(),
 		CiphersServerClient:     s.config.Crypto.ciphers(),
 		MACsClientServer:        s.config.Crypto.macs(),
 		MACsServerClient:        s.config.Crypto.macs(),
-		CompressionClientServer: supportedCompressions,
-		CompressionServerClient: supportedCompressions,
+		CompressionClientServer: s.config.Crypto.serverCompressions(),
+		CompressionServerClient: s.config.Crypto.serverCompressions(),
 	}
 	for _, k := range s.config.hostKeys {
+		algos := []string{k.PublicKey().PublicKeyAlgo()}
+		// The SHA-2 signature algorithms are only offered if
+		// the key can sign with them.
+		signer := k
+		if cs, ok := k.(*certSigner); ok {
+			signer = cs.signer
+		}
+		if _, ok := signer.(AlgorithmSigner); ok {
+			algos = hostKeyAlgosFor(k.PublicKey())
+		}
 		serverKexInit.ServerHostKeyAlgos = append(
-			serverKexInit.ServerHostKeyAlgos, k.PublicKey().PublicKeyAlgo())
+			serverKexInit.ServerHostKeyAlgos, algos...)
 	}
 
-	serverKexInitPacket := marshal(msgKexInit, serverKexInit)
-	if err = s.writePacket(serverKexInitPacket); err != nil {
+	return marshal(msgKexInit, serverKexInit)
+}
+
+// keyExchange runs a key exchange, for the initial handshake or a
+// later key change, given the server's and the client's KEXINIT
+// messages.
+func (s *ServerConn) keyExchange(serverKexInitPacket, clientKexInitPacket []byte) (err error) {
+	var clientKexInit, serverKexInit kexInitMsg
+	if err = unmarshal(&serverKexInit, serverKexInitPacket, msgKexInit); err != nil {
 		return
 	}
-
-	if clientKexInitPacket == nil {
-		clientKexInit = new(kexInitMsg)
-		if clientKexInitPacket, err = s.readPacket(); err != nil {
-			return
-		}
-		if err = unmarshal(clientKexInit, clientKexInitPacket, msgKexInit); err != nil {
-			return
-		}
+	if err = unmarshal(&clientKexInit, clientKexInitPacket, msgKexInit); err != nil {
+		return
 	}
 
-	kexAlgo, hostKeyAlgo, ok := findAgreedAlgorithms(s.transport, clientKexInit, &serverKexInit)
+	kexAlgo, hostKeyAlgo, ok := findAgreedAlgorithms(s.transport, &clientKexInit, &serverKexInit)
 	if !ok {
 		return errors.New("ssh: no common algorithms")
 	}
@@ -408,9 +765,10 @@ func (s *ServerConn) clientInitHandshake(clientKexInit *kexInitMsg, clientKexIni
 		}
 	}
 
+	keyAlgo, sigAlgo := splitSigAlgo(hostKeyAlgo)
 	var hostKey Signer
 	for _, k := range s.config.hostKeys {
-		if hostKeyAlgo == k.PublicKey().PublicKeyAlgo() {
+		if keyAlgo == k.PublicKey().PublicKeyAlgo() {
 			hostKey = k
 		}
 	}
@@ -418,23 +776,27 @@ func (s *ServerConn) clientInitHandshake(clientKexInit *kexInitMsg, clientKexIni
 	var magics handshakeMagics
 	magics.serverVersion = serverVersion[:len(serverVersion)-2]
 	magics.clientVersion = s.ClientVersion
-	magics.serverKexInit = marshal(msgKexInit, serverKexInit)
+	magics.serverKexInit = serverKexInitPacket
 	magics.clientKexInit = clientKexInitPacket
 
 	var result *kexResult
 	switch kexAlgo {
+	case kexAlgoCurve25519SHA256, kexAlgoCurve25519SHA256LibSSH:
+		result, err = s.kexCurve25519(&magics, hostKey, sigAlgo)
 	case kexAlgoECDH256:
-		result, err = s.kexECDH(elliptic.P256(), &magics, hostKey)
+		result, err = s.kexECDH(elliptic.P256(), &magics, hostKey, sigAlgo)
 	case kexAlgoECDH384:
-		result, err = s.kexECDH(elliptic.P384(), &magics, hostKey)
+		result, err = s.kexECDH(elliptic.P384(), &magics, hostKey, sigAlgo)
 	case kexAlgoECDH521:
-		result, err = s.kexECDH(elliptic.P521(), &magics, hostKey)
+		result, err = s.kexECDH(elliptic.P521(), &magics, hostKey, sigAlgo)
+	case kexAlgoDHGEXSHA256:
+		result, err = s.kexDHGroupExchange(crypto.SHA256, &magics, hostKey, sigAlgo)
 	case kexAlgoDH14SHA1:
 		dhGroup14Once.Do(initDHGroup14)
-		result, err = s.kexDH(dhGroup14, crypto.SHA1, &magics, hostKey)
+		result, err = s.kexDH(dhGroup14, crypto.SHA1, &magics, hostKey, sigAlgo)
 	case kexAlgoDH1SHA1:
 		dhGroup1Once.Do(initDHGroup1)
-		result, err = s.kexDH(dhGroup1, crypto.SHA1, &magics, hostKey)
+		result, err = s.kexDH(dhGroup1, crypto.SHA1, &magics, hostKey, sigAlgo)
 	default:
 		err = errors.New("ssh: unexpected key exchange algorithm " + kexAlgo)
 	}
@@ -442,36 +804,46 @@ func (s *ServerConn) clientInitHandshake(clientKexInit *kexInitMsg, clientKexIni
 		return
 	}
 	// sessionId must only be assigned during initial handshake.
-	if s.sessionId == nil {
+	firstKex := s.sessionId == nil
+	if firstKex {
 		s.sessionId = result.H
 	}
 
-	var packet []byte
-
-	if err = s.writePacket([]byte{msgNewKeys}); err != nil {
+	if err = s.transport.writer.sendNewKeys(serverKeys, result.K, result.H, s.sessionId, result.Hash); err != nil {
 		return
 	}
-	if err = s.transport.writer.setupKeys(serverKeys, result.K, result.H, s.sessionId, result.Hash); err != nil {
-		return
+	// The extension negotiation message must directly follow the
+	// first NEWKEYS, see RFC 8308, section 2.4.
+	if firstKex && contains(clientKexInit.KexAlgos, extInfoClient) {
+		if err = s.writePacket(marshalExtInfo(map[string]string{
+			extServerSigAlgs: strings.Join(serverSigAlgs, ","),
+		})); err != nil {
+			return
+		}
 	}
 
+	var packet []byte
 	if packet, err = s.readPacket(); err != nil {
 		return
 	}
 	if packet[0] != msgNewKeys {
 		return UnexpectedMessageError{msgNewKeys, packet[0]}
 	}
-	if err = s.transport.reader.setupKeys(clientKeys, result.K, result.H, s.sessionId, result.Hash); err != nil {
-		return
-	}
+	return s.transport.reader.setupKeys(clientKeys, result.K, result.H, s.sessionId, result.Hash)
+}
 
-	return
+// RequestKeyChange starts a new key exchange with the client, unless
+// one is already in progress, and waits until the new keys are used
+// for sending. Accept must be running in another goroutine to complete
+// the exchange.
+func (s *ServerConn) RequestKeyChange() error {
+	return s.transport.requestKeyChange()
 }
 
 func isAcceptableAlgo(algo string) bool {
 	switch algo {
-	case KeyAlgoRSA, KeyAlgoDSA, KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521,
-		CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01:
+	case KeyAlgoRSA, KeyAlgoDSA, KeyAlgoECDSA256, KeyAlgoECDSA384, KeyAlgoECDSA521, KeyAlgoED25519,
+		CertAlgoRSAv01, CertAlgoDSAv01, CertAlgoECDSA256v01, CertAlgoECDSA384v01, CertAlgoECDSA521v01, CertAlgoED25519v01:
 		return true
 	}
 	return false
@@ -485,6 +857,7 @@ func (s *ServerConn) testPubKey(user, algo string, pubKey []byte) bool {
 
 	for _, c := range s.cachedPubKeys {
 		if c.user == user && c.algo == algo && bytes.Equal(c.pubKey, pubKey) {
+			s.Permissions = c.permissions
 			return c.result
 		}
 	}
@@ -492,10 +865,11 @@ func (s *ServerConn) testPubKey(user, algo string, pubKey []byte) bool {
 	result := s.config.PublicKeyCallback(s, user, algo, pubKey)
 	if len(s.cachedPubKeys) < maxCachedPubKeys {
 		c := cachedPubKey{
-			user:   user,
-			algo:   algo,
-			pubKey: make([]byte, len(pubKey)),
-			result: result,
+			user:        user,
+			algo:        algo,
+			pubKey:      make([]byte, len(pubKey)),
+			result:      result,
+			permissions: s.Permissions,
 		}
 		copy(c.pubKey, pubKey)
 		s.cachedPubKeys = append(s.cachedPubKeys, c)
@@ -522,6 +896,9 @@ userAuthLoop:
 			return errors.New("ssh: client attempted to negotiate for unknown service: " + userAuthReq.Service)
 		}
 
+		// Permissions only survive from the attempt that succeeds.
+		s.Permissions = Permissions{}
+
 		switch userAuthReq.Method {
 		case "none":
 			if s.config.NoClientAuth {
@@ -569,6 +946,9 @@ userAuthLoop:
 				return ParseError{msgUserAuthRequest}
 			}
 			algo := string(algoBytes)
+			// The key type is used for checking the key; for
+			// RSA keys algo also selects the signature hash.
+			keyAlgo, sigAlgo := splitSigAlgo(algo)
 
 			pubKey, payload, ok := parseString(payload)
 			if !ok {
@@ -580,7 +960,7 @@ userAuthLoop:
 				if len(payload) > 0 {
 					return ParseError{msgUserAuthRequest}
 				}
-				if s.testPubKey(userAuthReq.User, algo, pubKey) {
+				if s.testPubKey(userAuthReq.User, keyAlgo, pubKey) {
 					okMsg := userAuthPubKeyOkMsg{
 						Algo:   algo,
 						PubKey: string(pubKey),
@@ -596,11 +976,10 @@ userAuthLoop:
 					return ParseError{msgUserAuthRequest}
 				}
 				// Ensure the public key algo and signature algo
-				// are supported.  Compare the private key
-				// algorithm name that corresponds to algo with
-				// sig.Format.  This is usually the same, but
-				// for certs, the names differ.
-				if !isAcceptableAlgo(algo) || !isAcceptableAlgo(sig.Format) || pubAlgoToPrivAlgo(algo) != sig.Format {
+				// are supported.  The signature must use the
+				// algorithm named by algo.  For certs and for
+				// rsa-sha2-* this differs from the key type.
+				if !isAcceptableAlgo(keyAlgo) || sig.Format != sigAlgo {
 					break
 				}
 				signedData := buildDataSignedForAuth(H, userAuthReq, algoBytes, pubKey)
@@ -608,13 +987,17 @@ userAuthLoop:
 				if !ok {
 					return ParseError{msgUserAuthRequest}
 				}
+				if key.PublicKeyAlgo() != keyAlgo {
+					break
+				}
 
-				if !key.Verify(signedData, sig.Blob) {
+				if !verifySignature(key, signedData, sig) {
 					return ParseError{msgUserAuthRequest}
 				}
-				// TODO(jmpittman): Implement full validation for certificates.
+				// Certificates are validated by the callback,
+				// see CertChecker.
 				s.User = userAuthReq.User
-				if s.testPubKey(userAuthReq.User, algo, pubKey) {
+				if s.testPubKey(userAuthReq.User, keyAlgo, pubKey) {
 					break userAuthLoop
 				}
 			}
@@ -644,7 +1027,7 @@ userAuthLoop:
 	if err = s.writePacket(packet); err != nil {
 		return err
 	}
-
+	s.transport.startDelayedCompression()
 	return nil
 }
 
@@ -705,28 +1088,42 @@ func (c *sshClientKeyboardInteractive) Challenge(user, instruction string, quest
 
 const defaultWindowSize = 32768
 
+// shutdown records err as the error of the connection. It ends the
+// channels, including those that are still being opened, and closes
+// the listeners of remote forwards.
+func (s *ServerConn) shutdown(err error) {
+	s.lock.Lock()
+	s.err = err
+	for _, c := range s.channels {
+		c.setDead()
+		c.handleData(nil)
+		c.openDone(err)
+	}
+	s.lock.Unlock()
+	s.forwards.closeAll()
+}
+
 // Accept reads and processes messages on a ServerConn. It must be called
-// in order to demultiplex messages to any resulting Channels.
+// in order to demultiplex messages to any resulting Channels. Once it
+// returns an error, the connection is finished and every later call
+// returns the same error.
 func (s *ServerConn) Accept() (Channel, error) {
 	// TODO(dfc) s.lock is not held here so visibility of s.err is not guaranteed.
 	if s.err != nil {
 		return nil, s.err
 	}
 
+	c, err := s.accept()
+	if err != nil {
+		s.shutdown(err)
+	}
+	return c, err
+}
+
+func (s *ServerConn) accept() (Channel, error) {
 	for {
 		packet, err := s.readPacket()
 		if err != nil {
-
-			s.lock.Lock()
-			s.err = err
-			s.lock.Unlock()
-
-			// TODO(dfc) s.lock protects s.channels but isn't being held here.
-			for _, c := range s.channels {
-				c.setDead()
-				c.handleData(nil)
-			}
-
 			return nil, err
 		}
 
@@ -758,6 +1155,17 @@ func (s *ServerConn) Accept() (Channel, error) {
 				if msg.MaxPacketSize < minPacketLength || msg.MaxPacketSize > 1<<31 {
 					return nil, errors.New("ssh: invalid MaxPacketSize from peer")
 				}
+				if !s.permitsChannel(msg) {
+					if err := s.writePacket(marshal(msgChannelOpenFailure, channelOpenFailureMsg{
+						PeersId:  msg.PeersId,
+						Reason:   Prohibited,
+						Message:  "administratively prohibited",
+						Language: "en",
+					})); err != nil {
+						return nil, err
+					}
+					continue
+				}
 				c := &serverChan{
 					channel: channel{
 						conn:      s,
@@ -780,6 +1188,35 @@ func (s *ServerConn) Accept() (Channel, error) {
 				s.lock.Unlock()
 				return c, nil
 
+			case *channelOpenConfirmMsg:
+				s.lock.Lock()
+				c, ok := s.channels[msg.PeersId]
+				if !ok || c.openResult == nil {
+					s.lock.Unlock()
+					continue
+				}
+				if msg.MaxPacketSize < minPacketLength || msg.MaxPacketSize > 1<<31 {
+					err := errors.New("ssh: invalid MaxPacketSize from peer")
+					delete(s.channels, msg.PeersId)
+					c.openDone(err)
+					s.lock.Unlock()
+					return nil, err
+				}
+				c.remoteId = msg.MyId
+				c.maxPacket = msg.MaxPacketSize
+				c.remoteWin.add(msg.MyWindow)
+				c.openDone(nil)
+				s.lock.Unlock()
+
+			case *channelOpenFailureMsg:
+				s.lock.Lock()
+				c, ok := s.channels[msg.PeersId]
+				if ok && c.openResult != nil {
+					delete(s.channels, msg.PeersId)
+					c.openDone(fmt.Errorf("ssh: channel open failed: %s", safeString(msg.Message)))
+				}
+				s.lock.Unlock()
+
 			case *channelRequestMsg:
 				s.lock.Lock()
 				c, ok := s.channels[msg.PeersId]
@@ -787,8 +1224,14 @@ func (s *ServerConn) Accept() (Channel, error) {
 					s.lock.Unlock()
 					continue
 				}
-				c.handlePacket(msg)
+				reqs, err := s.filterChannelRequest(c, msg)
+				for _, req := range reqs {
+					c.handlePacket(req)
+				}
 				s.lock.Unlock()
+				if err != nil {
+					return nil, err
+				}
 
 			case *windowAdjustMsg:
 				s.lock.Lock()
@@ -821,19 +1264,10 @@ func (s *ServerConn) Accept() (Channel, error) {
 				s.lock.Unlock()
 
 			case *globalRequestMsg:
-				if msg.WantReply {
-					if err := s.writePacket([]byte{msgRequestFailure}); err != nil {
-						return nil, err
-					}
-				}
-
-			case *kexInitMsg:
-				s.lock.Lock()
-				if err := s.clientInitHandshake(msg, packet); err != nil {
-					s.lock.Unlock()
+				if err := s.handleGlobalRequest(msg); err != nil {
 					return nil, err
 				}
-				s.lock.Unlock()
+
 			case *disconnectMsg:
 				return nil, io.EOF
 			default:
@@ -845,6 +1279,67 @@ func (s *ServerConn) Accept() (Channel, error) {
 	panic("unreachable")
 }
 
+// permitsChannel reports whether s.Permissions allow the client to
+// open the channel described by msg.
+func (s *ServerConn) permitsChannel(msg *channelOpenMsg) bool {
+	switch msg.ChanType {
+	case "direct-tcpip":
+		return s.permitsDirectTCPIP(msg.TypeSpecificData)
+	case directStreamLocalChannelType:
+		return s.permitsDirectStreamLocal(msg.TypeSpecificData)
+	}
+	return true
+}
+
+// OpenChannel opens a channel of the given type to the client, as
+// described in RFC 4254, section 5.1. extraData holds the channel type
+// specific data. Accept must be running in another goroutine, as it
+// processes the client's answer.
+func (s *ServerConn) OpenChannel(chanType string, extraData []byte) (Channel, error) {
+	c := &serverChan{
+		channel: channel{
+			conn:      s,
+			remoteWin: window{Cond: newCond()},
+		},
+		chanType:    chanType,
+		extraData:   extraData,
+		myWindow:    defaultWindowSize,
+		serverConn:  s,
+		cond:        newCond(),
+		pendingData: make([]byte, defaultWindowSize),
+	}
+	result := make(chan error, 1)
+	c.openResult = result
+
+	s.lock.Lock()
+	if s.err != nil {
+		s.lock.Unlock()
+		return nil, s.err
+	}
+	c.localId = s.nextChanId
+	s.nextChanId++
+	s.channels[c.localId] = c
+	err := s.writePacket(marshal(msgChannelOpen, channelOpenMsg{
+		ChanType:         chanType,
+		PeersId:          c.localId,
+		PeersWindow:      defaultWindowSize,
+		MaxPacketSize:    defaultWindowSize,
+		TypeSpecificData: extraData,
+	}))
+	s.lock.Unlock()
+
+	if err == nil {
+		err = <-result
+	}
+	if err != nil {
+		s.lock.Lock()
+		delete(s.channels, c.localId)
+		s.lock.Unlock()
+		return nil, err
+	}
+	return c, nil
+}
+
 // A Listener implements a network listener (net.Listener) for SSH connections.
 type Listener struct {
 	listener net.Listener
@@ -0,0 +1,290 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"errors"
+)
+
+// A ServerSession is the server side of an interactive session, described
+// in RFC 4254, section 6. Requests from the client are decoded into the
+// Request types below and returned by Read as errors, in the same way
+// that Channel.Read returns a ChannelRequest.
+type ServerSession struct {
+	*serverChan // the channel backing this session
+}
+
+// AcceptSession accepts ch, which must be a "session" channel returned by
+// ServerConn.Accept, and returns the session running on it.
+func AcceptSession(ch Channel) (*ServerSession, error) {
+	c, ok := ch.(*serverChan)
+	if !ok || c.ChannelType() != "session" {
+		return nil, errors.New("ssh: not a session channel")
+	}
+	if err := c.Accept(); err != nil {
+		return nil, err
+	}
+	return &ServerSession{c}, nil
+}
+
+// Read reads data sent by the client. When the client sends a request,
+// Read returns it as an error of type *ExecRequest, *ShellRequest,
+// *SubsystemRequest, *EnvRequest, *PtyRequest, *WindowChangeRequest,
+// *SignalRequest, *BreakRequest or *X11Request, or as a ChannelRequest
+// if the request is of another type. The caller must answer requests that want a reply
+// with AckRequest. Malformed requests are refused without being returned.
+func (s *ServerSession) Read(data []byte) (int, error) {
+	for {
+		n, err := s.serverChan.Read(data)
+		req, ok := err.(ChannelRequest)
+		if !ok {
+			return n, err
+		}
+		if decoded, ok := parseSessionRequest(req); ok {
+			return n, decoded.(error)
+		}
+		if req.WantReply {
+			if err := s.AckRequest(false); err != nil {
+				return n, err
+			}
+		}
+	}
+}
+
+// ExecRequest asks the server to run Command. See RFC 4254, section 6.5.
+type ExecRequest struct {
+	ChannelRequest
+	Command string
+}
+
+// ShellRequest asks the server to start the user's default shell. See
+// RFC 4254, section 6.5.
+type ShellRequest struct {
+	ChannelRequest
+}
+
+// SubsystemRequest asks the server to start a predefined subsystem such
+// as "sftp". See RFC 4254, section 6.5.
+type SubsystemRequest struct {
+	ChannelRequest
+	Subsystem string
+}
+
+// EnvRequest passes an environment variable to the shell or command that
+// is started later. See RFC 4254, section 6.4.
+type EnvRequest struct {
+	ChannelRequest
+	Name, Value string
+}
+
+// PtyRequest asks the server to allocate a pseudo-terminal. The
+// dimensions are given in characters and in pixels; either may be zero.
+// See RFC 4254, section 6.2.
+type PtyRequest struct {
+	ChannelRequest
+	Term          string
+	Columns, Rows uint32
+	Width, Height uint32
+	Modes         TerminalModes
+}
+
+// WindowChangeRequest reports a change of the client's terminal size.
+// See RFC 4254, section 6.7.
+type WindowChangeRequest struct {
+	ChannelRequest
+	Columns, Rows uint32
+	Width, Height uint32
+}
+
+// SignalRequest asks the server to deliver Signal to the remote process.
+// See RFC 4254, section 6.9.
+type SignalRequest struct {
+	ChannelRequest
+	Signal Signal
+}
+
+// BreakRequest asks the server to send a break of Length milliseconds to
+// the remote process. See RFC 4335.
+type BreakRequest struct {
+	ChannelRequest
+	Length uint32
+}
+
+// X11Request asks the server to forward connections to an X11 display
+// to the client, over channels opened with ServerConn.OpenX11Channel.
+// The display should only accept connections that present AuthCookie,
+// a hex encoded cookie for AuthProtocol. See RFC 4254, section 6.3.
+type X11Request struct {
+	ChannelRequest
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	Screen           uint32
+}
+
+// parseSessionRequest decodes the payload of a request sent on a session
+// channel. Requests of unknown types are returned unchanged.
+func parseSessionRequest(req ChannelRequest) (interface{}, bool) {
+	in := req.Payload
+	switch req.Request {
+	case "exec":
+		cmd, in, ok := parseString(in)
+		if !ok || len(in) != 0 {
+			return nil, false
+		}
+		return &ExecRequest{req, string(cmd)}, true
+	case "shell":
+		return &ShellRequest{req}, true
+	case "subsystem":
+		name, in, ok := parseString(in)
+		if !ok || len(in) != 0 {
+			return nil, false
+		}
+		return &SubsystemRequest{req, string(name)}, true
+	case "env":
+		name, in, ok := parseString(in)
+		if !ok {
+			return nil, false
+		}
+		value, in, ok := parseString(in)
+		if !ok || len(in) != 0 {
+			return nil, false
+		}
+		return &EnvRequest{req, string(name), string(value)}, true
+	case "pty-req":
+		return parsePtyRequestPayload(req)
+	case "window-change":
+		dims, in, ok := parseDimensions(in)
+		if !ok || len(in) != 0 {
+			return nil, false
+		}
+		return &WindowChangeRequest{req, dims[0], dims[1], dims[2], dims[3]}, true
+	case "signal":
+		sig, in, ok := parseString(in)
+		if !ok || len(in) != 0 {
+			return nil, false
+		}
+		return &SignalRequest{req, Signal(sig)}, true
+	case x11RequestType:
+		if len(in) == 0 {
+			return nil, false
+		}
+		single := in[0] != 0
+		proto, in, ok := parseString(in[1:])
+		if !ok {
+			return nil, false
+		}
+		cookie, in, ok := parseString(in)
+		if !ok {
+			return nil, false
+		}
+		screen, in, ok := parseUint32(in)
+		if !ok || len(in) != 0 {
+			return nil, false
+		}
+		return &X11Request{req, single, string(proto), string(cookie), screen}, true
+	case "break":
+		length, in, ok := parseUint32(in)
+		if !ok || len(in) != 0 {
+			return nil, false
+		}
+		return &BreakRequest{req, length}, true
+	}
+	return req, true
+}
+
+// parseDimensions parses the columns, rows, width and height that follow
+// each other in pty-req and window-change requests.
+func parseDimensions(in []byte) (dims [4]uint32, rest []byte, ok bool) {
+	for i := range dims {
+		if dims[i], in, ok = parseUint32(in); !ok {
+			return
+		}
+	}
+	return dims, in, true
+}
+
+func parsePtyRequestPayload(req ChannelRequest) (*PtyRequest, bool) {
+	term, in, ok := parseString(req.Payload)
+	if !ok {
+		return nil, false
+	}
+	dims, in, ok := parseDimensions(in)
+	if !ok {
+		return nil, false
+	}
+	modeList, in, ok := parseString(in)
+	if !ok || len(in) != 0 {
+		return nil, false
+	}
+
+	// Each mode is an opcode followed by a uint32 argument. Opcodes
+	// from 160 to 255 are not defined and stop the parsing, as in
+	// RFC 4254, section 8.
+	modes := make(TerminalModes)
+	for len(modeList) > 0 && modeList[0] != tty_OP_END && modeList[0] < 160 {
+		opcode := modeList[0]
+		var arg uint32
+		if arg, modeList, ok = parseUint32(modeList[1:]); !ok {
+			return nil, false
+		}
+		modes[opcode] = arg
+	}
+	return &PtyRequest{req, string(term), dims[0], dims[1], dims[2], dims[3], modes}, true
+}
+
+// RFC 4254 Section 6.10.
+type exitStatusMsg struct {
+	PeersId   uint32
+	Request   string
+	WantReply bool
+	Status    uint32
+}
+
+// RFC 4254 Section 6.10.
+type exitSignalMsg struct {
+	PeersId    uint32
+	Request    string
+	WantReply  bool
+	Signal     string
+	CoreDumped bool
+	Errmsg     string
+	Lang       string
+}
+
+// sendRequest sends a request that wants no reply to the client.
+func (s *ServerSession) sendRequest(msg interface{}) error {
+	s.serverConn.lock.Lock()
+	defer s.serverConn.lock.Unlock()
+
+	if s.serverConn.err != nil {
+		return s.serverConn.err
+	}
+	return s.writePacket(marshal(msgChannelRequest, msg))
+}
+
+// SendExitStatus reports the exit status of the remote process, which the
+// client's Session.Wait returns. The session should be closed afterwards.
+func (s *ServerSession) SendExitStatus(status uint32) error {
+	return s.sendRequest(exitStatusMsg{
+		PeersId: s.remoteId,
+		Request: "exit-status",
+		Status:  status,
+	})
+}
+
+// SendExitSignal reports that the remote process was terminated by sig.
+// errmsg is a textual explanation in the language given by lang, either
+// of which may be empty. The session should be closed afterwards.
+func (s *ServerSession) SendExitSignal(sig Signal, coreDumped bool, errmsg, lang string) error {
+	return s.sendRequest(exitSignalMsg{
+		PeersId:    s.remoteId,
+		Request:    "exit-signal",
+		Signal:     string(sig),
+		CoreDumped: coreDumped,
+		Errmsg:     errmsg,
+		Lang:       lang,
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSessionRequest(t *testing.T) {
+	dims := appendU32(appendU32(appendU32(appendU32(nil, 80), 24), 640), 480)
+	tests := []struct {
+		req  string
+		data []byte
+		want interface{}
+	}{
+		{"exec", appendString(nil, "ls -l"), &ExecRequest{Command: "ls -l"}},
+		{"shell", nil, &ShellRequest{}},
+		{"subsystem", appendString(nil, "sftp"), &SubsystemRequest{Subsystem: "sftp"}},
+		{"env", appendString(appendString(nil, "LANG"), "C"), &EnvRequest{Name: "LANG", Value: "C"}},
+		{"pty-req", appendString(append(appendString(nil, "xterm"), dims...), "\x35\x00\x00\x00\x01\x00"),
+			&PtyRequest{Term: "xterm", Columns: 80, Rows: 24, Width: 640, Height: 480, Modes: TerminalModes{ECHO: 1}}},
+		{"window-change", dims, &WindowChangeRequest{Columns: 80, Rows: 24, Width: 640, Height: 480}},
+		{"signal", appendString(nil, "INT"), &SignalRequest{Signal: SIGINT}},
+		{"break", appendU32(nil, 500), &BreakRequest{Length: 500}},
+		{"keepalive@openssh.com", []byte{1}, ChannelRequest{}},
+
+		{"exec", nil, nil},
+		{"exec", append(appendString(nil, "ls"), 0), nil},
+		{"env", appendString(nil, "LANG"), nil},
+		{"pty-req", appendString(nil, "xterm"), nil},
+		{"pty-req", appendString(append(appendString(nil, "xterm"), dims...), "\x35\x00"), nil},
+		{"window-change", dims[:12], nil},
+		{"break", nil, nil},
+	}
+	for _, test := range tests {
+		req := ChannelRequest{Request: test.req, WantReply: true, Payload: test.data}
+		got, ok := parseSessionRequest(req)
+		if test.want == nil {
+			if ok {
+				t.Errorf("%s %x: got %#v, want error", test.req, test.data, got)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s %x: parsing failed", test.req, test.data)
+			continue
+		}
+		// Fill in the raw request embedded in each result.
+		want := reflect.New(reflect.TypeOf(test.want)).Elem()
+		want.Set(reflect.ValueOf(test.want))
+		if want.Kind() == reflect.Ptr {
+			want.Elem().Field(0).Set(reflect.ValueOf(req))
+		} else {
+			want.Set(reflect.ValueOf(req))
+		}
+		if !reflect.DeepEqual(got, want.Interface()) {
+			t.Errorf("%s %x: got %#v, want %#v", test.req, test.data, got, want.Interface())
+		}
+	}
+}
+
+func TestParsePtyRequestLenient(t *testing.T) {
+	// ServerTerminal only needs the dimensions, so a malformed mode
+	// list or trailing data is accepted.
+	prefix := append(appendString(nil, "xterm"), appendU32(appendU32(nil, 80), 24)...)
+	for _, payload := range [][]byte{
+		prefix,
+		append(appendU32(appendU32(prefix, 640), 480), "\x35\x00"...),
+		append(appendString(appendU32(appendU32(prefix, 640), 480), ""), 1, 2, 3),
+	} {
+		width, height, ok := parsePtyRequest(payload)
+		if !ok || width != 80 || height != 24 {
+			t.Errorf("%x: got %d, %d, %v", payload, width, height, ok)
+		}
+	}
+	if _, _, ok := parsePtyRequest(appendString(nil, "xterm")); ok {
+		t.Errorf("accepted a request without dimensions")
+	}
+}
+
+// sessionHandler answers the requests of a client session, recording
+// them in reqs, and exits with a status of 3 when asked to run a command.
+func sessionHandler(reqs chan<- interface{}) serverType {
+	return func(ch *serverChan, t *testing.T) {
+		defer ch.Close()
+		s := &ServerSession{ch}
+		for {
+			_, err := s.Read(make([]byte, 1))
+			switch req := err.(type) {
+			case *ExecRequest:
+				reqs <- req
+				s.AckRequest(true)
+				s.Write([]byte(req.Command))
+				if err := s.SendExitStatus(3); err != nil {
+					t.Errorf("SendExitStatus: %v", err)
+				}
+				return
+			case *ShellRequest:
+				reqs <- req
+				s.AckRequest(true)
+				if err := s.SendExitSignal(SIGTERM, false, "terminated", "en"); err != nil {
+					t.Errorf("SendExitSignal: %v", err)
+				}
+				return
+			case *PtyRequest:
+				reqs <- req
+				s.AckRequest(true)
+			case *EnvRequest:
+				reqs <- req
+				s.AckRequest(req.Name == "LANG")
+			case *SignalRequest:
+				reqs <- req
+			case ChannelRequest:
+				t.Errorf("unexpected request %q", req.Request)
+				if req.WantReply {
+					s.AckRequest(false)
+				}
+			default:
+				return
+			}
+		}
+	}
+}
+
+func TestServerSession(t *testing.T) {
+	reqs := make(chan interface{}, 10)
+	conn := dial(sessionHandler(reqs), t)
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.RequestPty("vt100", 24, 80, TerminalModes{ECHO: 0, TTY_OP_ISPEED: 14400}); err != nil {
+		t.Fatalf("RequestPty: %v", err)
+	}
+	pty := (<-reqs).(*PtyRequest)
+	if pty.Term != "vt100" || pty.Columns != 80 || pty.Rows != 24 ||
+		!reflect.DeepEqual(pty.Modes, TerminalModes{ECHO: 0, TTY_OP_ISPEED: 14400}) {
+		t.Errorf("got pty request %+v", pty)
+	}
+
+	if err := session.Setenv("LANG", "C"); err != nil {
+		t.Errorf("Setenv(LANG): %v", err)
+	}
+	if err := session.Setenv("PATH", "/"); err == nil {
+		t.Errorf("Setenv(PATH) succeeded, want refused")
+	}
+	for _, want := range []string{"LANG", "PATH"} {
+		if env := (<-reqs).(*EnvRequest); env.Name != want {
+			t.Errorf("got env request for %q, want %q", env.Name, want)
+		}
+	}
+
+	if err := session.Signal(SIGUSR1); err != nil {
+		t.Fatalf("Signal: %v", err)
+	}
+	if sig := (<-reqs).(*SignalRequest); sig.Signal != SIGUSR1 {
+		t.Errorf("got signal %q, want %q", sig.Signal, SIGUSR1)
+	}
+
+	out, err := session.Output("uname -a")
+	if exit, ok := err.(*ExitError); !ok || exit.ExitStatus() != 3 {
+		t.Errorf("got error %v, want exit status 3", err)
+	}
+	if string(out) != "uname -a" {
+		t.Errorf("got output %q", out)
+	}
+	if exec := (<-reqs).(*ExecRequest); exec.Command != "uname -a" {
+		t.Errorf("got command %q", exec.Command)
+	}
+}
+
+func TestServerSessionExitSignal(t *testing.T) {
+	reqs := make(chan interface{}, 10)
+	conn := dial(sessionHandler(reqs), t)
+	defer conn.Close()
+	session, err := conn.NewSession()
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	if err := session.Shell(); err != nil {
+		t.Fatalf("Shell: %v", err)
+	}
+	err = session.Wait()
+	exit, ok := err.(*ExitError)
+	if !ok {
+		t.Fatalf("got error %v, want an *ExitError", err)
+	}
+	if exit.Signal() != "TERM" || exit.Msg() != "terminated" || exit.ExitStatus() != 128+15 {
+		t.Errorf("got %v, want TERM", exit)
+	}
+}
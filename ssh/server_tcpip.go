@@ -0,0 +1,217 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// DirectTCPIP holds the type specific data of a direct-tcpip channel, with
+// which the client asks the server to connect to a host and port on its
+// behalf. See RFC 4254, section 7.2.
+type DirectTCPIP struct {
+	// Host and Port give the destination of the connection.
+	Host string
+	Port uint32
+
+	// OriginAddr and OriginPort give the address from which the
+	// client accepted the connection that it forwards.
+	OriginAddr string
+	OriginPort uint32
+}
+
+// ParseDirectTCPIP decodes the extra data of a direct-tcpip channel, as
+// returned by Channel.ExtraData.
+func ParseDirectTCPIP(extraData []byte) (*DirectTCPIP, error) {
+	d := new(DirectTCPIP)
+	host, in, ok := parseString(extraData)
+	if !ok {
+		return nil, errDirectTCPIP
+	}
+	if d.Port, in, ok = parseUint32(in); !ok {
+		return nil, errDirectTCPIP
+	}
+	origin, in, ok := parseString(in)
+	if !ok {
+		return nil, errDirectTCPIP
+	}
+	if d.OriginPort, in, ok = parseUint32(in); !ok || len(in) != 0 {
+		return nil, errDirectTCPIP
+	}
+	d.Host, d.OriginAddr = string(host), string(origin)
+	return d, nil
+}
+
+var errDirectTCPIP = errors.New("ssh: invalid direct-tcpip channel data")
+
+// permitsDirectTCPIP reports whether the client may open a direct-tcpip
+// channel to the destination in extraData.
+func (s *ServerConn) permitsDirectTCPIP(extraData []byte) bool {
+	d, err := ParseDirectTCPIP(extraData)
+	if err != nil || !s.Permissions.permitsOpen(d.Host, d.Port) {
+		return false
+	}
+	if cb := s.config.LocalForwardCallback; cb != nil {
+		return cb(s, d.Host, d.Port)
+	}
+	return true
+}
+
+// forwardKey identifies a remote forward by the network and address
+// that the client asked for.
+type forwardKey struct {
+	network, addr string
+}
+
+// remoteForwards holds the listeners opened for the tcpip-forward and
+// streamlocal-forward requests of a connection.
+type remoteForwards struct {
+	sync.Mutex
+	listeners map[forwardKey]net.Listener
+}
+
+// add records l under key, unless a listener already exists there.
+func (f *remoteForwards) add(key forwardKey, l net.Listener) bool {
+	f.Lock()
+	defer f.Unlock()
+	if _, dup := f.listeners[key]; dup {
+		return false
+	}
+	if f.listeners == nil {
+		f.listeners = make(map[forwardKey]net.Listener)
+	}
+	f.listeners[key] = l
+	return true
+}
+
+// remove closes and forgets the listener under key.
+func (f *remoteForwards) remove(key forwardKey) bool {
+	f.Lock()
+	defer f.Unlock()
+	l, ok := f.listeners[key]
+	if ok {
+		l.Close()
+		delete(f.listeners, key)
+	}
+	return ok
+}
+
+// closeAll stops all forwards when the connection ends.
+func (f *remoteForwards) closeAll() {
+	f.Lock()
+	defer f.Unlock()
+	for key, l := range f.listeners {
+		l.Close()
+		delete(f.listeners, key)
+	}
+}
+
+// handleGlobalRequest answers a global request of the client. Only
+// requests to start and cancel forwards are supported, and only if
+// ServerConfig.RemoteForwardCallback or RemoteUnixForwardCallback is
+// set.
+func (s *ServerConn) handleGlobalRequest(msg *globalRequestMsg) error {
+	var reply []byte
+	var ok bool
+	switch msg.Type {
+	case "tcpip-forward":
+		reply, ok = s.startRemoteForward(msg.Data)
+	case "cancel-tcpip-forward":
+		ok = s.cancelRemoteForward(msg.Data)
+	case streamLocalForwardRequest:
+		ok = s.startStreamLocalForward(msg.Data)
+	case cancelStreamLocalForwardRequest:
+		ok = s.cancelStreamLocalForward(msg.Data)
+	}
+	if !msg.WantReply {
+		return nil
+	}
+	if !ok {
+		return s.writePacket([]byte{msgRequestFailure})
+	}
+	return s.writePacket(marshal(msgRequestSuccess, globalRequestSuccessMsg{Data: reply}))
+}
+
+// startRemoteForward listens on the address of a tcpip-forward request,
+// RFC 4254, section 7.1. If the client asked for port 0, the port that
+// was allocated is returned as the reply data.
+func (s *ServerConn) startRemoteForward(data []byte) ([]byte, bool) {
+	cb := s.config.RemoteForwardCallback
+	if cb == nil || !s.Permissions.permits(CertExtPermitPortForwarding) {
+		return nil, false
+	}
+	host, data, ok := parseString(data)
+	if !ok {
+		return nil, false
+	}
+	port, data, ok := parseUint32(data)
+	if !ok || len(data) != 0 || port > 65535 || !cb(s, string(host), port) {
+		return nil, false
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(string(host), strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, false
+	}
+	bound := uint32(l.Addr().(*net.TCPAddr).Port)
+	if !s.forwards.add(forwardKey{"tcp", net.JoinHostPort(string(host), strconv.Itoa(int(bound)))}, l) {
+		l.Close()
+		return nil, false
+	}
+
+	// RFC 4254 7.2
+	go s.serveRemoteForward(l, "forwarded-tcpip", func(conn net.Conn) []byte {
+		origin := conn.RemoteAddr().(*net.TCPAddr)
+		data := appendU32(appendString(nil, string(host)), bound)
+		return appendU32(appendString(data, origin.IP.String()), uint32(origin.Port))
+	})
+
+	if port == 0 {
+		return appendU32(nil, bound), true
+	}
+	return nil, true
+}
+
+// cancelRemoteForward stops the forward of a cancel-tcpip-forward request.
+func (s *ServerConn) cancelRemoteForward(data []byte) bool {
+	host, data, ok := parseString(data)
+	if !ok {
+		return false
+	}
+	port, data, ok := parseUint32(data)
+	if !ok || len(data) != 0 {
+		return false
+	}
+	return s.forwards.remove(forwardKey{"tcp", net.JoinHostPort(string(host), strconv.Itoa(int(port)))})
+}
+
+// serveRemoteForward opens a channel of type chanType to the client for
+// every connection accepted by l, until l is closed. chanData returns
+// the channel type specific data for a connection.
+func (s *ServerConn) serveRemoteForward(l net.Listener, chanType string, chanData func(net.Conn) []byte) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			ch, err := s.OpenChannel(chanType, chanData(conn))
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go func() {
+				io.Copy(ch, conn)
+				ch.Close()
+			}()
+			io.Copy(conn, ch)
+			conn.Close()
+		}()
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDirectTCPIP(t *testing.T) {
+	data := appendU32(appendString(nil, "example.com"), 443)
+	data = appendU32(appendString(data, "192.0.2.1"), 5555)
+	got, err := ParseDirectTCPIP(data)
+	if err != nil {
+		t.Fatalf("ParseDirectTCPIP: %v", err)
+	}
+	want := &DirectTCPIP{"example.com", 443, "192.0.2.1", 5555}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if _, err := ParseDirectTCPIP(data[:len(data)-1]); err == nil {
+		t.Errorf("truncated data accepted")
+	}
+}
+
+// dialForwardingServer starts a server that allows port forwarding to
+// and from 127.0.0.1 only, and of unix sockets whose path does not
+// contain "forbidden". It answers direct-tcpip and direct-streamlocal
+// channels itself with the destination that was asked for.
+func dialForwardingServer(t *testing.T) *ClientConn {
+	onlyLoopback := func(conn *ServerConn, host string, port uint32) bool {
+		return host == "127.0.0.1"
+	}
+	notForbidden := func(conn *ServerConn, socketPath string) bool {
+		return !strings.Contains(socketPath, "forbidden")
+	}
+	config := &ServerConfig{
+		PasswordCallback:          serverConfig.PasswordCallback,
+		LocalForwardCallback:      onlyLoopback,
+		RemoteForwardCallback:     onlyLoopback,
+		LocalUnixForwardCallback:  notForbidden,
+		RemoteUnixForwardCallback: notForbidden,
+	}
+	config.AddHostKey(rsaKey)
+	l, err := Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Errorf("Accept: %v", err)
+			return
+		}
+		defer conn.Close()
+		if err := conn.Handshake(); err != nil {
+			t.Errorf("Handshake: %v", err)
+			return
+		}
+		for {
+			ch, err := conn.Accept()
+			if err != nil {
+				return
+			}
+			var dest string
+			switch ch.ChannelType() {
+			case "direct-tcpip":
+				var d *DirectTCPIP
+				if d, err = ParseDirectTCPIP(ch.ExtraData()); err == nil {
+					dest = net.JoinHostPort(d.Host, strconv.Itoa(int(d.Port)))
+				}
+			case directStreamLocalChannelType:
+				dest, err = ParseDirectStreamLocal(ch.ExtraData())
+			default:
+				err = errors.New("unexpected channel")
+			}
+			if err != nil {
+				ch.Reject(UnknownChannelType, err.Error())
+				continue
+			}
+			ch.Accept()
+			ch.Write([]byte(dest))
+			ch.Close()
+		}
+	}()
+
+	client, err := Dial("tcp", l.Addr().String(), &ClientConfig{
+		User: "testuser",
+		Auth: []ClientAuth{ClientAuthPassword(clientPassword)},
+	})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	return client
+}
+
+func TestServerDirectTCPIP(t *testing.T) {
+	client := dialForwardingServer(t)
+	defer client.Close()
+
+	conn, err := client.Dial("tcp", "127.0.0.1:80")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "127.0.0.1:80" {
+		t.Errorf("got %q, want %q", got, "127.0.0.1:80")
+	}
+	conn.Close()
+
+	if _, err := client.Dial("tcp", "example.com:80"); err == nil {
+		t.Errorf("forwarding to a destination refused by the callback succeeded")
+	}
+}
+
+func TestServerRemoteForward(t *testing.T) {
+	client := dialForwardingServer(t)
+	defer client.Close()
+
+	if _, err := client.Listen("tcp", "127.0.0.2:0"); err == nil {
+		t.Errorf("forward refused by the callback succeeded")
+	}
+
+	l, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	addr := l.Addr().String()
+	if l.Addr().(*net.TCPAddr).Port == 0 {
+		t.Fatalf("server did not report the port it allocated")
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Errorf("net.Dial: %v", err)
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+	conn.Close()
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Errorf("server still listening after the forward was cancelled")
+	}
+}
+
+// TestServerRemoteForwardConnectionEnd checks that the server stops
+// listening for remote forwards however the connection ends.
+func TestServerRemoteForwardConnectionEnd(t *testing.T) {
+	for _, packet := range [][]byte{
+		marshal(msgDisconnect, disconnectMsg{Message: "bye"}),
+		{msgChannelData, 0, 0, 0, 0}, // malformed
+	} {
+		client := dialForwardingServer(t)
+		l, err := client.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		addr := l.Addr().String()
+
+		client.writePacket(packet)
+		for i := 0; ; i++ {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				break
+			}
+			conn.Close()
+			if i == 50 {
+				t.Fatalf("message %d: server still listening after the connection ended", packet[0])
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// rawClient returns a server connection that serves channels in a loop
+// and an authenticated client connection to it that has no main loop,
+// so the test can drive the client side packet by packet.
+func rawClient(t *testing.T) (*ServerConn, *ClientConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	c2, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	c1, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	server := Server(c1, serverConfig)
+	go func() {
+		if err := server.Handshake(); err != nil {
+			t.Errorf("Handshake: %v", err)
+			return
+		}
+		for {
+			if _, err := server.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	config := &ClientConfig{
+		User: "testuser",
+		Auth: []ClientAuth{ClientAuthPassword(clientPassword)},
+	}
+	client := &ClientConn{
+		transport:     newTransport(c2, config.rand(), &config.Crypto),
+		config:        config,
+		globalRequest: globalRequest{response: make(chan interface{}, 1)},
+	}
+	if err := client.handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	return server, client
+}
+
+// readChannelOpen reads packets until the server opens a channel.
+func readChannelOpen(t *testing.T, client *ClientConn) *channelOpenMsg {
+	for {
+		packet, err := client.readPacket()
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		if packet[0] == msgChannelOpen {
+			msg, err := decode(packet)
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			return msg.(*channelOpenMsg)
+		}
+	}
+}
+
+// openChannel calls OpenChannel on server in another goroutine.
+func openChannel(server *ServerConn) chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.OpenChannel("test", nil)
+		done <- err
+	}()
+	return done
+}
+
+func TestOpenChannelInvalidMaxPacketSize(t *testing.T) {
+	server, client := rawClient(t)
+	defer client.Close()
+
+	done := openChannel(server)
+	open := readChannelOpen(t, client)
+	client.writePacket(marshal(msgChannelOpenConfirm, channelOpenConfirmMsg{
+		PeersId:       open.PeersId,
+		MyWindow:      1 << 14,
+		MaxPacketSize: 1,
+	}))
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("OpenChannel accepted an invalid MaxPacketSize")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OpenChannel still waiting after an invalid confirmation")
+	}
+}
+
+func TestOpenChannelDuplicateAnswers(t *testing.T) {
+	server, client := rawClient(t)
+	defer client.Close()
+
+	done := make(chan Channel, 1)
+	go func() {
+		ch, err := server.OpenChannel("test", nil)
+		if err != nil {
+			t.Errorf("OpenChannel: %v", err)
+		}
+		done <- ch
+	}()
+	open := readChannelOpen(t, client)
+	confirm := channelOpenConfirmMsg{
+		PeersId:       open.PeersId,
+		MyId:          7,
+		MyWindow:      1 << 14,
+		MaxPacketSize: 1 << 15,
+	}
+	client.writePacket(marshal(msgChannelOpenConfirm, confirm))
+	ch := <-done
+	if ch == nil {
+		return
+	}
+
+	// A second confirmation and a failure for the open channel must
+	// neither change its remote id nor remove it.
+	confirm.MyId = 8
+	client.writePacket(marshal(msgChannelOpenConfirm, confirm))
+	client.writePacket(marshal(msgChannelOpenFailure, channelOpenFailureMsg{
+		PeersId: open.PeersId,
+		Reason:  ConnectionFailed,
+	}))
+
+	id := open.PeersId
+	client.writePacket([]byte{
+		msgChannelData,
+		byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id),
+		0, 0, 0, 4, 'p', 'i', 'n', 'g',
+	})
+	buf := make([]byte, 4)
+	if n, err := ch.Read(buf); err != nil || string(buf[:n]) != "ping" {
+		t.Fatalf("Read: got %q, %v", buf[:n], err)
+	}
+
+	go ch.Write([]byte("pong"))
+	for {
+		packet, err := client.readPacket()
+		if err != nil {
+			t.Fatalf("readPacket: %v", err)
+		}
+		if packet[0] != msgChannelData {
+			continue
+		}
+		if len(packet) < 5 || packet[4] != 7 {
+			t.Errorf("data sent to remote id %v, want 7", packet[1:5])
+		}
+		break
+	}
+}
+
+func TestOpenChannelDisconnect(t *testing.T) {
+	server, client := rawClient(t)
+	defer client.Close()
+
+	done := openChannel(server)
+	readChannelOpen(t, client)
+	client.writePacket(marshal(msgDisconnect, disconnectMsg{Message: "bye"}))
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("OpenChannel succeeded after a disconnect")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("OpenChannel still waiting after a disconnect")
+	}
+	if _, err := server.OpenChannel("test", nil); err == nil {
+		t.Errorf("OpenChannel succeeded on a disconnected connection")
+	}
+}
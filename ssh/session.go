@@ -130,6 +130,7 @@ type Session struct {
 	Stderr io.Writer
 
 	*clientChan // the channel backing this session
+	clientConn  *ClientConn
 
 	started   bool // true once Start, Run or Shell is invoked.
 	copyFuncs []func() error
@@ -172,6 +173,30 @@ func (s *Session) Setenv(name, value string) error {
 	return s.waitForResponse()
 }
 
+// agentForwardRequestMsg is the OpenSSH agent forwarding request. It
+// carries no request specific data.
+type agentForwardRequestMsg struct {
+	PeersId   uint32
+	Request   string
+	WantReply bool
+}
+
+// RequestAgentForwarding asks the server to forward connections to the
+// authentication agent back to the client over this session's
+// connection. The ClientConn must be set up to serve them with
+// ForwardAgent or ForwardAgentKeyring.
+func (s *Session) RequestAgentForwarding() error {
+	req := agentForwardRequestMsg{
+		PeersId:   s.remoteId,
+		Request:   agentRequestType,
+		WantReply: true,
+	}
+	if err := s.writePacket(marshal(msgChannelRequest, req)); err != nil {
+		return err
+	}
+	return s.waitForResponse()
+}
+
 // RFC 4254 Section 6.2.
 type ptyRequestMsg struct {
 	PeersId   uint32
@@ -579,6 +604,7 @@ func (c *ClientConn) NewSession() (*Session, error) {
 	}
 	return &Session{
 		clientChan: ch,
+		clientConn: c,
 	}, nil
 }
 
@@ -541,6 +541,29 @@ func TestServerWindow(t *testing.T) {
 	}
 }
 
+// TestServerChanDataBeforeEOF checks that data which arrives ahead of
+// an EOF or close from the client is read before io.EOF.
+func TestServerChanDataBeforeEOF(t *testing.T) {
+	for _, end := range []interface{}{&channelEOFMsg{}, &channelCloseMsg{}} {
+		c := &serverChan{
+			myWindow:    defaultWindowSize,
+			cond:        newCond(),
+			pendingData: make([]byte, defaultWindowSize),
+		}
+		c.handleData([]byte("hello"))
+		c.handlePacket(end)
+
+		buf := make([]byte, 16)
+		n, err, _ := c.read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Errorf("%T: got %q, %v, want %q", end, buf[:n], err, "hello")
+		}
+		if _, err, _ := c.read(buf); err != io.EOF {
+			t.Errorf("%T: got %v after the data, want io.EOF", end, err)
+		}
+	}
+}
+
 // Verify the client can handle a keepalive packet from the server.
 func TestClientHandlesKeepalives(t *testing.T) {
 	conn := dial(channelKeepaliveSender, t)
@@ -559,23 +582,6 @@ func TestClientHandlesKeepalives(t *testing.T) {
 	}
 }
 
-type exitStatusMsg struct {
-	PeersId   uint32
-	Request   string
-	WantReply bool
-	Status    uint32
-}
-
-type exitSignalMsg struct {
-	PeersId    uint32
-	Request    string
-	WantReply  bool
-	Signal     string
-	CoreDumped bool
-	Errmsg     string
-	Lang       string
-}
-
 func newServerShell(ch *serverChan, prompt string) *ServerTerminal {
 	term := terminal.NewTerminal(ch, prompt)
 	return &ServerTerminal{
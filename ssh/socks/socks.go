@@ -0,0 +1,339 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package socks implements a SOCKS5 proxy server, as described in RFC 1928,
+that makes its outgoing connections with a dial function. Given the Dial
+method of an ssh.ClientConn it acts like OpenSSH's dynamic port
+forwarding (ssh -D):
+
+	client, err := ssh.Dial("tcp", "bastion:22", config)
+	...
+	l, err := net.Listen("tcp", "127.0.0.1:1080")
+	...
+	server := &socks.Server{Dial: client.Dial}
+	server.Serve(l)
+
+Only the CONNECT command is supported. Domain names are passed to the dial
+function unresolved, so that the remote host of an SSH connection
+resolves them.
+*/
+package socks
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+const socksVersion = 5
+
+// Authentication methods, RFC 1928 section 3.
+const (
+	methodNone         = 0x00
+	methodPassword     = 0x02
+	methodNoAcceptable = 0xff
+)
+
+// Address types, RFC 1928 section 5.
+const (
+	addrIPv4   = 0x01
+	addrDomain = 0x03
+	addrIPv6   = 0x04
+)
+
+const cmdConnect = 0x01
+
+// Reply codes, RFC 1928 section 6.
+const (
+	replySucceeded           = 0x00
+	replyGeneralFailure      = 0x01
+	replyCommandUnsupported  = 0x07
+	replyAddrTypeUnsupported = 0x08
+)
+
+// passwordVersion is the version of the username/password
+// subnegotiation of RFC 1929.
+const passwordVersion = 1
+
+var (
+	errVersion        = errors.New("socks: unsupported protocol version")
+	errNoMethod       = errors.New("socks: no acceptable authentication method")
+	errAuthFailed     = errors.New("socks: username/password authentication failed")
+	errCommand        = errors.New("socks: unsupported command")
+	errAddrType       = errors.New("socks: unsupported address type")
+	errNoDialFunction = errors.New("socks: Server.Dial is nil")
+)
+
+// Server is a SOCKS5 server.
+type Server struct {
+	// Dial connects to the host:port addr on the network "tcp",
+	// typically through ssh.ClientConn.Dial.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// PasswordCallback, if non-nil, requires clients to authenticate
+	// with a username and password, as in RFC 1929, and is called to
+	// check them. Otherwise clients are not authenticated.
+	PasswordCallback func(user, password string) bool
+
+	// ReportCallback, if non-nil, is called whenever the server has
+	// finished with a connection.
+	ReportCallback func(r *Report)
+}
+
+// Report describes a connection that the server has finished with.
+type Report struct {
+	// ClientAddr is the address of the SOCKS client.
+	ClientAddr net.Addr
+
+	// User is the name the client authenticated with, if any.
+	User string
+
+	// Target is the host:port the client asked to connect to, or
+	// empty if the client did not get that far.
+	Target string
+
+	// Sent and Received count the bytes copied from the client to
+	// the target and from the target to the client.
+	Sent, Received int64
+
+	// Err is the first error that happened on the connection, or nil
+	// if both sides closed it normally.
+	Err error
+}
+
+// Serve accepts connections on l and serves each of them in a new
+// goroutine. It returns when Accept fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a single SOCKS connection and closes it. It returns
+// the error that is reported for the connection.
+func (s *Server) ServeConn(conn net.Conn) error {
+	r := &Report{ClientAddr: conn.RemoteAddr()}
+	r.Err = s.serve(conn, r)
+	if s.ReportCallback != nil {
+		s.ReportCallback(r)
+	}
+	return r.Err
+}
+
+func (s *Server) serve(conn net.Conn, r *Report) error {
+	if err := s.authenticate(conn, r); err != nil {
+		conn.Close()
+		return err
+	}
+	target, err := s.connect(conn, r)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return relay(conn, target, r)
+}
+
+// authenticate negotiates the authentication method with the client
+// and carries it out.
+func (s *Server) authenticate(conn net.Conn, r *Report) error {
+	var buf [255]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socksVersion {
+		return errVersion
+	}
+	methods := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+
+	want := byte(methodNone)
+	if s.PasswordCallback != nil {
+		want = methodPassword
+	}
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return err
+	}
+
+	switch method {
+	case methodNone:
+		return nil
+	case methodPassword:
+		return s.checkPassword(conn, r)
+	}
+	return errNoMethod
+}
+
+// checkPassword reads and checks the username and password of RFC
+// 1929.
+func (s *Server) checkPassword(conn net.Conn, r *Report) error {
+	var buf [255]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != passwordVersion {
+		return errVersion
+	}
+	user := buf[:buf[1]]
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	r.User = string(user)
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return err
+	}
+	password := buf[:buf[0]]
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+
+	if !s.PasswordCallback(r.User, string(password)) {
+		// Any status other than zero is a failure.
+		conn.Write([]byte{passwordVersion, 1})
+		return errAuthFailed
+	}
+	_, err := conn.Write([]byte{passwordVersion, 0})
+	return err
+}
+
+// connect reads the request of the client, dials its target and
+// replies with the outcome.
+func (s *Server) connect(conn net.Conn, r *Report) (net.Conn, error) {
+	var buf [255]byte
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, errVersion
+	}
+	cmd, addrType := buf[1], buf[3]
+
+	var host string
+	switch addrType {
+	case addrIPv4, addrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if addrType == addrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case addrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return nil, err
+		}
+		name := buf[:buf[0]]
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		sendReply(conn, replyAddrTypeUnsupported, nil)
+		return nil, errAddrType
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	port := int(buf[0])<<8 | int(buf[1])
+	r.Target = net.JoinHostPort(host, strconv.Itoa(port))
+
+	if cmd != cmdConnect {
+		sendReply(conn, replyCommandUnsupported, nil)
+		return nil, errCommand
+	}
+	if s.Dial == nil {
+		sendReply(conn, replyGeneralFailure, nil)
+		return nil, errNoDialFunction
+	}
+	target, err := s.Dial("tcp", r.Target)
+	if err != nil {
+		sendReply(conn, replyGeneralFailure, nil)
+		return nil, err
+	}
+	if err := sendReply(conn, replySucceeded, target.LocalAddr()); err != nil {
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+// sendReply writes a reply with the bound address addr. Addresses that
+// are not TCP addresses are sent as 0.0.0.0:0.
+func sendReply(conn net.Conn, reply byte, addr net.Addr) error {
+	ip, port := net.IPv4zero.To4(), 0
+	if a, ok := addr.(*net.TCPAddr); ok {
+		ip, port = a.IP, a.Port
+	}
+	msg := []byte{socksVersion, reply, 0, addrIPv4}
+	if ip4 := ip.To4(); ip4 != nil {
+		msg = append(msg, ip4...)
+	} else {
+		msg[3] = addrIPv6
+		msg = append(msg, ip.To16()...)
+	}
+	msg = append(msg, byte(port>>8), byte(port))
+	_, err := conn.Write(msg)
+	return err
+}
+
+// closeWriter is implemented by connections that can be half closed,
+// such as *net.TCPConn and those of ssh.ClientConn.Dial.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies data between client and target until both directions
+// are done, then closes them. The end of one direction is passed on as
+// a half close where possible. After an error, both connections are
+// closed at once.
+func relay(client, target net.Conn, r *Report) error {
+	type result struct {
+		sent bool
+		n    int64
+		err  error
+	}
+	results := make(chan result, 2)
+	copyConn := func(dst, src net.Conn, sent bool) {
+		n, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+			src.Close()
+		}
+		results <- result{sent, n, err}
+	}
+	go copyConn(target, client, true)
+	go copyConn(client, target, false)
+
+	var firstErr error
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.sent {
+			r.Sent = res.n
+		} else {
+			r.Received = res.n
+		}
+		if firstErr == nil {
+			firstErr = res.err
+		}
+	}
+	client.Close()
+	target.Close()
+	return firstErr
+}
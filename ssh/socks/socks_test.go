@@ -0,0 +1,236 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// listenEcho starts a TCP server that reads until EOF and then writes
+// back what it got, prefixed with "echo:".
+func listenEcho(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			data, _ := ioutil.ReadAll(conn)
+			conn.Write(append([]byte("echo:"), data...))
+			conn.Close()
+		}
+	}()
+	return l
+}
+
+// startServer serves s on a new listener and returns the listener and
+// a channel that receives the reports of s.
+func startServer(t *testing.T, s *Server) (net.Listener, chan *Report) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	reports := make(chan *Report, 1)
+	s.ReportCallback = func(r *Report) { reports <- r }
+	go s.Serve(l)
+	return l, reports
+}
+
+// handshake connects to the server at addr, offering the given
+// authentication methods, and returns the method the server chose.
+func handshake(t *testing.T, addr string, methods ...byte) (net.Conn, byte) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		t.Fatalf("reading method: %v", err)
+	}
+	return conn, reply[1]
+}
+
+// request sends a CONNECT request for the address, encoded as addrType,
+// and returns the reply code.
+func request(t *testing.T, conn net.Conn, cmd, addrType byte, addr []byte, port int) byte {
+	msg := []byte{socksVersion, cmd, 0, addrType}
+	if addrType == addrDomain {
+		msg = append(msg, byte(len(addr)))
+	}
+	msg = append(msg, addr...)
+	conn.Write(append(msg, byte(port>>8), byte(port)))
+	return readReply(t, conn)
+}
+
+// readReply reads the reply to a request and returns the reply code.
+func readReply(t *testing.T, conn net.Conn) byte {
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		t.Fatalf("reading reply: %v", err)
+	}
+	bound := net.IPv4len
+	if reply[3] == addrIPv6 {
+		bound = net.IPv6len
+	}
+	if _, err := io.ReadFull(conn, make([]byte, bound+2)); err != nil {
+		t.Fatalf("reading bound address: %v", err)
+	}
+	return reply[1]
+}
+
+func TestConnect(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+
+	var dialed string
+	l, reports := startServer(t, &Server{
+		Dial: func(network, addr string) (net.Conn, error) {
+			dialed = addr
+			return net.Dial(network, echo.Addr().String())
+		},
+	})
+	defer l.Close()
+
+	for _, c := range []struct {
+		addrType byte
+		addr     []byte
+		want     string
+	}{
+		{addrIPv4, []byte{192, 0, 2, 1}, "192.0.2.1:8080"},
+		{addrIPv6, net.ParseIP("2001:db8::1"), "[2001:db8::1]:8080"},
+		{addrDomain, []byte("intranet.example.com"), "intranet.example.com:8080"},
+	} {
+		conn, method := handshake(t, l.Addr().String(), methodPassword, methodNone)
+		if method != methodNone {
+			t.Fatalf("got method %d, want %d", method, methodNone)
+		}
+		if reply := request(t, conn, cmdConnect, c.addrType, c.addr, 8080); reply != replySucceeded {
+			t.Fatalf("%s: got reply %d", c.want, reply)
+		}
+		conn.Write([]byte("hello"))
+		conn.(*net.TCPConn).CloseWrite()
+		got, err := ioutil.ReadAll(conn)
+		if err != nil || string(got) != "echo:hello" {
+			t.Errorf("%s: got %q, %v, want %q", c.want, got, err, "echo:hello")
+		}
+		conn.Close()
+
+		r := <-reports
+		if dialed != c.want || r.Target != c.want {
+			t.Errorf("dialed %q, reported %q, want %q", dialed, r.Target, c.want)
+		}
+		if r.Err != nil || r.Sent != 5 || r.Received != 10 {
+			t.Errorf("%s: got report %+v", c.want, r)
+		}
+	}
+}
+
+func TestPassword(t *testing.T) {
+	echo := listenEcho(t)
+	defer echo.Close()
+
+	l, reports := startServer(t, &Server{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return net.Dial(network, echo.Addr().String())
+		},
+		PasswordCallback: func(user, password string) bool {
+			return user == "gopher" && password == "secret"
+		},
+	})
+	defer l.Close()
+
+	conn, method := handshake(t, l.Addr().String(), methodNone)
+	if method != methodNoAcceptable {
+		t.Errorf("got method %d without a password, want %d", method, methodNoAcceptable)
+	}
+	conn.Close()
+	if r := <-reports; r.Err != errNoMethod {
+		t.Errorf("got error %v, want %v", r.Err, errNoMethod)
+	}
+
+	for _, password := range []string{"wrong", "secret"} {
+		conn, method := handshake(t, l.Addr().String(), methodNone, methodPassword)
+		if method != methodPassword {
+			t.Fatalf("got method %d, want %d", method, methodPassword)
+		}
+		msg := append([]byte{passwordVersion, 6}, "gopher"...)
+		msg = append(append(msg, byte(len(password))), password...)
+		conn.Write(msg)
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			t.Fatalf("reading status: %v", err)
+		}
+		if ok := status[1] == 0; ok != (password == "secret") {
+			t.Errorf("password %q: got status %d", password, status[1])
+		}
+		if password == "secret" {
+			request(t, conn, cmdConnect, addrIPv4, []byte{127, 0, 0, 1}, 80)
+			conn.(*net.TCPConn).CloseWrite()
+			ioutil.ReadAll(conn)
+		}
+		conn.Close()
+		if r := <-reports; r.User != "gopher" {
+			t.Errorf("got user %q, want %q", r.User, "gopher")
+		}
+	}
+}
+
+func TestConnectErrors(t *testing.T) {
+	errRefused := errors.New("administratively prohibited")
+	l, reports := startServer(t, &Server{
+		Dial: func(network, addr string) (net.Conn, error) {
+			return nil, errRefused
+		},
+	})
+	defer l.Close()
+
+	for _, c := range []struct {
+		cmd, reply byte
+		err        error
+	}{
+		{cmdConnect, replyGeneralFailure, errRefused},
+		{0x02 /* BIND */, replyCommandUnsupported, errCommand},
+		{0x00 /* unknown address type */, replyAddrTypeUnsupported, errAddrType},
+	} {
+		conn, _ := handshake(t, l.Addr().String(), methodNone)
+		var reply byte
+		if c.cmd == 0 {
+			// The server stops reading after the address type.
+			conn.Write([]byte{socksVersion, cmdConnect, 0, 0x05})
+			reply = readReply(t, conn)
+		} else {
+			reply = request(t, conn, c.cmd, addrIPv4, []byte{10, 0, 0, 1}, 22)
+		}
+		if reply != c.reply {
+			t.Errorf("got reply %d, want %d", reply, c.reply)
+		}
+		if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+			t.Errorf("connection still open after a failed request")
+		}
+		conn.Close()
+		if r := <-reports; r.Err != c.err {
+			t.Errorf("got error %v, want %v", r.Err, c.err)
+		}
+	}
+}
+
+func TestBadVersion(t *testing.T) {
+	s := &Server{}
+	client, server := net.Pipe()
+	go client.Write([]byte{4, 1, 0})
+	if err := s.ServeConn(server); err != errVersion {
+		t.Errorf("got %v, want %v", err, errVersion)
+	}
+	client.Close()
+}
@@ -0,0 +1,224 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// These are the names OpenSSH uses for forwarding unix domain sockets,
+// described in PROTOCOL in the OpenSSH sources.
+const (
+	streamLocalForwardRequest       = "streamlocal-forward@openssh.com"
+	cancelStreamLocalForwardRequest = "cancel-streamlocal-forward@openssh.com"
+	forwardedStreamLocalChannelType = "forwarded-streamlocal@openssh.com"
+	directStreamLocalChannelType    = "direct-streamlocal@openssh.com"
+)
+
+// streamLocalChannelForwardMsg is the OpenSSH counterpart of
+// channelForwardMsg for unix sockets.
+type streamLocalChannelForwardMsg struct {
+	Message    string
+	WantReply  bool
+	socketPath string
+}
+
+// ListenUnix requests the remote peer open a listening unix socket at
+// socketPath. Incoming connections will be available by calling Accept
+// on the returned net.Listener.
+func (c *ClientConn) ListenUnix(socketPath string) (net.Listener, error) {
+	m := streamLocalChannelForwardMsg{
+		streamLocalForwardRequest,
+		true, // sendGlobalRequest waits for a reply
+		socketPath,
+	}
+	if _, err := c.sendGlobalRequest(m); err != nil {
+		return nil, err
+	}
+	laddr := &net.UnixAddr{Name: socketPath, Net: "unix"}
+	ch := c.forwardList.add(laddr)
+	return &unixListener{laddr, c, ch}, nil
+}
+
+type unixListener struct {
+	laddr *net.UnixAddr
+
+	conn *ClientConn
+	in   <-chan forward
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *unixListener) Accept() (net.Conn, error) {
+	s, ok := <-l.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return &tcpChanConn{
+		tcpChan: &tcpChan{
+			clientChan: s.c,
+			Reader:     s.c.stdout,
+			Writer:     s.c.stdin,
+		},
+		laddr: l.laddr,
+		raddr: s.raddr,
+	}, nil
+}
+
+// Close closes the listener.
+func (l *unixListener) Close() error {
+	m := streamLocalChannelForwardMsg{
+		cancelStreamLocalForwardRequest,
+		true,
+		l.laddr.Name,
+	}
+	l.conn.forwardList.remove(l.laddr)
+	if _, err := l.conn.sendGlobalRequest(m); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Addr returns the listener's network address.
+func (l *unixListener) Addr() net.Addr {
+	return l.laddr
+}
+
+// handleStreamLocalChanOpen passes a forwarded-streamlocal channel to
+// the listener for its socket.
+func (c *ClientConn) handleStreamLocalChanOpen(msg *channelOpenMsg) {
+	socketPath, rest, ok := parseString(msg.TypeSpecificData)
+	if !ok {
+		// invalid request
+		c.sendConnectionFailed(msg.PeersId)
+		return
+	}
+	if _, _, ok = parseString(rest); !ok {
+		c.sendConnectionFailed(msg.PeersId)
+		return
+	}
+	l, ok := c.forwardList.lookup(&net.UnixAddr{Name: string(socketPath), Net: "unix"})
+	if !ok {
+		// Section 7.2, implementations MUST reject suprious incoming
+		// connections.
+		c.sendConnectionFailed(msg.PeersId)
+		return
+	}
+	ch := c.acceptChan(msg)
+	l <- forward{ch, &net.UnixAddr{Net: "unix"}}
+}
+
+// channelOpenDirectStreamLocalMsg is the OpenSSH counterpart of
+// channelOpenDirectMsg for unix sockets.
+type channelOpenDirectStreamLocalMsg struct {
+	ChanType      string
+	PeersId       uint32
+	PeersWindow   uint32
+	MaxPacketSize uint32
+	socketPath    string
+	reserved0     string
+	reserved1     uint32
+}
+
+// DialUnix connects to the unix socket at socketPath on the remote host.
+// The resulting connection has a zero LocalAddr().
+func (c *ClientConn) DialUnix(socketPath string) (net.Conn, error) {
+	ch := c.newChan(c.transport)
+	if err := c.writePacket(marshal(msgChannelOpen, channelOpenDirectStreamLocalMsg{
+		ChanType:      directStreamLocalChannelType,
+		PeersId:       ch.localId,
+		PeersWindow:   1 << 14,
+		MaxPacketSize: 1 << 15, // RFC 4253 6.1
+		socketPath:    socketPath,
+	})); err != nil {
+		c.chanList.remove(ch.localId)
+		return nil, err
+	}
+	if err := ch.waitForChannelOpenResponse(); err != nil {
+		c.chanList.remove(ch.localId)
+		return nil, fmt.Errorf("ssh: unable to open direct streamlocal connection: %v", err)
+	}
+	return &tcpChanConn{
+		tcpChan: &tcpChan{
+			clientChan: ch,
+			Reader:     ch.stdout,
+			Writer:     ch.stdin,
+		},
+		laddr: &net.UnixAddr{Net: "unix"},
+		raddr: &net.UnixAddr{Name: socketPath, Net: "unix"},
+	}, nil
+}
+
+// ParseDirectStreamLocal decodes the extra data of a
+// direct-streamlocal@openssh.com channel, as returned by
+// Channel.ExtraData, and returns the path of the unix socket that the
+// client wants to connect to.
+func ParseDirectStreamLocal(extraData []byte) (socketPath string, err error) {
+	path, rest, ok := parseString(extraData)
+	if !ok {
+		return "", errDirectStreamLocal
+	}
+	if _, rest, ok = parseString(rest); !ok {
+		return "", errDirectStreamLocal
+	}
+	if _, rest, ok = parseUint32(rest); !ok || len(rest) != 0 {
+		return "", errDirectStreamLocal
+	}
+	return string(path), nil
+}
+
+var errDirectStreamLocal = errors.New("ssh: invalid direct-streamlocal channel data")
+
+// permitsDirectStreamLocal reports whether the client may open a
+// direct-streamlocal channel to the socket in extraData.
+func (s *ServerConn) permitsDirectStreamLocal(extraData []byte) bool {
+	path, err := ParseDirectStreamLocal(extraData)
+	if err != nil || !s.Permissions.permits(CertExtPermitPortForwarding) {
+		return false
+	}
+	if cb := s.config.LocalUnixForwardCallback; cb != nil {
+		return cb(s, path)
+	}
+	return true
+}
+
+// startStreamLocalForward listens on the socket of a
+// streamlocal-forward request.
+func (s *ServerConn) startStreamLocalForward(data []byte) bool {
+	cb := s.config.RemoteUnixForwardCallback
+	if cb == nil || !s.Permissions.permits(CertExtPermitPortForwarding) {
+		return false
+	}
+	path, data, ok := parseString(data)
+	if !ok || len(data) != 0 || !cb(s, string(path)) {
+		return false
+	}
+	l, err := net.Listen("unix", string(path))
+	if err != nil {
+		return false
+	}
+	if !s.forwards.add(forwardKey{"unix", string(path)}, l) {
+		l.Close()
+		return false
+	}
+
+	chanData := appendString(appendString(nil, string(path)), "")
+	go s.serveRemoteForward(l, forwardedStreamLocalChannelType, func(net.Conn) []byte {
+		return chanData
+	})
+	return true
+}
+
+// cancelStreamLocalForward stops the forward of a
+// cancel-streamlocal-forward request.
+func (s *ServerConn) cancelStreamLocalForward(data []byte) bool {
+	path, data, ok := parseString(data)
+	if !ok || len(data) != 0 {
+		return false
+	}
+	return s.forwards.remove(forwardKey{"unix", string(path)})
+}
@@ -0,0 +1,108 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDirectStreamLocal(t *testing.T) {
+	data := appendU32(appendString(appendString(nil, "/run/docker.sock"), ""), 0)
+	path, err := ParseDirectStreamLocal(data)
+	if err != nil || path != "/run/docker.sock" {
+		t.Errorf("got %q, %v, want %q", path, err, "/run/docker.sock")
+	}
+	if _, err := ParseDirectStreamLocal(data[:len(data)-1]); err == nil {
+		t.Errorf("truncated data accepted")
+	}
+}
+
+func TestServerDirectStreamLocal(t *testing.T) {
+	client := dialForwardingServer(t)
+	defer client.Close()
+
+	for _, dial := range []func(string) (net.Conn, error){
+		client.DialUnix,
+		func(path string) (net.Conn, error) { return client.Dial("unix", path) },
+	} {
+		conn, err := dial("/run/docker.sock")
+		if err != nil {
+			t.Fatalf("DialUnix: %v", err)
+		}
+		got, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if string(got) != "/run/docker.sock" {
+			t.Errorf("got %q, want %q", got, "/run/docker.sock")
+		}
+		if addr := conn.RemoteAddr().String(); addr != "/run/docker.sock" {
+			t.Errorf("got remote address %q", addr)
+		}
+		conn.Close()
+	}
+
+	if _, err := client.DialUnix("/forbidden.sock"); err == nil {
+		t.Errorf("forwarding to a socket refused by the callback succeeded")
+	}
+}
+
+func TestServerStreamLocalForward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "streamlocal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := dialForwardingServer(t)
+	defer client.Close()
+
+	if _, err := client.ListenUnix(filepath.Join(dir, "forbidden.sock")); err == nil {
+		t.Errorf("forward refused by the callback succeeded")
+	}
+
+	path := filepath.Join(dir, "app.sock")
+	l, err := client.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("ListenUnix: %v", err)
+	}
+	if addr := l.Addr().String(); addr != path {
+		t.Errorf("got listener address %q, want %q", addr, path)
+	}
+
+	go func() {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Errorf("net.Dial: %v", err)
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	got, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+	conn.Close()
+
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		t.Errorf("server still listening after the forward was cancelled")
+	}
+}
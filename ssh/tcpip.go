@@ -18,8 +18,12 @@ import (
 
 // Listen requests the remote peer open a listening socket
 // on addr. Incoming connections will be available by calling
-// Accept on the returned net.Listener.
+// Accept on the returned net.Listener. If n is "unix", addr is
+// the path of a unix socket, as with ListenUnix.
 func (c *ClientConn) Listen(n, addr string) (net.Listener, error) {
+	if n == "unix" {
+		return c.ListenUnix(addr)
+	}
 	laddr, err := net.ResolveTCPAddr(n, addr)
 	if err != nil {
 		return nil, err
@@ -114,7 +118,8 @@ func (c *ClientConn) ListenTCP(laddr *net.TCPAddr) (net.Listener, error) {
 	}
 
 	// Register this forward, using the port number we obtained.
-	ch := c.forwardList.add(*laddr)
+	addr := *laddr
+	ch := c.forwardList.add(&addr)
 
 	return &tcpListener{laddr, c, ch}, nil
 }
@@ -129,19 +134,33 @@ type forwardList struct {
 // forwardEntry represents an established mapping of a laddr on a
 // remote ssh server to a channel connected to a tcpListener.
 type forwardEntry struct {
-	laddr net.TCPAddr
+	laddr net.Addr
 	c     chan forward
 }
 
-// forward represents an incoming forwarded tcpip connection. The
-// arguments to add/remove/lookup should be address as specified in
-// the original forward-request.
+// forward represents an incoming forwarded tcpip or streamlocal
+// connection. The arguments to add/remove/lookup should be address as
+// specified in the original forward-request.
 type forward struct {
-	c     *clientChan  // the ssh client channel underlying this forward
-	raddr *net.TCPAddr // the raddr of the incoming connection
+	c     *clientChan // the ssh client channel underlying this forward
+	raddr net.Addr    // the raddr of the incoming connection
+}
+
+// sameAddr reports whether a and b are the same TCP address or unix
+// socket.
+func sameAddr(a, b net.Addr) bool {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		b, ok := b.(*net.TCPAddr)
+		return ok && a.IP.Equal(b.IP) && a.Port == b.Port
+	case *net.UnixAddr:
+		b, ok := b.(*net.UnixAddr)
+		return ok && a.Name == b.Name
+	}
+	return false
 }
 
-func (l *forwardList) add(addr net.TCPAddr) chan forward {
+func (l *forwardList) add(addr net.Addr) chan forward {
 	l.Lock()
 	defer l.Unlock()
 	f := forwardEntry{
@@ -154,11 +173,11 @@ func (l *forwardList) add(addr net.TCPAddr) chan forward {
 
 // remove removes the forward entry, and the channel feeding its
 // listener.
-func (l *forwardList) remove(addr net.TCPAddr) {
+func (l *forwardList) remove(addr net.Addr) {
 	l.Lock()
 	defer l.Unlock()
 	for i, f := range l.entries {
-		if addr.IP.Equal(f.laddr.IP) && addr.Port == f.laddr.Port {
+		if sameAddr(addr, f.laddr) {
 			l.entries = append(l.entries[:i], l.entries[i+1:]...)
 			close(f.c)
 			return
@@ -176,11 +195,11 @@ func (l *forwardList) closeAll() {
 	l.entries = nil
 }
 
-func (l *forwardList) lookup(addr net.TCPAddr) (chan forward, bool) {
+func (l *forwardList) lookup(addr net.Addr) (chan forward, bool) {
 	l.Lock()
 	defer l.Unlock()
 	for _, f := range l.entries {
-		if addr.IP.Equal(f.laddr.IP) && addr.Port == f.laddr.Port {
+		if sameAddr(addr, f.laddr) {
 			return f.c, true
 		}
 	}
@@ -219,7 +238,7 @@ func (l *tcpListener) Close() error {
 		l.laddr.IP.String(),
 		uint32(l.laddr.Port),
 	}
-	l.conn.forwardList.remove(*l.laddr)
+	l.conn.forwardList.remove(l.laddr)
 	if _, err := l.conn.sendGlobalRequest(m); err != nil {
 		return err
 	}
@@ -233,7 +252,11 @@ func (l *tcpListener) Addr() net.Addr {
 
 // Dial initiates a connection to the addr from the remote host.
 // The resulting connection has a zero LocalAddr() and RemoteAddr().
+// If n is "unix", addr is the path of a unix socket, as with DialUnix.
 func (c *ClientConn) Dial(n, addr string) (net.Conn, error) {
+	if n == "unix" {
+		return c.DialUnix(addr)
+	}
 	// Parse the address into host and numeric port.
 	host, portString, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -343,6 +366,12 @@ func (t *tcpChanConn) RemoteAddr() net.Addr {
 	return t.raddr
 }
 
+// CloseWrite signals the remote end that no more data will be
+// sent, while data can still be read from the connection.
+func (t *tcpChanConn) CloseWrite() error {
+	return t.clientChan.stdin.Close()
+}
+
 // SetDeadline sets the read and write deadlines associated
 // with the connection.
 func (t *tcpChanConn) SetDeadline(deadline time.Time) error {
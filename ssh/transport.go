@@ -7,14 +7,12 @@ package ssh
 import (
 	"bufio"
 	"crypto"
-	"crypto/cipher"
-	"crypto/subtle"
-	"encoding/binary"
 	"errors"
 	"hash"
 	"io"
 	"net"
 	"sync"
+	"time"
 )
 
 const (
@@ -45,6 +43,19 @@ type transport struct {
 	writer
 
 	net.Conn
+
+	// kex runs a key exchange started by either side, given our
+	// KEXINIT packet and the peer's. It is set once the initial key
+	// exchange is done; until then readPacket returns KEXINIT messages
+	// to its caller.
+	kex func(ourKexInit, theirKexInit []byte) error
+
+	// inKex is set while readPacket runs kex.
+	inKex bool
+
+	// extensions holds the extensions announced by the peer in an
+	// SSH_MSG_EXT_INFO message, see RFC 8308.
+	extensions map[string]string
 }
 
 // reader represents the incoming connection state.
@@ -59,90 +70,133 @@ type writer struct {
 	*bufio.Writer
 	rand io.Reader
 	common
+
+	// kexInit returns our KEXINIT packet.
+	kexInit func() []byte
+
+	// pendingKexInit holds the KEXINIT packet we sent for the key
+	// exchange in progress, if any. Until the new keys are in use,
+	// other messages are held in queued.
+	pendingKexInit []byte
+	queued         [][]byte
+
+	// kexDone is signalled, with the Mutex held, when a key exchange
+	// completes or kexErr is set.
+	kexDone *sync.Cond
+	kexErr  error
 }
 
 // common represents the cipher state needed to process messages in a single
 // direction.
 type common struct {
-	seqNum uint32
-	mac    hash.Hash
-	cipher cipher.Stream
+	seqNum       uint32
+	packetCipher packetCipher
 
 	cipherAlgo      string
 	macAlgo         string
 	compressionAlgo string
+
+	// compression, if set, compresses outgoing or decompresses
+	// incoming payloads. newCompression creates it for the direction.
+	// zlib@openssh.com is only used once authenticated is set.
+	compression    packetCompression
+	newCompression func() packetCompression
+	authenticated  bool
+
+	// bytes counts the packet data processed since the keys were
+	// set up at keyTime. A key exchange is due once either exceeds
+	// its limit.
+	bytes          uint64
+	keyTime        time.Time
+	rekeyThreshold uint64
+	rekeyInterval  time.Duration
 }
 
-// Read and decrypt a single packet from the remote peer.
-func (r *reader) readOnePacket() ([]byte, error) {
-	var lengthBytes = make([]byte, 5)
-	var macSize uint32
-	if _, err := io.ReadFull(r, lengthBytes); err != nil {
-		return nil, err
+// needsKeyChange reports whether the current keys have reached their
+// byte or time limit.
+func (c *common) needsKeyChange() bool {
+	if c.keyTime.IsZero() {
+		// The initial key exchange is still running.
+		return false
 	}
+	return c.bytes >= c.rekeyThreshold || time.Since(c.keyTime) >= c.rekeyInterval
+}
 
-	r.cipher.XORKeyStream(lengthBytes, lengthBytes)
+// isKexMsg reports whether msg may be sent while a key exchange is in
+// progress, as listed in RFC 4253, section 7.1.
+func isKexMsg(msg byte) bool {
+	return msg < 50 && msg != msgServiceRequest && msg != msgServiceAccept
+}
 
-	if r.mac != nil {
-		r.mac.Reset()
-		seqNumBytes := []byte{
-			byte(r.seqNum >> 24),
-			byte(r.seqNum >> 16),
-			byte(r.seqNum >> 8),
-			byte(r.seqNum),
+// Read and decrypt a single packet from the remote peer.
+func (r *reader) readOnePacket() ([]byte, error) {
+	packet, err := r.packetCipher.readPacket(r.seqNum, r.Reader)
+	if err != nil {
+		if r.compression != nil {
+			r.compression.close()
+			r.compression = nil
 		}
-		r.mac.Write(seqNumBytes)
-		r.mac.Write(lengthBytes)
-		macSize = uint32(r.mac.Size())
-	}
-
-	length := binary.BigEndian.Uint32(lengthBytes[0:4])
-	paddingLength := uint32(lengthBytes[4])
-
-	if length <= paddingLength+1 {
-		return nil, errors.New("ssh: invalid packet length, packet too small")
-	}
-
-	if length > maxPacket {
-		return nil, errors.New("ssh: invalid packet length, packet too large")
-	}
-
-	packet := make([]byte, length-1+macSize)
-	if _, err := io.ReadFull(r, packet); err != nil {
 		return nil, err
 	}
-	mac := packet[length-1:]
-	r.cipher.XORKeyStream(packet, packet[:length-1])
-
-	if r.mac != nil {
-		r.mac.Write(packet[:length-1])
-		if subtle.ConstantTimeCompare(r.mac.Sum(nil), mac) != 1 {
-			return nil, errors.New("ssh: MAC failure")
-		}
-	}
-
 	r.seqNum++
-	return packet[:length-paddingLength-1], nil
+	r.bytes += uint64(len(packet))
+	if r.compression != nil {
+		return r.compression.transform(packet)
+	}
+	return packet, nil
 }
 
 // Read and decrypt next packet discarding debug and noop messages.
+// Once the initial key exchange is done, key exchanges started by the
+// peer are run here as well.
 func (t *transport) readPacket() ([]byte, error) {
 	for {
 		packet, err := t.readOnePacket()
 		if err != nil {
+			t.writer.fail(err)
 			return nil, err
 		}
 		if len(packet) == 0 {
 			return nil, errors.New("ssh: zero length packet")
 		}
-		if packet[0] != msgIgnore && packet[0] != msgDebug {
-			return packet, nil
+		switch {
+		case packet[0] == msgIgnore || packet[0] == msgDebug:
+			continue
+		case packet[0] == msgExtInfo:
+			if t.extensions, err = parseExtInfo(packet); err != nil {
+				return nil, err
+			}
+			continue
+		case packet[0] == msgKexInit && t.kex != nil && !t.inKex:
+			if err := t.runKex(packet); err != nil {
+				t.writer.fail(err)
+				return nil, err
+			}
+			continue
+		case !isKexMsg(packet[0]) && t.reader.needsKeyChange():
+			if _, err := t.sendKexInit(); err != nil {
+				return nil, err
+			}
 		}
+		return packet, nil
 	}
 	panic("unreachable")
 }
 
-// Encrypt and send a packet of data to the remote peer.
+// runKex answers a KEXINIT from the peer and runs the key exchange.
+func (t *transport) runKex(theirKexInit []byte) error {
+	ourKexInit, err := t.sendKexInit()
+	if err != nil {
+		return err
+	}
+	t.inKex = true
+	defer func() { t.inKex = false }()
+	return t.kex(ourKexInit, theirKexInit)
+}
+
+// Encrypt and send a packet of data to the remote peer. While a key
+// exchange is in progress, only key exchange messages are sent; others
+// are queued until the new keys are in use.
 func (w *writer) writePacket(packet []byte) error {
 	if len(packet) > maxPacket {
 		return errors.New("ssh: packet too large")
@@ -150,82 +204,161 @@ func (w *writer) writePacket(packet []byte) error {
 	w.Mutex.Lock()
 	defer w.Mutex.Unlock()
 
-	paddingLength := packetSizeMultiple - (5+len(packet))%packetSizeMultiple
-	if paddingLength < 4 {
-		paddingLength += packetSizeMultiple
+	if len(packet) > 0 && !isKexMsg(packet[0]) {
+		if w.pendingKexInit == nil && w.needsKeyChange() {
+			if err := w.sendKexInitLocked(); err != nil {
+				return err
+			}
+		}
+		if w.pendingKexInit != nil {
+			if w.kexErr != nil {
+				return w.kexErr
+			}
+			// packet is encrypted in place when it is sent, so
+			// the caller's copy must not be kept.
+			w.queued = append(w.queued, append([]byte(nil), packet...))
+			return nil
+		}
 	}
+	return w.writePacketLocked(packet)
+}
 
-	length := len(packet) + 1 + paddingLength
-	lengthBytes := []byte{
-		byte(length >> 24),
-		byte(length >> 16),
-		byte(length >> 8),
-		byte(length),
-		byte(paddingLength),
+// writePacketLocked sends packet. w.Mutex must be held.
+func (w *writer) writePacketLocked(packet []byte) error {
+	if w.compression != nil {
+		var err error
+		if packet, err = w.compression.transform(packet); err != nil {
+			return err
+		}
 	}
-	padding := make([]byte, paddingLength)
-	_, err := io.ReadFull(w.rand, padding)
-	if err != nil {
+	if err := w.packetCipher.writePacket(w.seqNum, w.Writer, w.rand, packet); err != nil {
 		return err
 	}
+	w.seqNum++
+	w.bytes += uint64(len(packet))
+	return w.Flush()
+}
 
-	if w.mac != nil {
-		w.mac.Reset()
-		seqNumBytes := []byte{
-			byte(w.seqNum >> 24),
-			byte(w.seqNum >> 16),
-			byte(w.seqNum >> 8),
-			byte(w.seqNum),
+// sendKexInit sends our KEXINIT message, unless one was already sent
+// for the key exchange in progress, and returns it.
+func (w *writer) sendKexInit() ([]byte, error) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	if w.pendingKexInit == nil {
+		if err := w.sendKexInitLocked(); err != nil {
+			return nil, err
 		}
-		w.mac.Write(seqNumBytes)
-		w.mac.Write(lengthBytes)
-		w.mac.Write(packet)
-		w.mac.Write(padding)
 	}
+	return w.pendingKexInit, nil
+}
 
-	// TODO(dfc) lengthBytes, packet and padding should be
-	// subslices of a single buffer
-	w.cipher.XORKeyStream(lengthBytes, lengthBytes)
-	w.cipher.XORKeyStream(packet, packet)
-	w.cipher.XORKeyStream(padding, padding)
-
-	if _, err := w.Write(lengthBytes); err != nil {
+// sendKexInitLocked starts a key exchange. w.Mutex must be held.
+func (w *writer) sendKexInitLocked() error {
+	packet := w.kexInit()
+	if err := w.writePacketLocked(append([]byte(nil), packet...)); err != nil {
 		return err
 	}
-	if _, err := w.Write(packet); err != nil {
+	w.pendingKexInit = packet
+	return nil
+}
+
+// sendNewKeys sends NEWKEYS and switches to the keys derived from K,
+// H and sessionId, then sends the messages queued during the key
+// exchange.
+func (w *writer) sendNewKeys(d direction, K, H, sessionId []byte, hashFunc crypto.Hash) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	if err := w.writePacketLocked([]byte{msgNewKeys}); err != nil {
 		return err
 	}
-	if _, err := w.Write(padding); err != nil {
+	if err := w.setupKeys(d, K, H, sessionId, hashFunc); err != nil {
 		return err
 	}
+	w.pendingKexInit = nil
+	w.kexDone.Broadcast()
 
-	if w.mac != nil {
-		if _, err := w.Write(w.mac.Sum(nil)); err != nil {
+	queued := w.queued
+	w.queued = nil
+	for _, packet := range queued {
+		if err := w.writePacketLocked(packet); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	w.seqNum++
-	return w.Flush()
+// requestKeyChange starts a key exchange, unless one is in progress,
+// and waits until the new keys are used for sending.
+func (w *writer) requestKeyChange() error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	if w.pendingKexInit == nil {
+		if err := w.sendKexInitLocked(); err != nil {
+			return err
+		}
+	}
+	for w.pendingKexInit != nil {
+		if w.kexErr != nil {
+			return w.kexErr
+		}
+		w.kexDone.Wait()
+	}
+	return nil
+}
+
+// fail records that no further key exchange can complete, because
+// reading from the peer failed with err.
+func (w *writer) fail(err error) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+
+	if w.kexErr == nil {
+		w.kexErr = err
+	}
+	w.kexDone.Broadcast()
 }
 
-func newTransport(conn net.Conn, rand io.Reader) *transport {
-	return &transport{
+func newTransport(conn net.Conn, rand io.Reader, config *CryptoConfig) *transport {
+	c := common{
+		packetCipher:   &streamPacketCipher{cipher: noneCipher{}},
+		rekeyThreshold: config.rekeyThreshold(),
+		rekeyInterval:  config.rekeyInterval(),
+	}
+	t := &transport{
 		reader: reader{
 			Reader: bufio.NewReader(conn),
-			common: common{
-				cipher: noneCipher{},
-			},
+			common: c,
 		},
 		writer: writer{
 			Writer: bufio.NewWriter(conn),
 			rand:   rand,
-			common: common{
-				cipher: noneCipher{},
-			},
+			common: c,
 		},
 		Conn: conn,
 	}
+	t.reader.newCompression = newZlibDecompressor
+	t.writer.newCompression = newZlibCompressor
+	t.writer.kexDone = sync.NewCond(&t.writer.Mutex)
+	return t
+}
+
+// startDelayedCompression records that the user is authenticated, and
+// so starts zlib@openssh.com compression if it was negotiated.
+func (t *transport) startDelayedCompression() {
+	t.writer.Mutex.Lock()
+	t.writer.authenticated = true
+	if t.writer.compression == nil {
+		t.writer.resetCompression()
+	}
+	t.writer.Mutex.Unlock()
+
+	t.reader.authenticated = true
+	if t.reader.compression == nil {
+		t.reader.resetCompression()
+	}
 }
 
 type direction struct {
@@ -245,22 +378,42 @@ var (
 // (to setup server->client keys) or clientKeys (for client->server keys).
 func (c *common) setupKeys(d direction, K, H, sessionId []byte, hashFunc crypto.Hash) error {
 	cipherMode := cipherModes[c.cipherAlgo]
+	// macMode is nil for AEAD ciphers, which need no MAC key.
 	macMode := macModes[c.macAlgo]
 
 	iv := make([]byte, cipherMode.ivSize)
 	key := make([]byte, cipherMode.keySize)
-	macKey := make([]byte, macMode.keySize)
+	var macKey []byte
+	if macMode != nil {
+		macKey = make([]byte, macMode.keySize)
+	}
 
 	h := hashFunc.New()
 	generateKeyMaterial(iv, d.ivTag, K, H, sessionId, h)
 	generateKeyMaterial(key, d.keyTag, K, H, sessionId, h)
 	generateKeyMaterial(macKey, d.macKeyTag, K, H, sessionId, h)
 
-	c.mac = macMode.new(macKey)
+	packetCipher, err := cipherMode.createCipher(key, iv, macKey, macMode)
+	if err != nil {
+		return err
+	}
+	c.packetCipher = packetCipher
+	c.bytes = 0
+	c.keyTime = time.Now()
+	c.resetCompression()
+	return nil
+}
 
-	var err error
-	c.cipher, err = cipherMode.createCipher(key, iv)
-	return err
+// resetCompression starts a new compression context for the negotiated
+// algorithm, as the context is initialized after each key exchange.
+func (c *common) resetCompression() {
+	if c.compression != nil {
+		c.compression.close()
+		c.compression = nil
+	}
+	if c.compressionAlgo == compressionZlib || c.compressionAlgo == compressionZlibOpenSSH && c.authenticated {
+		c.compression = c.newCompression()
+	}
 }
 
 // generateKeyMaterial fills out with key material generated from tag, K, H
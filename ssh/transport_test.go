@@ -7,6 +7,9 @@ package ssh
 import (
 	"bufio"
 	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
 	"testing"
 )
 
@@ -49,3 +52,136 @@ func TestReadVersionWithoutCRLF(t *testing.T) {
 		t.Error("readVersion did not notice \\n was missing")
 	}
 }
+
+// rekeyConns returns a client and a server connected by a pipe. The
+// server echoes the data of every channel the client opens.
+func rekeyConns(t *testing.T, clientCrypto, serverCrypto CryptoConfig) (*ClientConn, *ServerConn) {
+	conn1, conn2, err := pipe()
+	if err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	serverConfig := &ServerConfig{
+		PasswordCallback: func(conn *ServerConn, user, password string) bool {
+			return password == "password"
+		},
+		Crypto: serverCrypto,
+	}
+	if err := serverConfig.SetRSAPrivateKey([]byte(testServerPrivateKey)); err != nil {
+		t.Fatalf("SetRSAPrivateKey: %v", err)
+	}
+	server := Server(conn2, serverConfig)
+	go func() {
+		defer server.Close()
+		if err := server.Handshake(); err != nil {
+			t.Errorf("server.Handshake: %v", err)
+			return
+		}
+		for {
+			ch, err := server.Accept()
+			if err != nil {
+				return
+			}
+			ch.Accept()
+			go func() {
+				io.Copy(ch, ch)
+				ch.Close()
+			}()
+		}
+	}()
+
+	client, err := Client(conn1, &ClientConfig{
+		User:   "user",
+		Auth:   []ClientAuth{ClientAuthPassword(password("password"))},
+		Crypto: clientCrypto,
+	})
+	if err != nil {
+		t.Fatalf("Client: %v", err)
+	}
+	return client, server
+}
+
+// testEcho writes n random bytes to conn, calling during once half of
+// them are written, and checks that they are echoed back.
+func testEcho(t *testing.T, conn net.Conn, n int, during func()) {
+	want := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, want); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for i := 0; i < n; i += 1024 {
+			if i == n/2 && during != nil {
+				during()
+			}
+			end := i + 1024
+			if end > n {
+				end = n
+			}
+			if _, err := conn.Write(want[i:end]); err != nil {
+				t.Errorf("Write: %v", err)
+				return
+			}
+		}
+	}()
+	got := make([]byte, n)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("echoed data differs")
+	}
+}
+
+// sendCipher returns the cipher t currently uses for sending.
+func sendCipher(t *transport) packetCipher {
+	t.writer.Lock()
+	defer t.writer.Unlock()
+	return t.writer.packetCipher
+}
+
+func TestRequestKeyChange(t *testing.T) {
+	client, server := rekeyConns(t, CryptoConfig{}, CryptoConfig{})
+	defer client.Close()
+	conn, err := client.Dial("tcp", "127.0.0.1:22")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	clientCipher, serverCipher := sendCipher(client.transport), sendCipher(server.transport)
+	testEcho(t, conn, 64*1024, func() {
+		if err := client.RequestKeyChange(); err != nil {
+			t.Errorf("client RequestKeyChange: %v", err)
+		}
+	})
+	if sendCipher(client.transport) == clientCipher {
+		t.Errorf("client keys did not change")
+	}
+	testEcho(t, conn, 64*1024, func() {
+		if err := server.RequestKeyChange(); err != nil {
+			t.Errorf("server RequestKeyChange: %v", err)
+		}
+	})
+	if sendCipher(server.transport) == serverCipher {
+		t.Errorf("server keys did not change")
+	}
+}
+
+func TestRekeyThreshold(t *testing.T) {
+	client, server := rekeyConns(t, CryptoConfig{RekeyThreshold: 16 * 1024}, CryptoConfig{})
+	defer client.Close()
+	conn, err := client.Dial("tcp", "127.0.0.1:22")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	clientCipher, serverCipher := sendCipher(client.transport), sendCipher(server.transport)
+	testEcho(t, conn, 256*1024, nil)
+	if sendCipher(client.transport) == clientCipher {
+		t.Errorf("client keys did not change")
+	}
+	// The server answers the client's key exchanges.
+	if sendCipher(server.transport) == serverCipher {
+		t.Errorf("server keys did not change")
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// X11 forwarding is described in RFC 4254, section 6.3.
+const (
+	x11RequestType = "x11-req"
+	x11ChannelType = "x11"
+
+	// x11AuthProtocol is the only authentication protocol for which
+	// fake cookies are substituted.
+	x11AuthProtocol = "MIT-MAGIC-COOKIE-1"
+)
+
+// x11SocketDir holds the unix sockets of local X displays.
+var x11SocketDir = "/tmp/.X11-unix"
+
+// x11Forward holds the X11 forwarding setup of a ClientConn.
+type x11Forward struct {
+	network, addr string
+	screen        uint32
+
+	// cookie is the real authentication cookie of the display, and
+	// fakeCookie the one that is sent to the server in its place.
+	cookie, fakeCookie []byte
+}
+
+// parseX11Display splits a display name such as ":0", "unix:0.1" or
+// "localhost:10.0" into the address of its X server and the screen.
+func parseX11Display(display string) (network, addr string, screen uint32, err error) {
+	i := strings.LastIndex(display, ":")
+	if i < 0 {
+		return "", "", 0, fmt.Errorf("ssh: invalid X11 display %q", display)
+	}
+	host, num := display[:i], display[i+1:]
+	if j := strings.Index(num, "."); j >= 0 {
+		s, err := strconv.ParseUint(num[j+1:], 10, 32)
+		if err != nil {
+			return "", "", 0, fmt.Errorf("ssh: invalid X11 display %q", display)
+		}
+		num, screen = num[:j], uint32(s)
+	}
+	n, err := strconv.ParseUint(num, 10, 16)
+	if err != nil || n > 65535-6000 {
+		return "", "", 0, fmt.Errorf("ssh: invalid X11 display %q", display)
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" || host == "unix" {
+		return "unix", fmt.Sprintf("%s/X%d", x11SocketDir, n), screen, nil
+	}
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(6000+int(n))), screen, nil
+}
+
+// ForwardX11 arranges for x11 channels opened by the server, after a call
+// to Session.RequestX11Forwarding, to be relayed to the local X display,
+// such as ":0" or "localhost:10.0". cookie is the display's
+// MIT-MAGIC-COOKIE-1, as printed by "xauth list". The server is only
+// given a random fake cookie, which X11 clients on the remote host must
+// present and which is replaced by cookie before their connections are
+// relayed.
+func (c *ClientConn) ForwardX11(display string, cookie []byte) error {
+	network, addr, screen, err := parseX11Display(display)
+	if err != nil {
+		return err
+	}
+	fake := make([]byte, 16)
+	if _, err := io.ReadFull(c.config.rand(), fake); err != nil {
+		return err
+	}
+
+	c.x11Mu.Lock()
+	defer c.x11Mu.Unlock()
+	c.x11 = &x11Forward{
+		network:    network,
+		addr:       addr,
+		screen:     screen,
+		cookie:     append([]byte(nil), cookie...),
+		fakeCookie: fake,
+	}
+	return nil
+}
+
+func (c *ClientConn) x11Forward() *x11Forward {
+	c.x11Mu.Lock()
+	defer c.x11Mu.Unlock()
+	return c.x11
+}
+
+// RFC 4254 Section 6.3.1.
+type x11RequestMsg struct {
+	PeersId          uint32
+	Request          string
+	WantReply        bool
+	SingleConnection bool
+	AuthProtocol     string
+	AuthCookie       string
+	Screen           uint32
+}
+
+// RequestX11Forwarding asks the server to forward connections to its
+// X11 display back to the client, which must have been set up with
+// ClientConn.ForwardX11. If singleConnection is true, only the first
+// connection is forwarded, and the client refuses any further ones.
+func (s *Session) RequestX11Forwarding(singleConnection bool) error {
+	fwd := s.clientConn.x11Forward()
+	if fwd == nil {
+		return errors.New("ssh: X11 forwarding has not been set up with ForwardX11")
+	}
+	req := x11RequestMsg{
+		PeersId:          s.remoteId,
+		Request:          x11RequestType,
+		WantReply:        true,
+		SingleConnection: singleConnection,
+		AuthProtocol:     x11AuthProtocol,
+		AuthCookie:       hex.EncodeToString(fwd.fakeCookie),
+		Screen:           fwd.screen,
+	}
+	if err := s.writePacket(marshal(msgChannelRequest, req)); err != nil {
+		return err
+	}
+	if err := s.waitForResponse(); err != nil {
+		return err
+	}
+
+	c := s.clientConn
+	c.x11Mu.Lock()
+	defer c.x11Mu.Unlock()
+	if c.x11Sessions == nil {
+		c.x11Sessions = make(map[*Session]bool)
+	}
+	c.x11Sessions[s] = singleConnection
+	return nil
+}
+
+// x11Permitted reports whether the server may open an x11 channel,
+// which requires a session that is still open to have requested X11
+// forwarding. The x11 channel does not tell which session it belongs
+// to, so a session that asked for a single connection is forgotten
+// once any channel has been permitted for it.
+func (c *ClientConn) x11Permitted() bool {
+	c.x11Mu.Lock()
+	defer c.x11Mu.Unlock()
+	var single *Session
+	for s, once := range c.x11Sessions {
+		if ch, ok := c.getChan(s.localId); !ok || ch != s.clientChan {
+			// The session has been closed.
+			delete(c.x11Sessions, s)
+			continue
+		}
+		if !once {
+			return true
+		}
+		single = s
+	}
+	if single == nil {
+		return false
+	}
+	delete(c.x11Sessions, single)
+	return true
+}
+
+// handleX11ChanOpen accepts an x11 channel from the server if X11
+// forwarding has been set up and requested, and relays it to the local
+// display.
+func (c *ClientConn) handleX11ChanOpen(msg *channelOpenMsg) {
+	fwd := c.x11Forward()
+	if fwd == nil || !c.x11Permitted() {
+		c.writePacket(marshal(msgChannelOpenFailure, channelOpenFailureMsg{
+			PeersId:  msg.PeersId,
+			Reason:   Prohibited,
+			Message:  "X11 forwarding was not requested",
+			Language: "en_US.UTF-8",
+		}))
+		return
+	}
+
+	ch := c.acceptChan(msg)
+	go func() {
+		defer ch.Close()
+		setup, err := fwd.readSetup(ch.stdout)
+		if err != nil {
+			return
+		}
+		display, err := net.Dial(fwd.network, fwd.addr)
+		if err != nil {
+			return
+		}
+		defer display.Close()
+		if _, err := display.Write(setup); err != nil {
+			return
+		}
+		go io.Copy(display, ch.stdout)
+		io.Copy(ch.stdin, display)
+	}()
+}
+
+// pad4 returns n rounded up to a multiple of four.
+func pad4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// readSetup reads the connection setup message that starts every X11
+// connection, checks that it carries the fake cookie and returns it with
+// the real cookie in its place.
+func (fwd *x11Forward) readSetup(r io.Reader) ([]byte, error) {
+	// The setup starts with a byte order byte, a pad byte, the
+	// protocol version, the lengths of the authorization protocol
+	// name and data, and two pad bytes.
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch header[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return nil, errors.New("ssh: invalid X11 byte order")
+	}
+	nameLen := int(order.Uint16(header[6:]))
+	dataLen := int(order.Uint16(header[8:]))
+
+	auth := make([]byte, pad4(nameLen)+pad4(dataLen))
+	if _, err := io.ReadFull(r, auth); err != nil {
+		return nil, err
+	}
+	name := auth[:nameLen]
+	data := auth[pad4(nameLen) : pad4(nameLen)+dataLen]
+	if string(name) != x11AuthProtocol || subtle.ConstantTimeCompare(data, fwd.fakeCookie) != 1 {
+		return nil, errors.New("ssh: X11 connection with an invalid cookie")
+	}
+
+	order.PutUint16(header[8:], uint16(len(fwd.cookie)))
+	setup := append(header, auth[:pad4(nameLen)]...)
+	setup = append(setup, fwd.cookie...)
+	return append(setup, make([]byte, pad4(len(fwd.cookie))-len(fwd.cookie))...), nil
+}
+
+// OpenX11Channel opens an x11 channel to the client, which must have
+// requested X11 forwarding on one of its sessions, for a connection to
+// the forwarded display from originAddr and originPort. The X11 client's
+// data, starting with its connection setup, is written to the returned
+// Channel. As with OpenChannel, Accept must be running in another
+// goroutine.
+func (s *ServerConn) OpenX11Channel(originAddr string, originPort uint32) (Channel, error) {
+	return s.OpenChannel(x11ChannelType, appendU32(appendString(nil, originAddr), originPort))
+}
@@ -0,0 +1,222 @@
+// Copyright 2013 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestParseX11Display(t *testing.T) {
+	for _, c := range []struct {
+		display, network, addr string
+		screen                 uint32
+	}{
+		{":0", "unix", x11SocketDir + "/X0", 0},
+		{"unix:3.1", "unix", x11SocketDir + "/X3", 1},
+		{"localhost:10.0", "tcp", "localhost:6010", 0},
+		{"[::1]:2", "tcp", "[::1]:6002", 0},
+	} {
+		network, addr, screen, err := parseX11Display(c.display)
+		if err != nil {
+			t.Errorf("%s: %v", c.display, err)
+			continue
+		}
+		if network != c.network || addr != c.addr || screen != c.screen {
+			t.Errorf("%s: got %s %s %d, want %s %s %d", c.display, network, addr, screen, c.network, c.addr, c.screen)
+		}
+	}
+	for _, display := range []string{"", "localhost", ":x", ":0.x", ":70000"} {
+		if _, _, _, err := parseX11Display(display); err == nil {
+			t.Errorf("%q: parsing succeeded", display)
+		}
+	}
+}
+
+// x11Setup returns a little endian X11 connection setup carrying cookie.
+func x11Setup(cookie []byte) []byte {
+	setup := []byte{'l', 0, 11, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(setup[6:], uint16(len(x11AuthProtocol)))
+	binary.LittleEndian.PutUint16(setup[8:], uint16(len(cookie)))
+	setup = append(setup, x11AuthProtocol+"\x00\x00"...)
+	return append(setup, cookie...)
+}
+
+// x11Handler waits for X11 forwarding to be requested, then connects to
+// the client's display as an X11 client would, with the cookie given
+// in the request, and copies what the display answers to stdout. With
+// the exec request "bad-cookie", it uses another cookie.
+func x11Handler(ch *serverChan, t *testing.T) {
+	defer ch.Close()
+	s := &ServerSession{ch}
+	var cookie []byte
+	for cookie == nil || len(cookie) > 0 {
+		_, err := s.Read(nil)
+		switch req := err.(type) {
+		case *X11Request:
+			if req.AuthProtocol != x11AuthProtocol || req.Screen != 1 {
+				t.Errorf("got X11 request %+v", req)
+			}
+			if cookie, err = hex.DecodeString(req.AuthCookie); err != nil {
+				t.Errorf("invalid cookie %q", req.AuthCookie)
+			}
+			s.AckRequest(true)
+		case *ExecRequest:
+			if req.Command == "bad-cookie" {
+				cookie = make([]byte, len(cookie))
+			}
+			s.AckRequest(true)
+			x11, err := ch.serverConn.OpenX11Channel("127.0.0.1", 4242)
+			if err != nil {
+				t.Errorf("OpenX11Channel: %v", err)
+				return
+			}
+			x11.Write(x11Setup(cookie))
+			x11.Write([]byte("ping"))
+			io.Copy(s, x11)
+			x11.Close()
+			s.SendExitStatus(0)
+			return
+		default:
+			t.Errorf("unexpected request %v", err)
+			return
+		}
+	}
+}
+
+func TestX11Forwarding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "x11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { x11SocketDir = old }(x11SocketDir)
+	x11SocketDir = dir
+
+	// The display checks the real cookie and answers "pong".
+	realCookie := []byte("0123456789abcdef0123")
+	l, err := net.Listen("unix", dir+"/X7")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			want := append(x11Setup(realCookie), "ping"...)
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("display got %q, %v, want %q", got, err, want)
+			}
+			conn.Write([]byte("pong"))
+			conn.Close()
+		}
+	}()
+
+	for _, c := range []struct {
+		cmd, want string
+	}{
+		{"xclock", "pong"},
+		{"bad-cookie", ""},
+	} {
+		conn := dial(x11Handler, t)
+		session, err := conn.NewSession()
+		if err != nil {
+			t.Fatalf("NewSession: %v", err)
+		}
+		if err := session.RequestX11Forwarding(false); err == nil {
+			t.Errorf("RequestX11Forwarding succeeded without ForwardX11")
+		}
+		if err := conn.ForwardX11(":7.1", realCookie); err != nil {
+			t.Fatalf("ForwardX11: %v", err)
+		}
+		if err := session.RequestX11Forwarding(false); err != nil {
+			t.Fatalf("RequestX11Forwarding: %v", err)
+		}
+		out, err := session.Output(c.cmd)
+		if err != nil {
+			t.Fatalf("%s: Output: %v", c.cmd, err)
+		}
+		if string(out) != c.want {
+			t.Errorf("%s: got %q, want %q", c.cmd, out, c.want)
+		}
+		session.Close()
+		conn.Close()
+	}
+}
+
+// x11OpenHandler acknowledges X11 forwarding requests and, when asked to
+// run a command, tries to open two x11 channels and prints for each of
+// them whether the client accepted it.
+func x11OpenHandler(ch *serverChan, t *testing.T) {
+	defer ch.Close()
+	s := &ServerSession{ch}
+	for {
+		_, err := s.Read(nil)
+		switch err.(type) {
+		case *X11Request:
+			s.AckRequest(true)
+		case *ExecRequest:
+			s.AckRequest(true)
+			for i := 0; i < 2; i++ {
+				x11, err := ch.serverConn.OpenX11Channel("127.0.0.1", 4242)
+				if err != nil {
+					s.Write([]byte("refused "))
+					continue
+				}
+				x11.Close()
+				s.Write([]byte("accepted "))
+			}
+			s.SendExitStatus(0)
+			return
+		default:
+			t.Errorf("unexpected request %v", err)
+			return
+		}
+	}
+}
+
+func TestX11ForwardingRequested(t *testing.T) {
+	for _, c := range []struct {
+		request, single bool
+		want            string
+	}{
+		{false, false, "refused refused "},
+		{true, true, "accepted refused "},
+		{true, false, "accepted accepted "},
+	} {
+		conn := dial(x11OpenHandler, t)
+		if err := conn.ForwardX11(":7", []byte("cookie")); err != nil {
+			t.Fatalf("ForwardX11: %v", err)
+		}
+		session, err := conn.NewSession()
+		if err != nil {
+			t.Fatalf("NewSession: %v", err)
+		}
+		if c.request {
+			if err := session.RequestX11Forwarding(c.single); err != nil {
+				t.Fatalf("RequestX11Forwarding: %v", err)
+			}
+		}
+		out, err := session.Output("xclock")
+		if err != nil {
+			t.Fatalf("Output: %v", err)
+		}
+		if string(out) != c.want {
+			t.Errorf("request=%v single=%v: got %q, want %q", c.request, c.single, out, c.want)
+		}
+		session.Close()
+		conn.Close()
+	}
+}